@@ -0,0 +1,660 @@
+package azblob
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/streaming"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blockblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/container"
+	"github.com/uw-labs/straw"
+	"github.com/uw-labs/straw/cache"
+)
+
+var _ straw.StreamStore = &azblobStreamStore{}
+
+func init() {
+	open := func(u *url.URL) (straw.StreamStore, error) {
+		opts, err := optionsFromURL(u)
+		if err != nil {
+			return nil, err
+		}
+		ss, err := newAzblobStreamStore(u.Host, opts)
+		if err != nil {
+			return nil, err
+		}
+		// A path in the URL roots the store at that prefix in the container.
+		if u.Path != "" && u.Path != "/" {
+			return straw.Sub(ss, u.Path), nil
+		}
+		return ss, nil
+	}
+	straw.Register("az", open)
+	straw.Register("azblob", open)
+}
+
+// Options configures an Azure Blob Storage backed StreamStore.  One of
+// ConnectionString, AccountKey or Anonymous must be set.
+type Options struct {
+	// ConnectionString is a storage account connection string, which
+	// carries both the endpoint and the credentials.  When set, the other
+	// fields are ignored.
+	ConnectionString string
+	// Account is the storage account name.
+	Account string
+	// AccountKey is the shared key for Account.
+	AccountKey string
+	// Endpoint overrides the blob service URL, which otherwise defaults to
+	// `https://<account>.blob.core.windows.net/`.  For Azurite this is
+	// something like `http://127.0.0.1:10000/devstoreaccount1`.
+	Endpoint string
+	// Anonymous accesses a public container without any credentials.
+	Anonymous bool
+	// TTLOptions sets how long the results of lookups are cached for.
+	cache.TTLOptions
+}
+
+// NewStreamStore returns a StreamStore for the given container.
+func NewStreamStore(containerName string, opts Options) (straw.StreamStore, error) {
+	return newAzblobStreamStore(containerName, opts)
+}
+
+// optionsFromURL reads the `account`, `endpoint`, `anonymous`,
+// `metadata_ttl` and `negative_metadata_ttl` query parameters.  Credentials
+// are never taken from the URL itself.  Instead the account key comes from
+// `AZURE_STORAGE_KEY`, and when no account is given in the URL a connection
+// string in `AZURE_STORAGE_CONNECTION_STRING` is used, falling back to the
+// account in `AZURE_STORAGE_ACCOUNT`.
+func optionsFromURL(u *url.URL) (Options, error) {
+	q := u.Query()
+	opts := Options{
+		Account:    q.Get("account"),
+		AccountKey: os.Getenv("AZURE_STORAGE_KEY"),
+		Endpoint:   q.Get("endpoint"),
+	}
+	anon := q.Get("anonymous")
+	if anon != "" {
+		b, err := strconv.ParseBool(anon)
+		if err != nil {
+			return Options{}, fmt.Errorf("invalid %q query parameter: %w", "anonymous", err)
+		}
+		opts.Anonymous = b
+	}
+	ttls, err := cache.TTLOptionsFromQuery(q)
+	if err != nil {
+		return Options{}, err
+	}
+	opts.TTLOptions = ttls
+	if opts.Account == "" {
+		opts.ConnectionString = os.Getenv("AZURE_STORAGE_CONNECTION_STRING")
+		opts.Account = os.Getenv("AZURE_STORAGE_ACCOUNT")
+	}
+	return opts, nil
+}
+
+func newAzblobStreamStore(containerName string, opts Options) (*azblobStreamStore, error) {
+	if containerName == "" {
+		return nil, errors.New("no container name given")
+	}
+
+	var client *container.Client
+	var err error
+	switch {
+	case opts.ConnectionString != "":
+		client, err = container.NewClientFromConnectionString(opts.ConnectionString, containerName, nil)
+	default:
+		endpoint := opts.Endpoint
+		if endpoint == "" {
+			if opts.Account == "" {
+				return nil, errors.New("no storage account or connection string given")
+			}
+			endpoint = fmt.Sprintf("https://%s.blob.core.windows.net/", opts.Account)
+		}
+		containerURL := strings.TrimSuffix(endpoint, "/") + "/" + url.PathEscape(containerName)
+
+		switch {
+		case opts.Anonymous:
+			client, err = container.NewClientWithNoCredential(containerURL, nil)
+		case opts.AccountKey != "":
+			if opts.Account == "" {
+				return nil, errors.New("an account key needs an account name")
+			}
+			var cred *container.SharedKeyCredential
+			cred, err = container.NewSharedKeyCredential(opts.Account, opts.AccountKey)
+			if err != nil {
+				return nil, err
+			}
+			client, err = container.NewClientWithSharedKeyCredential(containerURL, cred, nil)
+		default:
+			return nil, errors.New("no azure storage credentials given")
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ss := &azblobStreamStore{
+		ctx:    context.Background(),
+		client: client,
+		meta:   opts.TTLOptions.Cache(),
+	}
+	return ss, nil
+}
+
+type azblobStreamStore struct {
+	ctx    context.Context
+	client *container.Client
+	// meta caches Stat and Readdir results, if enabled.
+	meta *cache.MetadataCache
+}
+
+func (fs *azblobStreamStore) Close() error {
+	return nil
+}
+
+func (fs *azblobStreamStore) Lstat(name string) (os.FileInfo, error) {
+	// Azure blob storage does not support symlinks
+	return fs.Stat(name)
+}
+
+func (fs *azblobStreamStore) Stat(name string) (os.FileInfo, error) {
+	return fs.meta.Stat(name, fs.stat)
+}
+
+// stat first fetches the properties of the exact blob, and only if that is
+// not found falls back to listing a single blob beneath `name/` to detect an
+// implicit directory.  As with the s3 backend, a blob `name` takes precedence
+// over blobs beneath `name/`.
+func (fs *azblobStreamStore) stat(name string) (os.FileInfo, error) {
+	name = fs.noSlashPrefix(name)
+	name = fs.noSlashSuffix(name)
+
+	if name == "" {
+		return &azblobStatResult{
+			name:  "/",
+			isDir: true,
+			size:  4096,
+		}, nil
+	}
+
+	props, err := fs.client.NewBlobClient(name).GetProperties(fs.ctx, nil)
+	if err == nil {
+		return &azblobStatResult{
+			name:    fs.lastElem(name),
+			modTime: timeValue(props.LastModified),
+			size:    int64Value(props.ContentLength),
+			etag:    etagValue(props.ETag),
+		}, nil
+	}
+	if !isNotFound(err) {
+		return nil, err
+	}
+
+	return fs.statDir(name)
+}
+
+// statDir reports name as a directory if any blob exists beneath `name/`,
+// which is either an explicit directory marker or an implicit directory.
+func (fs *azblobStreamStore) statDir(name string) (os.FileInfo, error) {
+	prefix := name + "/"
+	pager := fs.client.NewListBlobsFlatPager(&container.ListBlobsFlatOptions{
+		Prefix:     to.Ptr(prefix),
+		MaxResults: to.Ptr(int32(1)),
+	})
+	page, err := pager.NextPage(fs.ctx)
+	if err != nil {
+		return nil, err
+	}
+	if page.Segment == nil || len(page.Segment.BlobItems) == 0 {
+		return nil, os.ErrNotExist
+	}
+
+	res := &azblobStatResult{
+		name:  fs.lastElem(name),
+		isDir: true,
+		size:  4096,
+	}
+	// The directory marker, if there is one, sorts before any other blob
+	// with the same prefix.
+	item := page.Segment.BlobItems[0]
+	if item.Name != nil && *item.Name == prefix && item.Properties != nil {
+		res.modTime = timeValue(item.Properties.LastModified)
+	}
+	return res, nil
+}
+
+// isNotFound reports whether err is a missing blob.  GetProperties has no
+// response body, so only the status code is reliable.
+func isNotFound(err error) bool {
+	var re *azcore.ResponseError
+	return errors.As(err, &re) && re.StatusCode == http.StatusNotFound
+}
+
+func isInvalidRange(err error) bool {
+	var re *azcore.ResponseError
+	return errors.As(err, &re) && re.StatusCode == http.StatusRequestedRangeNotSatisfiable
+}
+
+func timeValue(t *time.Time) time.Time {
+	if t == nil {
+		return time.Time{}
+	}
+	return *t
+}
+
+func int64Value(i *int64) int64 {
+	if i == nil {
+		return 0
+	}
+	return *i
+}
+
+func etagValue(e *azcore.ETag) string {
+	if e == nil {
+		return ""
+	}
+	return string(*e)
+}
+
+type azblobStatResult struct {
+	name    string
+	isDir   bool
+	modTime time.Time
+	size    int64
+	etag    string
+}
+
+func (sr *azblobStatResult) Name() string {
+	return sr.name
+}
+
+func (sr *azblobStatResult) IsDir() bool {
+	return sr.isDir
+}
+
+func (sr *azblobStatResult) Size() int64 {
+	return sr.size
+}
+
+func (sr *azblobStatResult) ModTime() time.Time {
+	return sr.modTime
+}
+
+func (sr *azblobStatResult) ETag() string {
+	return sr.etag
+}
+
+func (sr *azblobStatResult) Mode() os.FileMode {
+	if sr.IsDir() {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}
+
+func (sr *azblobStatResult) Sys() interface{} {
+	return nil
+}
+
+// OpenReadCloser starts the download straight away, so size, mtime and
+// existence all come from a single request.  Only when there is no such blob
+// does it list beneath `name/` to tell a directory from a missing file.
+func (fs *azblobStreamStore) OpenReadCloser(name string) (straw.StrawReader, error) {
+	key := fs.noSlashSuffix(fs.noSlashPrefix(name))
+	if key == "" {
+		return nil, fmt.Errorf("%s is a directory", name)
+	}
+
+	bc := fs.client.NewBlobClient(key)
+	out, err := bc.DownloadStream(fs.ctx, nil)
+	if err != nil {
+		if !isNotFound(err) {
+			return nil, err
+		}
+		if _, err := fs.statDir(key); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%s is a directory", name)
+	}
+
+	fi := &azblobStatResult{
+		name:    fs.lastElem(key),
+		modTime: timeValue(out.LastModified),
+		size:    int64Value(out.ContentLength),
+		etag:    etagValue(out.ETag),
+	}
+	return &azblobReader{out.Body, fs.ctx, bc, -1, fi}, nil
+}
+
+type azblobReader struct {
+	rc io.ReadCloser
+
+	ctx    context.Context
+	client *blob.Client
+
+	// -1 means don't seek
+	seek int64
+
+	fi os.FileInfo
+}
+
+// Stat returns the FileInfo from the response to the initial download,
+// without making another request.
+func (r *azblobReader) Stat() (os.FileInfo, error) {
+	return r.fi, nil
+}
+
+func (r *azblobReader) Seek(start int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+		if start < 0 {
+			return 0, errors.New("invalid seek position")
+		}
+		r.seek = start
+		return start, nil
+	default:
+		return 0, fmt.Errorf("seek %d not currently supported in azblob backend", whence)
+	}
+}
+
+func (r *azblobReader) Read(buf []byte) (int, error) {
+	if r.seek != -1 {
+		// we have a deferred seek to do before we read.
+		err := r.rc.Close()
+		if err != nil {
+			return 0, err
+		}
+		r.rc = eofRdr
+
+		out, err := r.client.DownloadStream(r.ctx, &blob.DownloadStreamOptions{
+			Range: blob.HTTPRange{Offset: r.seek},
+		})
+		if err != nil {
+			if isNotFound(err) {
+				return 0, os.ErrNotExist
+			}
+			if isInvalidRange(err) {
+				return 0, io.EOF
+			}
+			return 0, err
+		}
+		r.rc = out.Body
+		r.seek = -1
+	}
+
+	return r.rc.Read(buf)
+}
+
+func (r *azblobReader) Close() error {
+	return r.rc.Close()
+}
+
+func (r *azblobReader) ReadAt(buf []byte, start int64) (int, error) {
+	if len(buf) == 0 {
+		return 0, nil
+	}
+	out, err := r.client.DownloadStream(r.ctx, &blob.DownloadStreamOptions{
+		Range: blob.HTTPRange{Offset: start, Count: int64(len(buf))},
+	})
+	if err != nil {
+		if isNotFound(err) {
+			return 0, os.ErrNotExist
+		}
+		if isInvalidRange(err) {
+			return 0, io.EOF
+		}
+		return 0, err
+	}
+	all, err := ioutil.ReadAll(out.Body)
+	if err != nil {
+		_ = out.Body.Close()
+		return 0, err
+	}
+
+	copy(buf, all)
+
+	err = out.Body.Close()
+
+	switch {
+	case len(all) == len(buf):
+		return len(all), err
+	case len(all) < len(buf):
+		return len(all), io.EOF
+	default:
+		panic(fmt.Sprintf("only expected up to %d bytes but got %d", len(buf), len(all)))
+	}
+}
+
+// Mkdir writes an empty `name/` marker blob, the same convention the s3
+// backend uses for directories.
+func (fs *azblobStreamStore) Mkdir(name string, mode os.FileMode) error {
+	if !strings.HasSuffix(name, "/") {
+		name = name + "/"
+	}
+
+	if err := fs.checkParentDir(name); err != nil {
+		return err
+	}
+
+	if _, err := fs.Stat(name); err == nil {
+		return fmt.Errorf("%s : file exists", name)
+	}
+
+	_, err := fs.client.NewBlockBlobClient(fs.noSlashPrefix(name)).Upload(
+		fs.ctx,
+		streaming.NopCloser(bytes.NewReader(nil)),
+		&blockblob.UploadOptions{
+			HTTPHeaders: &blob.HTTPHeaders{BlobContentType: to.Ptr("application/x-directory")},
+		},
+	)
+	fs.meta.Created(name)
+	return err
+}
+
+func (fs *azblobStreamStore) checkParentDir(child string) error {
+	child = fs.noSlashPrefix(child)
+	child = fs.noSlashSuffix(child)
+
+	d, _ := filepath.Split(child)
+	if d != "" {
+		fi, err := fs.Stat(d)
+		if err != nil {
+			return err
+		}
+		if !fi.IsDir() {
+			return fmt.Errorf("%s not a directory", d)
+		}
+	}
+	return nil
+}
+
+func (fs *azblobStreamStore) Remove(name string) error {
+	fi, err := fs.Stat(name)
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		files, err := fs.Readdir(name)
+		if err != nil {
+			return err
+		}
+		if len(files) != 0 {
+			return fmt.Errorf("%s : directory not empty", name)
+		}
+	}
+
+	key := fs.fixTrailingSlash(fs.noSlashPrefix(name), fi.IsDir())
+	_, err = fs.client.NewBlobClient(key).Delete(fs.ctx, nil)
+	fs.meta.Removed(name)
+	if err != nil && fi.IsDir() && isNotFound(err) {
+		// An implicit directory has no marker to delete.
+		return nil
+	}
+	return err
+}
+
+func (fs *azblobStreamStore) CreateWriteCloser(name string) (straw.StrawWriter, error) {
+	name = fs.noSlashPrefix(name)
+
+	if err := fs.checkParentDir(name); err != nil {
+		return nil, err
+	}
+
+	if fi, err := fs.Stat(name); err == nil && fi.IsDir() {
+		return nil, fmt.Errorf("%s is a directory", name)
+	}
+
+	bbc := fs.client.NewBlockBlobClient(name)
+
+	pr, pw := io.Pipe()
+
+	errCh := make(chan error, 1)
+
+	go func() {
+		_, err := bbc.UploadStream(fs.ctx, pr, nil)
+		// Unblock any writer if the upload gave up early.
+		pr.CloseWithError(err)
+		errCh <- err
+	}()
+
+	ul := &azblobUploader{
+		errCh,
+		pw,
+		func() { fs.meta.Created(name) },
+	}
+	return ul, nil
+}
+
+func (fs *azblobStreamStore) noSlashPrefix(s string) string {
+	if strings.HasPrefix(s, "/") {
+		return s[1:]
+	}
+	return s
+}
+
+func (fs *azblobStreamStore) noSlashSuffix(s string) string {
+	if strings.HasSuffix(s, "/") {
+		return s[:len(s)-1]
+	}
+	return s
+}
+
+func (fs *azblobStreamStore) fixTrailingSlash(s string, wantSlash bool) string {
+	if wantSlash {
+		if !strings.HasSuffix(s, "/") {
+			return s + "/"
+		}
+	} else {
+		if strings.HasSuffix(s, "/") {
+			return s[0 : len(s)-1]
+		}
+	}
+	return s
+}
+
+func (fs *azblobStreamStore) lastElem(s string) string {
+	_, f := filepath.Split(fs.noSlashSuffix(s))
+	return f
+}
+
+type azblobUploader struct {
+	errCh chan error
+	wc    io.WriteCloser
+	// done is called once the upload has finished.
+	done func()
+}
+
+func (wc *azblobUploader) Write(data []byte) (int, error) {
+	return wc.wc.Write(data)
+}
+
+func (wc *azblobUploader) Close() error {
+	err := wc.wc.Close()
+	if err != nil {
+		return err
+	}
+	err = <-wc.errCh
+	wc.done()
+	return err
+}
+
+func (fs *azblobStreamStore) Readdir(name string) ([]os.FileInfo, error) {
+	return fs.meta.Readdir(name, fs.readdir)
+}
+
+func (fs *azblobStreamStore) readdir(name string) ([]os.FileInfo, error) {
+	if !strings.HasSuffix(name, "/") {
+		name = name + "/"
+	}
+	if strings.HasPrefix(name, "/") {
+		name = name[1:]
+	}
+
+	var results []os.FileInfo
+
+	pager := fs.client.NewListBlobsHierarchyPager("/", &container.ListBlobsHierarchyOptions{
+		Prefix: to.Ptr(name),
+	})
+	for pager.More() {
+		page, err := pager.NextPage(fs.ctx)
+		if err != nil {
+			return nil, err
+		}
+		if page.Segment == nil {
+			continue
+		}
+		for _, item := range page.Segment.BlobItems {
+			if *item.Name == name {
+				continue
+			}
+			result := &azblobStatResult{
+				name: strings.TrimPrefix(*item.Name, name),
+			}
+			if item.Properties != nil {
+				result.modTime = timeValue(item.Properties.LastModified)
+				result.size = int64Value(item.Properties.ContentLength)
+				result.etag = etagValue(item.Properties.ETag)
+			}
+			results = append(results, result)
+		}
+		for _, prefix := range page.Segment.BlobPrefixes {
+			result := &azblobStatResult{
+				name:  fs.noSlashSuffix(strings.TrimPrefix(*prefix.Name, name)),
+				isDir: true,
+				size:  4096,
+			}
+			results = append(results, result)
+		}
+	}
+
+	sort.Slice(results, func(i, j int) bool { return results[i].Name() < results[j].Name() })
+	return results, nil
+}
+
+var (
+	eofRdr = &eofReader{}
+)
+
+type eofReader struct{}
+
+func (r *eofReader) Read(buf []byte) (int, error) {
+	return 0, io.EOF
+}
+
+func (r *eofReader) Close() error {
+	return nil
+}
@@ -0,0 +1,661 @@
+package bolt
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/uw-labs/straw"
+	"github.com/uw-labs/straw/internal/chunked"
+	"go.etcd.io/bbolt"
+)
+
+var _ straw.StreamStore = &boltStreamStore{}
+
+func init() {
+	straw.Register("bolt", func(u *url.URL) (straw.StreamStore, error) {
+		opts, err := optionsFromURL(u)
+		if err != nil {
+			return nil, err
+		}
+		db, err := bbolt.Open(u.Path, 0600, &bbolt.Options{Timeout: opts.Timeout})
+		if err != nil {
+			return nil, err
+		}
+		ss, err := newBoltStreamStore(db, opts)
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+		ss.closeDB = true
+		return ss, nil
+	})
+}
+
+// DefaultPageSize is the size of the pages file content is stored in.
+const DefaultPageSize = 64 * 1024
+
+// Options configures a bbolt backed StreamStore.
+type Options struct {
+	// Bucket names the top level bucket everything is kept under, so the
+	// database can be shared with other data.  Defaults to `straw`.
+	Bucket string
+	// PageSize is the size of the pages new content is split into.
+	// Defaults to DefaultPageSize.  Existing files keep the page size they
+	// were written with.
+	PageSize int
+	// Timeout is how long to wait for the lock on the database file when it
+	// is opened from a URL.  Zero waits forever.
+	Timeout time.Duration
+}
+
+// NewStreamStore returns a StreamStore keeping its files in db.  Content
+// left behind by writers that were never closed is discarded, other than
+// that of writers still open on db, which may belong to another
+// StreamStore using the same bucket.  Closing the returned StreamStore does
+// not close db.
+func NewStreamStore(db *bbolt.DB, opts Options) (straw.StreamStore, error) {
+	return newBoltStreamStore(db, opts)
+}
+
+// optionsFromURL reads the `bucket`, `page_size` and `timeout` query
+// parameters.
+func optionsFromURL(u *url.URL) (Options, error) {
+	q := u.Query()
+	opts := Options{Bucket: q.Get("bucket")}
+	if ps := q.Get("page_size"); ps != "" {
+		n, err := strconv.Atoi(ps)
+		if err != nil || n <= 0 {
+			return Options{}, fmt.Errorf("invalid %q query parameter: %q", "page_size", ps)
+		}
+		opts.PageSize = n
+	}
+	if t := q.Get("timeout"); t != "" {
+		d, err := time.ParseDuration(t)
+		if err != nil {
+			return Options{}, fmt.Errorf("invalid %q query parameter: %w", "timeout", err)
+		}
+		opts.Timeout = d
+	}
+	return opts, nil
+}
+
+var (
+	rootBucket    = []byte("root")
+	contentBucket = []byte("content")
+	// metaKey holds a directory's own metadata in its bucket.  It can never
+	// clash with an entry, as names don't contain a slash.
+	metaKey = []byte("/")
+)
+
+func newBoltStreamStore(db *bbolt.DB, opts Options) (*boltStreamStore, error) {
+	if opts.Bucket == "" {
+		opts.Bucket = "straw"
+	}
+	if opts.PageSize == 0 {
+		opts.PageSize = DefaultPageSize
+	}
+	if opts.PageSize < 0 {
+		return nil, errors.New("page size must be positive")
+	}
+
+	fs := &boltStreamStore{db: db, bucket: []byte(opts.Bucket), pageSize: opts.PageSize}
+	err := db.Update(func(tx *bbolt.Tx) error {
+		top, err := tx.CreateBucketIfNotExists(fs.bucket)
+		if err != nil {
+			return err
+		}
+		root, err := top.CreateBucketIfNotExists(rootBucket)
+		if err != nil {
+			return err
+		}
+		if root.Get(metaKey) == nil {
+			if err := putMeta(root, metaKey, &boltMeta{Mode: 0755, ModTime: time.Now().UnixNano()}); err != nil {
+				return err
+			}
+		}
+		content, err := top.CreateBucketIfNotExists(contentBucket)
+		if err != nil {
+			return err
+		}
+		return collectGarbage(root, content, func(id uint64) bool {
+			return writing.has(db, opts.Bucket, id)
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return fs, nil
+}
+
+// collectGarbage deletes content that no file refers to, which is what a
+// writer that was never closed leaves behind, unless open says the writer
+// is still open.
+func collectGarbage(root, content *bbolt.Bucket, open func(id uint64) bool) error {
+	used := map[uint64]bool{}
+	var walk func(b *bbolt.Bucket) error
+	walk = func(b *bbolt.Bucket) error {
+		return b.ForEach(func(k, v []byte) error {
+			if v == nil {
+				return walk(b.Bucket(k))
+			}
+			if string(k) == string(metaKey) {
+				return nil
+			}
+			m, err := decodeMeta(v)
+			if err != nil {
+				return err
+			}
+			used[m.Content] = true
+			return nil
+		})
+	}
+	if err := walk(root); err != nil {
+		return err
+	}
+
+	var unused [][]byte
+	err := content.ForEach(func(k, v []byte) error {
+		id := binary.BigEndian.Uint64(k)
+		if !used[id] && !open(id) {
+			unused = append(unused, append([]byte(nil), k...))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, k := range unused {
+		if err := content.DeleteBucket(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writing holds the content of writers that are not yet closed, for
+// collectGarbage to leave alone.  bbolt locks the database file, so they
+// can only be in this process.
+var writing = writers{ids: map[writerKey]bool{}}
+
+type writers struct {
+	lk  sync.Mutex
+	ids map[writerKey]bool
+}
+
+type writerKey struct {
+	db     *bbolt.DB
+	bucket string
+	id     uint64
+}
+
+func (w *writers) add(db *bbolt.DB, bucket string, id uint64) {
+	w.lk.Lock()
+	defer w.lk.Unlock()
+	w.ids[writerKey{db, bucket, id}] = true
+}
+
+func (w *writers) remove(db *bbolt.DB, bucket string, id uint64) {
+	w.lk.Lock()
+	defer w.lk.Unlock()
+	delete(w.ids, writerKey{db, bucket, id})
+}
+
+func (w *writers) has(db *bbolt.DB, bucket string, id uint64) bool {
+	w.lk.Lock()
+	defer w.lk.Unlock()
+	return w.ids[writerKey{db, bucket, id}]
+}
+
+// boltStreamStore keeps the same tree as the mem backend.  Each directory
+// is a bucket nested in its parent, holding its own metadata under metaKey
+// and a key for each file it contains.  A file's value is its metadata,
+// which points at a bucket of fixed size pages in the content bucket.
+type boltStreamStore struct {
+	db       *bbolt.DB
+	bucket   []byte
+	pageSize int
+	// closeDB is set when the database was opened from a URL.
+	closeDB bool
+}
+
+// boltMeta is stored as JSON for both files and directories.
+type boltMeta struct {
+	Mode     os.FileMode `json:"mode"`
+	ModTime  int64       `json:"mtime"`
+	Size     int64       `json:"size,omitempty"`
+	Content  uint64      `json:"content,omitempty"`
+	PageSize int         `json:"page_size,omitempty"`
+}
+
+func decodeMeta(v []byte) (*boltMeta, error) {
+	m := &boltMeta{}
+	if err := json.Unmarshal(v, m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func putMeta(b *bbolt.Bucket, key []byte, m *boltMeta) error {
+	v, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return b.Put(key, v)
+}
+
+func itob(i uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, i)
+	return b
+}
+
+func (fs *boltStreamStore) Close() error {
+	if fs.closeDB {
+		return fs.db.Close()
+	}
+	return nil
+}
+
+func split(name string) []string {
+	p := path.Clean("/" + name)
+	if p == "/" {
+		return nil
+	}
+	return strings.Split(p[1:], "/")
+}
+
+func (fs *boltStreamStore) root(tx *bbolt.Tx) *bbolt.Bucket {
+	return tx.Bucket(fs.bucket).Bucket(rootBucket)
+}
+
+func (fs *boltStreamStore) content(tx *bbolt.Tx) *bbolt.Bucket {
+	return tx.Bucket(fs.bucket).Bucket(contentBucket)
+}
+
+// dir returns the bucket for the directory made of elems.  If it doesn't
+// exist the error is a not exist PathError, and if one of elems is a file
+// it says which.
+func (fs *boltStreamStore) dir(tx *bbolt.Tx, op, name string, elems []string) (*bbolt.Bucket, error) {
+	b := fs.root(tx)
+	for i, elem := range elems {
+		child := b.Bucket([]byte(elem))
+		if child == nil {
+			if b.Get([]byte(elem)) != nil {
+				return nil, fmt.Errorf("/%s not a directory", strings.Join(elems[:i+1], "/"))
+			}
+			return nil, &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+		}
+		b = child
+	}
+	return b, nil
+}
+
+type boltStatResult struct {
+	name  string
+	isDir bool
+	meta  *boltMeta
+}
+
+func (sr *boltStatResult) Name() string {
+	return sr.name
+}
+
+func (sr *boltStatResult) IsDir() bool {
+	return sr.isDir
+}
+
+func (sr *boltStatResult) Size() int64 {
+	if sr.isDir {
+		return 4096
+	}
+	return sr.meta.Size
+}
+
+func (sr *boltStatResult) ModTime() time.Time {
+	return time.Unix(0, sr.meta.ModTime)
+}
+
+func (sr *boltStatResult) Mode() os.FileMode {
+	if sr.isDir {
+		return sr.meta.Mode | os.ModeDir
+	}
+	return sr.meta.Mode
+}
+
+func (sr *boltStatResult) Sys() interface{} {
+	return nil
+}
+
+// entry returns the named child of b, or nil if there isn't one.
+func entry(b *bbolt.Bucket, name string) (*boltStatResult, error) {
+	if child := b.Bucket([]byte(name)); child != nil {
+		m, err := decodeMeta(child.Get(metaKey))
+		if err != nil {
+			return nil, err
+		}
+		return &boltStatResult{name: name, isDir: true, meta: m}, nil
+	}
+	v := b.Get([]byte(name))
+	if v == nil {
+		return nil, nil
+	}
+	m, err := decodeMeta(v)
+	if err != nil {
+		return nil, err
+	}
+	return &boltStatResult{name: name, meta: m}, nil
+}
+
+// lookup returns the entry for name, or a not exist PathError.
+func (fs *boltStreamStore) lookup(tx *bbolt.Tx, op, name string) (*boltStatResult, error) {
+	elems := split(name)
+	if len(elems) == 0 {
+		m, err := decodeMeta(fs.root(tx).Get(metaKey))
+		if err != nil {
+			return nil, err
+		}
+		return &boltStatResult{name: "/", isDir: true, meta: m}, nil
+	}
+	parent, err := fs.dir(tx, op, name, elems[:len(elems)-1])
+	if err != nil {
+		if _, ok := err.(*os.PathError); !ok {
+			err = &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+		}
+		return nil, err
+	}
+	sr, err := entry(parent, elems[len(elems)-1])
+	if err != nil {
+		return nil, err
+	}
+	if sr == nil {
+		return nil, &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+	}
+	return sr, nil
+}
+
+func (fs *boltStreamStore) Lstat(name string) (os.FileInfo, error) {
+	return fs.Stat(name)
+}
+
+func (fs *boltStreamStore) Stat(name string) (os.FileInfo, error) {
+	var sr *boltStatResult
+	err := fs.db.View(func(tx *bbolt.Tx) error {
+		var err error
+		sr, err = fs.lookup(tx, "stat", name)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return sr, nil
+}
+
+func (fs *boltStreamStore) Readdir(name string) ([]os.FileInfo, error) {
+	var results []os.FileInfo
+	err := fs.db.View(func(tx *bbolt.Tx) error {
+		b, err := fs.dir(tx, "readdir", name, split(name))
+		if err != nil {
+			return err
+		}
+		// Keys come back in byte order, which is the order names sort in.
+		return b.ForEach(func(k, v []byte) error {
+			if string(k) == string(metaKey) {
+				return nil
+			}
+			sr, err := entry(b, string(k))
+			if err != nil {
+				return err
+			}
+			results = append(results, sr)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+func (fs *boltStreamStore) Mkdir(name string, mode os.FileMode) error {
+	elems := split(name)
+	if len(elems) == 0 {
+		return fmt.Errorf("%s : file exists", name)
+	}
+	return fs.db.Update(func(tx *bbolt.Tx) error {
+		parent, err := fs.dir(tx, "mkdir", name, elems[:len(elems)-1])
+		if err != nil {
+			return err
+		}
+		key := []byte(elems[len(elems)-1])
+		if parent.Bucket(key) != nil || parent.Get(key) != nil {
+			return fmt.Errorf("%s : file exists", name)
+		}
+		b, err := parent.CreateBucket(key)
+		if err != nil {
+			return err
+		}
+		return putMeta(b, metaKey, &boltMeta{Mode: mode.Perm(), ModTime: time.Now().UnixNano()})
+	})
+}
+
+func (fs *boltStreamStore) Remove(name string) error {
+	elems := split(name)
+	if len(elems) == 0 {
+		return errors.New("cannot remove root directory")
+	}
+	return fs.db.Update(func(tx *bbolt.Tx) error {
+		parent, err := fs.dir(tx, "remove", name, elems[:len(elems)-1])
+		if err != nil {
+			if _, ok := err.(*os.PathError); !ok {
+				err = &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+			}
+			return err
+		}
+		key := []byte(elems[len(elems)-1])
+
+		if b := parent.Bucket(key); b != nil {
+			c := b.Cursor()
+			for k, _ := c.First(); k != nil; k, _ = c.Next() {
+				if string(k) != string(metaKey) {
+					return fmt.Errorf("%s : directory not empty", name)
+				}
+			}
+			return parent.DeleteBucket(key)
+		}
+
+		v := parent.Get(key)
+		if v == nil {
+			return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+		}
+		m, err := decodeMeta(v)
+		if err != nil {
+			return err
+		}
+		if err := parent.Delete(key); err != nil {
+			return err
+		}
+		return deleteContent(fs.content(tx), m.Content)
+	})
+}
+
+func deleteContent(content *bbolt.Bucket, id uint64) error {
+	err := content.DeleteBucket(itob(id))
+	if err == bbolt.ErrBucketNotFound {
+		return nil
+	}
+	return err
+}
+
+// OpenReadCloser reads the content current when it is opened.  Each Read
+// or ReadAt fetches just the pages it needs in a short read transaction, as
+// a long running one would hold up writers.  If the file is overwritten or
+// removed while it is open, reads of pages not already fetched fail.
+func (fs *boltStreamStore) OpenReadCloser(name string) (straw.StrawReader, error) {
+	var sr *boltStatResult
+	err := fs.db.View(func(tx *bbolt.Tx) error {
+		var err error
+		sr, err = fs.lookup(tx, "open", name)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if sr.isDir {
+		return nil, fmt.Errorf("%s is a directory", name)
+	}
+	return chunked.NewReader(&boltSource{fs: fs, id: sr.meta.Content}, name, sr, int64(sr.meta.PageSize)), nil
+}
+
+// boltSource fetches the pages of one content bucket.
+type boltSource struct {
+	fs *boltStreamStore
+	id uint64
+}
+
+func (s *boltSource) Fetch(first, last, start, end int64) ([][]byte, error) {
+	pages := make([][]byte, 0, last-first+1)
+	err := s.fs.db.View(func(tx *bbolt.Tx) error {
+		b := s.fs.content(tx).Bucket(itob(s.id))
+		if b == nil {
+			return nil
+		}
+		for seq := first; seq <= last; seq++ {
+			p := b.Get(itob(uint64(seq)))
+			if p == nil {
+				return nil
+			}
+			// Pages are only valid for the life of the transaction.
+			pages = append(pages, append([]byte(nil), p...))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return chunked.Trim(pages, first, last, start, end), nil
+}
+
+// CreateWriteCloser stores pages as they fill, under a new content bucket
+// that nothing refers to yet.  Close then points the file at the new
+// content and drops the old content in a single transaction, so readers see
+// either the old file or the new one, and a new file appears only once it
+// is complete.
+func (fs *boltStreamStore) CreateWriteCloser(name string) (straw.StrawWriter, error) {
+	elems := split(name)
+	if len(elems) == 0 {
+		return nil, fmt.Errorf("%s is a directory", name)
+	}
+
+	var id uint64
+	err := fs.db.Update(func(tx *bbolt.Tx) error {
+		parent, err := fs.dir(tx, "open", name, elems[:len(elems)-1])
+		if err != nil {
+			return err
+		}
+		if parent.Bucket([]byte(elems[len(elems)-1])) != nil {
+			return fmt.Errorf("%s is a directory", name)
+		}
+		content := fs.content(tx)
+		if id, err = content.NextSequence(); err != nil {
+			return err
+		}
+		if _, err = content.CreateBucket(itob(id)); err != nil {
+			return err
+		}
+		// Registered before the transaction commits, so that no store
+		// opening meanwhile can collect the bucket.
+		writing.add(fs.db, string(fs.bucket), id)
+		return nil
+	})
+	if err != nil {
+		writing.remove(fs.db, string(fs.bucket), id)
+		return nil, err
+	}
+
+	sink := &boltSink{fs: fs, name: name, elems: elems, id: id, pageSize: fs.pageSize}
+	return chunked.NewWriter(sink, fs.pageSize), nil
+}
+
+// boltSink stores pages in a content bucket, and points the file at it on
+// commit.
+type boltSink struct {
+	fs       *boltStreamStore
+	name     string
+	elems    []string
+	id       uint64
+	pageSize int
+}
+
+func (s *boltSink) Put(first int64, pages [][]byte) error {
+	return s.fs.db.Update(func(tx *bbolt.Tx) error {
+		return s.put(tx, first, pages)
+	})
+}
+
+func (s *boltSink) put(tx *bbolt.Tx, first int64, pages [][]byte) error {
+	b := s.fs.content(tx).Bucket(itob(s.id))
+	if b == nil {
+		return fmt.Errorf("content for %s has gone", s.name)
+	}
+	for i, p := range pages {
+		if err := b.Put(itob(uint64(first)+uint64(i)), append([]byte(nil), p...)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Commit stores the last pages and switches the file to the new content in
+// one transaction.
+func (s *boltSink) Commit(first int64, pages [][]byte, size int64) error {
+	fs := s.fs
+	err := fs.db.Update(func(tx *bbolt.Tx) error {
+		if err := s.put(tx, first, pages); err != nil {
+			return err
+		}
+		parent, err := fs.dir(tx, "open", s.name, s.elems[:len(s.elems)-1])
+		if err != nil {
+			return err
+		}
+		key := []byte(s.elems[len(s.elems)-1])
+		if parent.Bucket(key) != nil {
+			return fmt.Errorf("%s is a directory", s.name)
+		}
+		if v := parent.Get(key); v != nil {
+			old, err := decodeMeta(v)
+			if err != nil {
+				return err
+			}
+			if err := deleteContent(fs.content(tx), old.Content); err != nil {
+				return err
+			}
+		}
+		return putMeta(parent, key, &boltMeta{
+			Mode:     0644,
+			ModTime:  time.Now().UnixNano(),
+			Size:     size,
+			Content:  s.id,
+			PageSize: s.pageSize,
+		})
+	})
+	if err == nil {
+		writing.remove(fs.db, string(fs.bucket), s.id)
+	}
+	return err
+}
+
+func (s *boltSink) Discard(n int64) {
+	_ = s.fs.db.Update(func(tx *bbolt.Tx) error {
+		return deleteContent(s.fs.content(tx), s.id)
+	})
+	writing.remove(s.fs.db, string(s.fs.bucket), s.id)
+}
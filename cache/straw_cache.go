@@ -0,0 +1,624 @@
+package cache
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/uw-labs/straw"
+)
+
+var _ straw.StreamStore = &cacheStreamStore{}
+
+// DefaultMaxSize is the most content kept in the cache when no MaxSize is
+// given.
+const DefaultMaxSize = 1024 * 1024 * 1024
+
+// Options configures a caching StreamStore.
+type Options struct {
+	// MaxSize is the most content, in bytes, kept in the cache store.  The
+	// least recently used entries are evicted to stay within it.  Defaults
+	// to DefaultMaxSize.
+	MaxSize int64
+	// BlockSize, if set, caches content in blocks of this many bytes,
+	// fetched from the wrapped store only as they are read.  Otherwise
+	// whole files are cached, fetched in full when they are first opened.
+	BlockSize int64
+}
+
+// NewStreamStore returns a StreamStore that forwards everything to ss, and
+// keeps copies of the content read through it as files in the root
+// directory of cache, which is typically a local directory opened with
+// `file://`.  Every open Stats the file in ss, and a cached copy is only
+// used if the size, modification time and, for FileInfos implementing
+// straw.ETagger, the ETag still match.  Writes and removals through the
+// returned StreamStore drop the cached copies of the files they change.
+//
+// Copies already in cache, left by an earlier StreamStore, are reused.
+// Nothing else should write to cache.  Closing the returned StreamStore
+// closes both ss and cache.
+func NewStreamStore(ss, cache straw.StreamStore, opts Options) (straw.StreamStore, error) {
+	if opts.MaxSize == 0 {
+		opts.MaxSize = DefaultMaxSize
+	}
+	if opts.MaxSize < 0 {
+		return nil, errors.New("max size must be positive")
+	}
+	if opts.BlockSize < 0 || opts.BlockSize > opts.MaxSize {
+		return nil, errors.New("block size must be positive and no more than the max size")
+	}
+	fs := &cacheStreamStore{
+		ss:        ss,
+		cache:     cache,
+		maxSize:   opts.MaxSize,
+		blockSize: opts.BlockSize,
+		lru:       list.New(),
+		entries:   make(map[string]*entry),
+		byPath:    make(map[string]map[string]*entry),
+		loading:   make(map[string]chan struct{}),
+	}
+	if err := fs.adopt(); err != nil {
+		return nil, err
+	}
+	return fs, nil
+}
+
+// cacheStreamStore names each cached copy
+//
+//	/<path key>-<version key>        for whole files
+//	/<path key>-<version key>.<n>    for block n of a file
+//
+// where the path key is a hash of the file's path, and the version key a
+// hash of its size, mtime, ETag and the block size.  A changed file so never
+// matches a stale copy, which is left for the LRU to evict, and all the
+// copies of a file can be found from its path alone.
+type cacheStreamStore struct {
+	ss        straw.StreamStore
+	cache     straw.StreamStore
+	maxSize   int64
+	blockSize int64
+
+	lk      sync.Mutex
+	lru     *list.List // of *entry, most recently used first
+	entries map[string]*entry
+	byPath  map[string]map[string]*entry
+	size    int64
+	// loading holds the names being written to the cache, closed once the
+	// write is done.
+	loading map[string]chan struct{}
+}
+
+// entry is a copy in the cache store.
+type entry struct {
+	name    string
+	pathKey string
+	size    int64
+	elem    *list.Element
+	// refs counts the readers using the entry, which keep it from being
+	// removed.
+	refs int
+	// forgotten is set once the entry is no longer indexed.
+	forgotten bool
+	// dropped is set for entries forgotten while in use whose copy should
+	// be removed once released.
+	dropped bool
+}
+
+var entryName = regexp.MustCompile(`^([0-9a-f]{32})-[0-9a-f]{16}(\.[0-9]+)?$`)
+
+func pathKey(name string) string {
+	sum := sha256.Sum256([]byte(path.Clean("/" + name)))
+	return hex.EncodeToString(sum[:16])
+}
+
+func etag(fi os.FileInfo) string {
+	if et, ok := fi.(straw.ETagger); ok {
+		return et.ETag()
+	}
+	return ""
+}
+
+// key returns the name of the cached copy of the version of name described
+// by fi.
+func (fs *cacheStreamStore) key(name string, fi os.FileInfo) string {
+	v := fmt.Sprintf("%d\x00%d\x00%s\x00%d", fi.Size(), fi.ModTime().UnixNano(), etag(fi), fs.blockSize)
+	sum := sha256.Sum256([]byte(v))
+	return "/" + pathKey(name) + "-" + hex.EncodeToString(sum[:8])
+}
+
+// adopt indexes the copies already in the cache store, least recently
+// modified first in line for eviction.
+func (fs *cacheStreamStore) adopt() error {
+	fis, err := fs.cache.Readdir("/")
+	if err != nil {
+		return err
+	}
+	sort.SliceStable(fis, func(i, j int) bool { return fis[i].ModTime().Before(fis[j].ModTime()) })
+	for _, fi := range fis {
+		m := entryName.FindStringSubmatch(fi.Name())
+		if fi.IsDir() || m == nil {
+			continue
+		}
+		fs.add("/"+fi.Name(), m[1], fi.Size())
+	}
+	return nil
+}
+
+// add indexes a copy just written to the cache store, and evicts others to
+// make room for it.
+func (fs *cacheStreamStore) add(name, pathKey string, size int64) {
+	fs.lk.Lock()
+	if e, ok := fs.entries[name]; ok {
+		// The copy has just been overwritten, so must not be removed.
+		fs.forget(e)
+	}
+	e := &entry{name: name, pathKey: pathKey, size: size}
+	e.elem = fs.lru.PushFront(e)
+	fs.entries[name] = e
+	if fs.byPath[pathKey] == nil {
+		fs.byPath[pathKey] = make(map[string]*entry)
+	}
+	fs.byPath[pathKey][name] = e
+	fs.size += size
+	fs.evict()
+	fs.lk.Unlock()
+}
+
+// evict drops the least recently used entries that aren't in use until the
+// cache is within its size limit.  It is called with fs.lk held.
+func (fs *cacheStreamStore) evict() {
+	for el := fs.lru.Back(); el != nil && fs.size > fs.maxSize; {
+		prev := el.Prev()
+		if e := el.Value.(*entry); e.refs == 0 {
+			fs.drop(e)
+		}
+		el = prev
+	}
+}
+
+// forget removes e from the index.  It is called with fs.lk held.
+func (fs *cacheStreamStore) forget(e *entry) {
+	fs.lru.Remove(e.elem)
+	delete(fs.entries, e.name)
+	delete(fs.byPath[e.pathKey], e.name)
+	if len(fs.byPath[e.pathKey]) == 0 {
+		delete(fs.byPath, e.pathKey)
+	}
+	fs.size -= e.size
+	e.forgotten = true
+}
+
+// drop forgets e, and removes it from the cache store unless it is in use.
+// It is called with fs.lk held.
+func (fs *cacheStreamStore) drop(e *entry) {
+	fs.forget(e)
+	if e.refs > 0 {
+		e.dropped = true
+		return
+	}
+	// The copy is unreachable now, so it doesn't matter if this fails.
+	fs.cache.Remove(e.name)
+}
+
+// acquire returns the entry called name, marked as in use, if there is one
+// of the expected size.  Entries of any other size are partial copies, and
+// are dropped.
+func (fs *cacheStreamStore) acquire(name string, size int64) *entry {
+	fs.lk.Lock()
+	defer fs.lk.Unlock()
+	e := fs.entries[name]
+	if e == nil {
+		return nil
+	}
+	if e.size != size {
+		fs.drop(e)
+		return nil
+	}
+	e.refs++
+	fs.lru.MoveToFront(e.elem)
+	return e
+}
+
+func (fs *cacheStreamStore) release(e *entry, bad bool) {
+	fs.lk.Lock()
+	defer fs.lk.Unlock()
+	e.refs--
+	if bad && !e.forgotten {
+		fs.drop(e)
+	}
+	if e.refs > 0 {
+		return
+	}
+	if e.dropped {
+		fs.cache.Remove(e.name)
+		return
+	}
+	fs.evict()
+}
+
+// invalidate drops every copy of name.
+func (fs *cacheStreamStore) invalidate(name string) {
+	fs.lk.Lock()
+	defer fs.lk.Unlock()
+	for _, e := range fs.byPath[pathKey(name)] {
+		fs.drop(e)
+	}
+}
+
+// startLoad claims the right to write name to the cache.  If another
+// goroutine is already writing it, it returns a channel that is closed once
+// that is done instead.
+func (fs *cacheStreamStore) startLoad(name string) (bool, <-chan struct{}) {
+	fs.lk.Lock()
+	defer fs.lk.Unlock()
+	if ch, ok := fs.loading[name]; ok {
+		return false, ch
+	}
+	fs.loading[name] = make(chan struct{})
+	return true, nil
+}
+
+func (fs *cacheStreamStore) finishLoad(name string) {
+	fs.lk.Lock()
+	defer fs.lk.Unlock()
+	close(fs.loading[name])
+	delete(fs.loading, name)
+}
+
+// store writes data to the cache as name.  The cache is best effort, so
+// failures just leave it uncached.
+func (fs *cacheStreamStore) store(name, pathKey string, data []byte) {
+	w, err := fs.cache.CreateWriteCloser(name)
+	if err != nil {
+		return
+	}
+	_, err = w.Write(data)
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		fs.cache.Remove(name)
+		return
+	}
+	fs.add(name, pathKey, int64(len(data)))
+}
+
+// sameVersion reports whether the reader r was opened on the version of
+// the file described by fi, as far as can be told.
+func sameVersion(fi os.FileInfo, r straw.StrawReader) bool {
+	s, ok := r.(straw.Statter)
+	if !ok {
+		return true
+	}
+	rfi, err := s.Stat()
+	if err != nil {
+		return false
+	}
+	if rfi.Size() != fi.Size() {
+		return false
+	}
+	et, ret := etag(fi), etag(rfi)
+	return et == "" || ret == "" || et == ret
+}
+
+func (fs *cacheStreamStore) Close() error {
+	err := fs.ss.Close()
+	if cerr := fs.cache.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (fs *cacheStreamStore) Lstat(name string) (os.FileInfo, error) {
+	return fs.ss.Lstat(name)
+}
+
+func (fs *cacheStreamStore) Stat(name string) (os.FileInfo, error) {
+	return fs.ss.Stat(name)
+}
+
+func (fs *cacheStreamStore) Readdir(name string) ([]os.FileInfo, error) {
+	return fs.ss.Readdir(name)
+}
+
+func (fs *cacheStreamStore) Mkdir(name string, mode os.FileMode) error {
+	return fs.ss.Mkdir(name, mode)
+}
+
+func (fs *cacheStreamStore) Remove(name string) error {
+	err := fs.ss.Remove(name)
+	fs.invalidate(name)
+	return err
+}
+
+func (fs *cacheStreamStore) CreateWriteCloser(name string) (straw.StrawWriter, error) {
+	fs.invalidate(name)
+	w, err := fs.ss.CreateWriteCloser(name)
+	if err != nil {
+		return nil, err
+	}
+	return &cacheWriter{w, fs, name}, nil
+}
+
+// cacheWriter drops the cached copies of its file again on Close, in case
+// the old content was read back into the cache while it was being written.
+type cacheWriter struct {
+	straw.StrawWriter
+	fs   *cacheStreamStore
+	name string
+}
+
+func (w *cacheWriter) Close() error {
+	err := w.StrawWriter.Close()
+	w.fs.invalidate(w.name)
+	return err
+}
+
+// OpenReadCloser Stats name to find which version of it to look for in the
+// cache.
+func (fs *cacheStreamStore) OpenReadCloser(name string) (straw.StrawReader, error) {
+	fi, err := fs.ss.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	if fi.IsDir() {
+		// Let the wrapped store report this in its own way.
+		return fs.ss.OpenReadCloser(name)
+	}
+	if fs.blockSize > 0 {
+		return &blockReader{fs: fs, name: name, key: fs.key(name, fi), fi: fi, block: -1}, nil
+	}
+
+	key := fs.key(name, fi)
+	for {
+		if r := fs.openCached(key, fi); r != nil {
+			return r, nil
+		}
+		if fi.Size() > fs.maxSize {
+			return fs.ss.OpenReadCloser(name)
+		}
+		ok, wait := fs.startLoad(key)
+		if !ok {
+			<-wait
+			continue
+		}
+		err := fs.fill(name, key, fi)
+		fs.finishLoad(key)
+		if err != nil {
+			return nil, err
+		}
+		if r := fs.openCached(key, fi); r != nil {
+			return r, nil
+		}
+		// The copy couldn't be written, or was evicted already.
+		return fs.ss.OpenReadCloser(name)
+	}
+}
+
+// openCached opens the whole file copy called key, or returns nil if there
+// is no usable one.
+func (fs *cacheStreamStore) openCached(key string, fi os.FileInfo) straw.StrawReader {
+	e := fs.acquire(key, fi.Size())
+	if e == nil {
+		return nil
+	}
+	r, err := fs.cache.OpenReadCloser(key)
+	if err != nil {
+		fs.release(e, true)
+		return nil
+	}
+	return &cachedReader{StrawReader: r, fs: fs, e: e, fi: fi}
+}
+
+// fill copies name from the wrapped store into the cache as key.  Errors
+// opening the file are returned, but otherwise the content is just left
+// uncached if anything goes wrong.
+func (fs *cacheStreamStore) fill(name, key string, fi os.FileInfo) error {
+	r, err := fs.ss.OpenReadCloser(name)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	if !sameVersion(fi, r) {
+		return nil
+	}
+
+	w, err := fs.cache.CreateWriteCloser(key)
+	if err != nil {
+		return nil
+	}
+	n, err := io.Copy(w, r)
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil || n != fi.Size() {
+		fs.cache.Remove(key)
+		return nil
+	}
+	fs.add(key, pathKey(name), n)
+	return nil
+}
+
+// cachedReader reads a whole file copy, which is kept in the cache while it
+// is open.
+type cachedReader struct {
+	straw.StrawReader
+	fs   *cacheStreamStore
+	e    *entry
+	fi   os.FileInfo
+	once sync.Once
+}
+
+// Stat returns the FileInfo of the file in the wrapped store.
+func (r *cachedReader) Stat() (os.FileInfo, error) {
+	return r.fi, nil
+}
+
+func (r *cachedReader) Close() error {
+	err := r.StrawReader.Close()
+	r.once.Do(func() { r.fs.release(r.e, false) })
+	return err
+}
+
+// blockReader reads a file a block at a time, from the cache where it can
+// and otherwise from the wrapped store, which it only opens when it first
+// needs to.
+type blockReader struct {
+	fs   *cacheStreamStore
+	name string
+	key  string
+	fi   os.FileInfo
+	pos  int64
+
+	lk     sync.Mutex
+	origin straw.StrawReader
+	// block is the index of the block in buf, or -1.
+	block  int64
+	buf    []byte
+	closed bool
+}
+
+// Stat returns the FileInfo of the file in the wrapped store.
+func (r *blockReader) Stat() (os.FileInfo, error) {
+	return r.fi, nil
+}
+
+func (r *blockReader) Read(p []byte) (int, error) {
+	n, err := r.ReadAt(p, r.pos)
+	r.pos += int64(n)
+	if n > 0 && err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+func (r *blockReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += r.fi.Size()
+	default:
+		return 0, fmt.Errorf("%s : invalid whence %d", r.name, whence)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("%s : negative position", r.name)
+	}
+	r.pos = offset
+	return offset, nil
+}
+
+func (r *blockReader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("%s : negative offset", r.name)
+	}
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	// Reading on after Close would reopen the wrapped store's file, and
+	// nothing would close it.
+	if r.closed {
+		return 0, os.ErrClosed
+	}
+
+	n := 0
+	for n < len(p) {
+		pos := off + int64(n)
+		if pos >= r.fi.Size() {
+			return n, io.EOF
+		}
+		b := pos / r.fs.blockSize
+		data, err := r.getBlock(b)
+		if err != nil {
+			return n, err
+		}
+		n += copy(p[n:], data[pos-b*r.fs.blockSize:])
+	}
+	return n, nil
+}
+
+// getBlock returns the content of block b.  It is called with r.lk held.
+func (r *blockReader) getBlock(b int64) ([]byte, error) {
+	if r.block == b {
+		return r.buf, nil
+	}
+	size := r.fi.Size() - b*r.fs.blockSize
+	if size > r.fs.blockSize {
+		size = r.fs.blockSize
+	}
+	if cap(r.buf) < int(size) {
+		r.buf = make([]byte, r.fs.blockSize)
+	}
+	r.buf = r.buf[:size]
+	r.block = -1
+
+	name := r.key + "." + strconv.FormatInt(b, 10)
+	if r.readCached(name, r.buf) {
+		r.block = b
+		return r.buf, nil
+	}
+
+	if r.origin == nil {
+		origin, err := r.fs.ss.OpenReadCloser(r.name)
+		if err != nil {
+			return nil, err
+		}
+		if !sameVersion(r.fi, origin) {
+			origin.Close()
+			return nil, fmt.Errorf("%s : changed while being read", r.name)
+		}
+		r.origin = origin
+	}
+	n, err := r.origin.ReadAt(r.buf, b*r.fs.blockSize)
+	if err == io.EOF && int64(n) == size {
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if ok, _ := r.fs.startLoad(name); ok {
+		r.fs.store(name, pathKey(r.name), r.buf)
+		r.fs.finishLoad(name)
+	}
+	r.block = b
+	return r.buf, nil
+}
+
+// readCached fills buf from the cached copy of a block, if there is a
+// usable one.
+func (r *blockReader) readCached(name string, buf []byte) bool {
+	e := r.fs.acquire(name, int64(len(buf)))
+	if e == nil {
+		return false
+	}
+	cr, err := r.fs.cache.OpenReadCloser(name)
+	if err == nil {
+		_, err = io.ReadFull(cr, buf)
+		cr.Close()
+	}
+	r.fs.release(e, err != nil)
+	return err == nil
+}
+
+func (r *blockReader) Close() error {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	r.closed = true
+	r.block, r.buf = -1, nil
+	if r.origin == nil {
+		return nil
+	}
+	err := r.origin.Close()
+	r.origin = nil
+	return err
+}
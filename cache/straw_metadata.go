@@ -0,0 +1,351 @@
+package cache
+
+import (
+	"container/list"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/uw-labs/straw"
+)
+
+var _ straw.StreamStore = &metadataStreamStore{}
+
+// DefaultMaxEntries is the number of results a MetadataCache keeps when no
+// MaxEntries is given.
+const DefaultMaxEntries = 10000
+
+// MetadataOptions configures a MetadataCache.
+type MetadataOptions struct {
+	// TTL is how long successful Stat, Lstat and Readdir results are kept.
+	// Zero disables caching them.
+	TTL time.Duration
+	// NegativeTTL is how long results saying that a path doesn't exist are
+	// kept.  They are cached separately from successful results, so that
+	// lookups of missing paths can't push those out.  Zero disables caching
+	// them.
+	NegativeTTL time.Duration
+	// MaxEntries bounds the number of successful results, and separately
+	// of negative results, kept.  The least recently used are dropped to
+	// stay within it.  Defaults to DefaultMaxEntries.
+	MaxEntries int
+}
+
+// TTLOptions is embedded in the Options of the backends that cache their
+// own lookups in a MetadataCache.
+type TTLOptions struct {
+	// MetadataTTL, if set, caches successful Stat and Readdir results for
+	// that long, which includes the lookups of parent directories made by
+	// every write.  Writes, Mkdir and Remove through the StreamStore keep
+	// the cache up to date, but changes made by anything else can go unseen
+	// for up to the TTL.
+	MetadataTTL time.Duration
+	// NegativeMetadataTTL, if set, caches the results that paths don't
+	// exist for that long.
+	NegativeMetadataTTL time.Duration
+}
+
+// TTLOptionsFromQuery reads the `metadata_ttl` and `negative_metadata_ttl`
+// query parameters.
+func TTLOptionsFromQuery(q url.Values) (TTLOptions, error) {
+	var opts TTLOptions
+	var err error
+	if opts.MetadataTTL, err = durationParam(q, "metadata_ttl"); err != nil {
+		return TTLOptions{}, err
+	}
+	if opts.NegativeMetadataTTL, err = durationParam(q, "negative_metadata_ttl"); err != nil {
+		return TTLOptions{}, err
+	}
+	return opts, nil
+}
+
+func durationParam(q url.Values, name string) (time.Duration, error) {
+	v := q.Get(name)
+	if v == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %q query parameter: %w", name, err)
+	}
+	return d, nil
+}
+
+// Cache returns a MetadataCache with the TTLs, or nil if both are zero.
+func (o TTLOptions) Cache() *MetadataCache {
+	if o.MetadataTTL <= 0 && o.NegativeMetadataTTL <= 0 {
+		return nil
+	}
+	return NewMetadataCache(MetadataOptions{TTL: o.MetadataTTL, NegativeTTL: o.NegativeMetadataTTL})
+}
+
+// MetadataCache memoises the results of Stat, Lstat and Readdir.  Only
+// results that a path doesn't exist are cached among errors.  Backends can
+// use one directly to cache their own lookups, while NewMetadataStreamStore
+// wraps any StreamStore with one.  It is safe for concurrent use.  A nil
+// MetadataCache caches nothing, so that backends can use one whether or
+// not caching is enabled.
+type MetadataCache struct {
+	lk       sync.Mutex
+	positive *ttlCache
+	negative *ttlCache
+	// gen is bumped by every change, so that results fetched before it
+	// aren't cached after it.
+	gen uint64
+}
+
+// NewMetadataCache returns an empty MetadataCache.
+func NewMetadataCache(opts MetadataOptions) *MetadataCache {
+	if opts.MaxEntries <= 0 {
+		opts.MaxEntries = DefaultMaxEntries
+	}
+	return &MetadataCache{
+		positive: newTTLCache(opts.TTL, opts.MaxEntries),
+		negative: newTTLCache(opts.NegativeTTL, opts.MaxEntries),
+	}
+}
+
+// Lookups are keyed by kind and cleaned path.
+const (
+	kindStat    = "stat"
+	kindLstat   = "lstat"
+	kindReaddir = "readdir"
+)
+
+var kinds = []string{kindStat, kindLstat, kindReaddir}
+
+func metadataKey(kind, name string) string {
+	return kind + ":" + path.Clean("/"+name)
+}
+
+// Stat returns the cached result of stat(name), calling it if there is
+// none.
+func (c *MetadataCache) Stat(name string, stat func(string) (os.FileInfo, error)) (os.FileInfo, error) {
+	v, err := c.lookup(metadataKey(kindStat, name), func() (interface{}, error) { return stat(name) })
+	if err != nil {
+		return nil, err
+	}
+	return v.(os.FileInfo), nil
+}
+
+// Lstat returns the cached result of lstat(name), calling it if there is
+// none.
+func (c *MetadataCache) Lstat(name string, lstat func(string) (os.FileInfo, error)) (os.FileInfo, error) {
+	v, err := c.lookup(metadataKey(kindLstat, name), func() (interface{}, error) { return lstat(name) })
+	if err != nil {
+		return nil, err
+	}
+	return v.(os.FileInfo), nil
+}
+
+// Readdir returns the cached result of readdir(name), calling it if there
+// is none.  The returned slice is the caller's own.
+func (c *MetadataCache) Readdir(name string, readdir func(string) ([]os.FileInfo, error)) ([]os.FileInfo, error) {
+	v, err := c.lookup(metadataKey(kindReaddir, name), func() (interface{}, error) { return readdir(name) })
+	if err != nil {
+		return nil, err
+	}
+	fis := v.([]os.FileInfo)
+	return append([]os.FileInfo(nil), fis...), nil
+}
+
+func (c *MetadataCache) lookup(key string, fetch func() (interface{}, error)) (interface{}, error) {
+	if c == nil {
+		return fetch()
+	}
+	c.lk.Lock()
+	if v, ok := c.positive.get(key); ok {
+		c.lk.Unlock()
+		return v, nil
+	}
+	if v, ok := c.negative.get(key); ok {
+		c.lk.Unlock()
+		return nil, v.(error)
+	}
+	gen := c.gen
+	c.lk.Unlock()
+
+	v, err := fetch()
+
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	if gen != c.gen {
+		return v, err
+	}
+	switch {
+	case err == nil:
+		c.positive.put(key, v)
+	case os.IsNotExist(err):
+		c.negative.put(key, err)
+	}
+	return v, err
+}
+
+// Created drops what is cached about name, and anything that its creation
+// could have changed: negative results for, and listings of, each of its
+// parents.  Call it once a file or directory has been written or created.
+func (c *MetadataCache) Created(name string) {
+	if c == nil {
+		return
+	}
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	c.gen++
+	p := path.Clean("/" + name)
+	c.drop(p)
+	for p != "/" {
+		p = path.Dir(p)
+		for _, kind := range kinds {
+			c.negative.remove(metadataKey(kind, p))
+		}
+		c.positive.remove(metadataKey(kindReaddir, p))
+	}
+}
+
+// Removed drops what is cached about name and each of its parents, which
+// in object stores can disappear along with their last child.  Call it once
+// a file or directory has been removed.
+func (c *MetadataCache) Removed(name string) {
+	if c == nil {
+		return
+	}
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	c.gen++
+	p := path.Clean("/" + name)
+	c.drop(p)
+	for p != "/" {
+		p = path.Dir(p)
+		c.drop(p)
+	}
+}
+
+// drop is called with c.lk held.
+func (c *MetadataCache) drop(p string) {
+	for _, kind := range kinds {
+		c.positive.remove(metadataKey(kind, p))
+		c.negative.remove(metadataKey(kind, p))
+	}
+}
+
+// ttlCache is a size bounded LRU whose entries expire.
+type ttlCache struct {
+	ttl     time.Duration
+	max     int
+	lru     *list.List // of *ttlEntry, most recently used first
+	entries map[string]*list.Element
+}
+
+type ttlEntry struct {
+	key     string
+	value   interface{}
+	expires time.Time
+}
+
+func newTTLCache(ttl time.Duration, max int) *ttlCache {
+	return &ttlCache{ttl: ttl, max: max, lru: list.New(), entries: make(map[string]*list.Element)}
+}
+
+func (c *ttlCache) get(key string) (interface{}, bool) {
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	e := el.Value.(*ttlEntry)
+	if time.Now().After(e.expires) {
+		c.remove(key)
+		return nil, false
+	}
+	c.lru.MoveToFront(el)
+	return e.value, true
+}
+
+func (c *ttlCache) put(key string, value interface{}) {
+	if c.ttl <= 0 {
+		return
+	}
+	c.remove(key)
+	c.entries[key] = c.lru.PushFront(&ttlEntry{key, value, time.Now().Add(c.ttl)})
+	for c.lru.Len() > c.max {
+		c.remove(c.lru.Back().Value.(*ttlEntry).key)
+	}
+}
+
+func (c *ttlCache) remove(key string) {
+	if el, ok := c.entries[key]; ok {
+		c.lru.Remove(el)
+		delete(c.entries, key)
+	}
+}
+
+// NewMetadataStreamStore returns a StreamStore that forwards everything to
+// ss, caching the results of Stat, Lstat and Readdir as configured by
+// opts.  Mkdir, Remove and writes through the returned StreamStore drop the
+// results they could change, but changes made any other way can go unseen
+// for up to the TTLs.  Closing the returned StreamStore closes ss.
+func NewMetadataStreamStore(ss straw.StreamStore, opts MetadataOptions) straw.StreamStore {
+	return &metadataStreamStore{ss: ss, meta: NewMetadataCache(opts)}
+}
+
+type metadataStreamStore struct {
+	ss   straw.StreamStore
+	meta *MetadataCache
+}
+
+func (fs *metadataStreamStore) Close() error {
+	return fs.ss.Close()
+}
+
+func (fs *metadataStreamStore) Lstat(name string) (os.FileInfo, error) {
+	return fs.meta.Lstat(name, fs.ss.Lstat)
+}
+
+func (fs *metadataStreamStore) Stat(name string) (os.FileInfo, error) {
+	return fs.meta.Stat(name, fs.ss.Stat)
+}
+
+func (fs *metadataStreamStore) Readdir(name string) ([]os.FileInfo, error) {
+	return fs.meta.Readdir(name, fs.ss.Readdir)
+}
+
+func (fs *metadataStreamStore) OpenReadCloser(name string) (straw.StrawReader, error) {
+	return fs.ss.OpenReadCloser(name)
+}
+
+func (fs *metadataStreamStore) Mkdir(name string, mode os.FileMode) error {
+	err := fs.ss.Mkdir(name, mode)
+	fs.meta.Created(name)
+	return err
+}
+
+func (fs *metadataStreamStore) Remove(name string) error {
+	err := fs.ss.Remove(name)
+	fs.meta.Removed(name)
+	return err
+}
+
+// CreateWriteCloser drops cached results both now, as some backends create
+// the file straight away, and when the writer is closed.
+func (fs *metadataStreamStore) CreateWriteCloser(name string) (straw.StrawWriter, error) {
+	w, err := fs.ss.CreateWriteCloser(name)
+	fs.meta.Created(name)
+	if err != nil {
+		return nil, err
+	}
+	return &metadataWriter{w, fs.meta, name}, nil
+}
+
+type metadataWriter struct {
+	straw.StrawWriter
+	meta *MetadataCache
+	name string
+}
+
+func (w *metadataWriter) Close() error {
+	err := w.StrawWriter.Close()
+	w.meta.Created(w.name)
+	return err
+}
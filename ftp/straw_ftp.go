@@ -0,0 +1,667 @@
+package ftp
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/jlaffaye/ftp"
+	"github.com/uw-labs/straw"
+)
+
+var _ straw.StreamStore = &ftpStreamStore{}
+
+func init() {
+	straw.Register("ftp", func(u *url.URL) (straw.StreamStore, error) {
+		opts, err := optionsFromURL(u)
+		if err != nil {
+			return nil, err
+		}
+		return newFTPStreamStore(withDefaultPort(u.Host, "21"), opts)
+	})
+	straw.Register("ftps", func(u *url.URL) (straw.StreamStore, error) {
+		opts, err := optionsFromURL(u)
+		if err != nil {
+			return nil, err
+		}
+		port := "21"
+		switch opts.TLS {
+		case TLSNone:
+			opts.TLS = TLSExplicit
+		case TLSImplicit:
+			port = "990"
+		}
+		return newFTPStreamStore(withDefaultPort(u.Host, port), opts)
+	})
+}
+
+const (
+	// TLSNone uses plain ftp.
+	TLSNone = ""
+	// TLSExplicit connects in plain text and upgrades the control and data
+	// connections with `AUTH TLS`, as described in RFC 4217.
+	TLSExplicit = "explicit"
+	// TLSImplicit speaks TLS from the start, usually on port 990.
+	TLSImplicit = "implicit"
+)
+
+// Options configures an ftp backed StreamStore.
+//
+// FTP has no way to read part of a file other than to start a transfer at
+// an offset and abandon it early, and abandoning a transfer leaves the
+// control connection unusable, as there is no telling which replies to the
+// abort are still to come.  So a ReadAt or Seek that stops short of the end
+// of the file discards its connection, and the next operation pays for a
+// new dial, login and, for FTPS, TLS handshake.  Random access, such as
+// opening a zip file over ftp, is therefore slow, and is better done on a
+// local copy.
+type Options struct {
+	// User defaults to `anonymous`.
+	User     string
+	Password string
+
+	// TLS selects FTPS, one of TLSNone, TLSExplicit or TLSImplicit.
+	TLS string
+	// TLSConfig is used for FTPS connections.  If nil, the system roots
+	// are used to verify the server.
+	TLSConfig *tls.Config
+
+	// DisableEPSV makes passive mode transfers use PASV rather than EPSV,
+	// for servers or firewalls that do not understand EPSV.  Active mode
+	// is not supported.
+	DisableEPSV bool
+	// Timeout applies to dialling the control and data connections.
+	Timeout time.Duration
+	// MaxIdleConns is how many control connections are kept open between
+	// operations.
+	MaxIdleConns int
+}
+
+// Defaults used for `ftp://` and `ftps://` URLs when the corresponding query
+// parameter is absent.
+const (
+	defaultTimeout      = 30 * time.Second
+	defaultMaxIdleConns = 2
+)
+
+// NewStreamStore returns a StreamStore for the ftp server at addr, which is
+// a `host:port` pair.
+func NewStreamStore(addr string, opts Options) (straw.StreamStore, error) {
+	return newFTPStreamStore(addr, opts)
+}
+
+// optionsFromURL reads the user and password from the URL, along with the
+// `tls`, `insecure_skip_verify`, `ca_file`, `disable_epsv`, `timeout` and
+// `max_idle_conns` query parameters.
+func optionsFromURL(u *url.URL) (Options, error) {
+	q := u.Query()
+	opts := Options{
+		TLS:          q.Get("tls"),
+		Timeout:      defaultTimeout,
+		MaxIdleConns: defaultMaxIdleConns,
+	}
+	if u.User != nil {
+		opts.User = u.User.Username()
+		opts.Password, _ = u.User.Password()
+	}
+
+	switch opts.TLS {
+	case TLSNone, TLSExplicit, TLSImplicit:
+	default:
+		return Options{}, fmt.Errorf("invalid %q query parameter: %q", "tls", opts.TLS)
+	}
+	if opts.TLS != TLSNone && u.Scheme != "ftps" {
+		return Options{}, fmt.Errorf("the %q query parameter needs an ftps:// url", "tls")
+	}
+
+	var err error
+	if opts.DisableEPSV, err = boolParam(q, "disable_epsv"); err != nil {
+		return Options{}, err
+	}
+	insecure, err := boolParam(q, "insecure_skip_verify")
+	if err != nil {
+		return Options{}, err
+	}
+	caFile := q.Get("ca_file")
+	if insecure || caFile != "" {
+		opts.TLSConfig = &tls.Config{InsecureSkipVerify: insecure}
+		if caFile != "" {
+			pem, err := ioutil.ReadFile(caFile)
+			if err != nil {
+				return Options{}, fmt.Errorf("failed to read CA file: %w", err)
+			}
+			opts.TLSConfig.RootCAs = x509.NewCertPool()
+			if !opts.TLSConfig.RootCAs.AppendCertsFromPEM(pem) {
+				return Options{}, fmt.Errorf("no certificates found in %s", caFile)
+			}
+		}
+	}
+	if v := q.Get("timeout"); v != "" {
+		if opts.Timeout, err = time.ParseDuration(v); err != nil {
+			return Options{}, fmt.Errorf("invalid %q query parameter: %w", "timeout", err)
+		}
+	}
+	if v := q.Get("max_idle_conns"); v != "" {
+		if opts.MaxIdleConns, err = strconv.Atoi(v); err != nil || opts.MaxIdleConns < 0 {
+			return Options{}, fmt.Errorf("invalid %q query parameter: %q", "max_idle_conns", v)
+		}
+	}
+	return opts, nil
+}
+
+func boolParam(q url.Values, name string) (bool, error) {
+	v := q.Get(name)
+	if v == "" {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("invalid %q query parameter: %w", name, err)
+	}
+	return b, nil
+}
+
+func withDefaultPort(host, port string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	return net.JoinHostPort(host, port)
+}
+
+func hostOnly(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+func newFTPStreamStore(addr string, opts Options) (*ftpStreamStore, error) {
+	switch opts.TLS {
+	case TLSNone, TLSExplicit, TLSImplicit:
+	default:
+		return nil, fmt.Errorf("invalid TLS mode %q", opts.TLS)
+	}
+
+	pool := &connPool{addr: addr, opts: opts}
+
+	// Connect straight away, so that bad addresses and credentials are
+	// reported by Open rather than by the first operation.
+	c, err := pool.dial()
+	if err != nil {
+		return nil, err
+	}
+	pool.put(c, true)
+
+	return &ftpStreamStore{pool: pool}, nil
+}
+
+type ftpStreamStore struct {
+	pool *connPool
+}
+
+func (fs *ftpStreamStore) Close() error {
+	return fs.pool.Close()
+}
+
+func cleanPath(name string) string {
+	return path.Clean("/" + name)
+}
+
+func notExist(op, name string) error {
+	return &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+}
+
+func (fs *ftpStreamStore) Lstat(name string) (os.FileInfo, error) {
+	// symlinks are reported as the link itself by LIST and MLSD
+	return fs.Stat(name)
+}
+
+// Stat uses MLST where the server supports it, and otherwise lists the
+// parent directory and picks out the entry for name.
+func (fs *ftpStreamStore) Stat(name string) (os.FileInfo, error) {
+	p := cleanPath(name)
+	if p == "/" {
+		return &ftpStatResult{name: "/", isDir: true, size: 4096}, nil
+	}
+
+	var fi os.FileInfo
+	err := fs.pool.do(func(c *ftp.ServerConn) error {
+		e, err := c.GetEntry(p)
+		if err == nil {
+			fi = entryInfo(path.Base(p), e)
+			return nil
+		}
+		if !isNotImplemented(err) {
+			return err
+		}
+
+		entries, err := c.List(path.Dir(p))
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if e.Name == path.Base(p) {
+				fi = entryInfo(e.Name, e)
+				return nil
+			}
+		}
+		return nil
+	})
+	if isFileUnavailable(err) || (err == nil && fi == nil) {
+		return nil, notExist("stat", name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return fi, nil
+}
+
+func entryInfo(name string, e *ftp.Entry) *ftpStatResult {
+	sr := &ftpStatResult{
+		name:    name,
+		modTime: e.Time,
+		size:    int64(e.Size),
+	}
+	if e.Type == ftp.EntryTypeFolder {
+		sr.isDir = true
+		sr.size = 4096
+	}
+	return sr
+}
+
+type ftpStatResult struct {
+	name    string
+	isDir   bool
+	modTime time.Time
+	size    int64
+}
+
+func (sr *ftpStatResult) Name() string {
+	return sr.name
+}
+
+func (sr *ftpStatResult) IsDir() bool {
+	return sr.isDir
+}
+
+func (sr *ftpStatResult) Size() int64 {
+	return sr.size
+}
+
+func (sr *ftpStatResult) ModTime() time.Time {
+	return sr.modTime
+}
+
+func (sr *ftpStatResult) Mode() os.FileMode {
+	if sr.IsDir() {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}
+
+func (sr *ftpStatResult) Sys() interface{} {
+	return nil
+}
+
+func (fs *ftpStreamStore) Readdir(name string) ([]os.FileInfo, error) {
+	fi, err := fs.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return nil, fmt.Errorf("%s not a directory", name)
+	}
+
+	var results []os.FileInfo
+	err = fs.pool.do(func(c *ftp.ServerConn) error {
+		entries, err := c.List(cleanPath(name))
+		if err != nil {
+			return err
+		}
+		results = results[:0]
+		for _, e := range entries {
+			if e.Name == "." || e.Name == ".." || e.Name == "" {
+				continue
+			}
+			results = append(results, entryInfo(path.Base(e.Name), e))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(results, func(i, j int) bool { return results[i].Name() < results[j].Name() })
+	return results, nil
+}
+
+func (fs *ftpStreamStore) checkParentDir(child string) error {
+	d := path.Dir(cleanPath(child))
+	if d != "/" {
+		fi, err := fs.Stat(d)
+		if err != nil {
+			return err
+		}
+		if !fi.IsDir() {
+			return fmt.Errorf("%s not a directory", d)
+		}
+	}
+	return nil
+}
+
+func (fs *ftpStreamStore) Mkdir(name string, mode os.FileMode) error {
+	if err := fs.checkParentDir(name); err != nil {
+		return err
+	}
+
+	if _, err := fs.Stat(name); err == nil {
+		return fmt.Errorf("%s : file exists", name)
+	}
+
+	return fs.pool.do(func(c *ftp.ServerConn) error {
+		return c.MakeDir(cleanPath(name))
+	})
+}
+
+func (fs *ftpStreamStore) Remove(name string) error {
+	fi, err := fs.Stat(name)
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		files, err := fs.Readdir(name)
+		if err != nil {
+			return err
+		}
+		if len(files) != 0 {
+			return fmt.Errorf("%s : directory not empty", name)
+		}
+	}
+
+	return fs.pool.do(func(c *ftp.ServerConn) error {
+		if fi.IsDir() {
+			return c.RemoveDir(cleanPath(name))
+		}
+		return c.Delete(cleanPath(name))
+	})
+}
+
+// liveConn returns a connection from the pool that is known to be alive,
+// for transfers that can not simply be retried if they fail part way.
+func (fs *ftpStreamStore) liveConn() (*ftp.ServerConn, error) {
+	for {
+		c, reused, err := fs.pool.get()
+		if err != nil {
+			return nil, err
+		}
+		if !reused {
+			return c, nil
+		}
+		if err := c.NoOp(); err == nil {
+			return c, nil
+		}
+		fs.pool.put(c, false)
+	}
+}
+
+// CreateWriteCloser streams the data to a STOR on a connection of its own,
+// which completes when the writer is closed.
+func (fs *ftpStreamStore) CreateWriteCloser(name string) (straw.StrawWriter, error) {
+	if err := fs.checkParentDir(name); err != nil {
+		return nil, err
+	}
+
+	if fi, err := fs.Stat(name); err == nil && fi.IsDir() {
+		return nil, fmt.Errorf("%s is a directory", name)
+	}
+
+	c, err := fs.liveConn()
+	if err != nil {
+		return nil, err
+	}
+
+	pr, pw := io.Pipe()
+
+	errCh := make(chan error, 1)
+
+	go func() {
+		err := c.Stor(cleanPath(name), pr)
+		fs.pool.put(c, err == nil || isProtocolError(err))
+		// Unblock any writer if the server gave up early.
+		pr.CloseWithError(err)
+		errCh <- err
+	}()
+
+	return &ftpUploader{errCh, pw}, nil
+}
+
+type ftpUploader struct {
+	errCh chan error
+	wc    io.WriteCloser
+}
+
+func (wc *ftpUploader) Write(data []byte) (int, error) {
+	return wc.wc.Write(data)
+}
+
+func (wc *ftpUploader) Close() error {
+	err := wc.wc.Close()
+	if err != nil {
+		return err
+	}
+	return <-wc.errCh
+}
+
+// OpenReadCloser stats name first, since RETR on a directory and on a
+// missing file fail the same way, and then starts the transfer on a
+// connection of its own.
+func (fs *ftpStreamStore) OpenReadCloser(name string) (straw.StrawReader, error) {
+	fi, err := fs.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	if fi.IsDir() {
+		return nil, fmt.Errorf("%s is a directory", name)
+	}
+
+	c, err := fs.liveConn()
+	if err != nil {
+		return nil, err
+	}
+	r := &ftpReader{fs: fs, path: cleanPath(name), c: c, healthy: true, seek: -1, fi: fi}
+	if err := r.retr(0); err != nil {
+		fs.pool.put(c, isProtocolError(err))
+		if isFileUnavailable(err) {
+			return nil, notExist("open", name)
+		}
+		return nil, err
+	}
+	return r, nil
+}
+
+type ftpReader struct {
+	fs   *ftpStreamStore
+	path string
+
+	// c is used for sequential reads.  It is given back to the pool on
+	// Close, unless a transfer was abandoned part way.
+	c       *ftp.ServerConn
+	healthy bool
+
+	resp    *ftp.Response
+	drained bool
+
+	// -1 means don't seek
+	seek int64
+
+	fi os.FileInfo
+}
+
+// Stat returns the FileInfo looked up when the reader was opened, without
+// making another request.
+func (r *ftpReader) Stat() (os.FileInfo, error) {
+	return r.fi, nil
+}
+
+func (r *ftpReader) retr(offset int64) error {
+	if offset >= r.fi.Size() {
+		// Servers disagree on what REST past the end means, so do not ask.
+		r.resp, r.drained = nil, true
+		return nil
+	}
+	resp, err := r.c.RetrFrom(r.path, uint64(offset))
+	if err != nil {
+		return err
+	}
+	r.resp, r.drained = resp, false
+	return nil
+}
+
+// closeResp ends the current transfer.  Closing one before it has been read
+// to the end aborts it, after which the control connection is in no state
+// to be reused.
+func (r *ftpReader) closeResp() error {
+	if r.resp == nil {
+		return nil
+	}
+	err := r.resp.Close()
+	r.resp = nil
+	if !r.drained {
+		r.healthy = false
+		return nil
+	}
+	if err != nil {
+		r.healthy = false
+	}
+	return err
+}
+
+func (r *ftpReader) Seek(start int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+		if start < 0 {
+			return 0, errors.New("invalid seek position")
+		}
+		r.seek = start
+		return start, nil
+	default:
+		return 0, fmt.Errorf("seek %d not currently supported in ftp backend", whence)
+	}
+}
+
+func (r *ftpReader) Read(buf []byte) (int, error) {
+	if r.c == nil {
+		return 0, os.ErrClosed
+	}
+	if r.seek != -1 {
+		// we have a deferred seek to do before we read.
+		if err := r.closeResp(); err != nil {
+			return 0, err
+		}
+		if !r.healthy {
+			r.fs.pool.put(r.c, false)
+			r.c = nil
+			c, err := r.fs.liveConn()
+			if err != nil {
+				return 0, err
+			}
+			r.c, r.healthy = c, true
+		}
+		if err := r.retr(r.seek); err != nil {
+			return 0, err
+		}
+		r.seek = -1
+	}
+
+	if r.resp == nil {
+		return 0, io.EOF
+	}
+	n, err := r.resp.Read(buf)
+	if err == io.EOF {
+		r.drained = true
+		if cerr := r.closeResp(); cerr != nil {
+			return n, cerr
+		}
+	}
+	return n, err
+}
+
+func (r *ftpReader) Close() error {
+	if r.c == nil {
+		return nil
+	}
+	err := r.closeResp()
+	r.fs.pool.put(r.c, r.healthy)
+	r.c = nil
+	return err
+}
+
+// ReadAt runs a transfer from start on a separate connection, so it is safe
+// to call concurrently with itself and with Read.  Unless it reads to the
+// end of the file, that connection cannot be reused, see Options.
+func (r *ftpReader) ReadAt(buf []byte, start int64) (int, error) {
+	size := r.fi.Size()
+	if start >= size {
+		return 0, io.EOF
+	}
+	want := int64(len(buf))
+	if rest := size - start; rest < want {
+		want = rest
+	}
+	if want == 0 {
+		return 0, nil
+	}
+
+	for {
+		c, reused, err := r.fs.pool.get()
+		if err != nil {
+			return 0, err
+		}
+		resp, err := c.RetrFrom(r.path, uint64(start))
+		if err != nil {
+			r.fs.pool.put(c, isProtocolError(err))
+			if reused && !isProtocolError(err) {
+				continue
+			}
+			if isFileUnavailable(err) {
+				return 0, notExist("read", r.path)
+			}
+			return 0, err
+		}
+
+		n, err := io.ReadFull(resp, buf[:want])
+		healthy := false
+		if err == nil && start+want == size {
+			// The transfer is complete, so the connection can be reused
+			// once the server has confirmed it.
+			var one [1]byte
+			if m, _ := resp.Read(one[:]); m == 0 {
+				healthy = resp.Close() == nil
+			}
+		}
+		_ = resp.Close()
+		r.fs.pool.put(c, healthy)
+
+		switch {
+		case err == io.ErrUnexpectedEOF || err == io.EOF:
+			return n, io.EOF
+		case err != nil:
+			return n, err
+		case n < len(buf):
+			return n, io.EOF
+		default:
+			return n, nil
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package ftp
+
+import (
+	"crypto/tls"
+	"errors"
+	"net/textproto"
+	"sync"
+
+	"github.com/jlaffaye/ftp"
+)
+
+var errStoreClosed = errors.New("ftp stream store is closed")
+
+// connPool hands out logged in control connections.  An ftp control
+// connection can only run one transfer at a time, so every reader, writer
+// and ReadAt call takes a connection of its own for as long as it needs it.
+type connPool struct {
+	addr string
+	opts Options
+
+	lk     sync.Mutex
+	idle   []*ftp.ServerConn
+	closed bool
+}
+
+func (p *connPool) dial() (*ftp.ServerConn, error) {
+	dialOpts := []ftp.DialOption{
+		ftp.DialWithTimeout(p.opts.Timeout),
+		ftp.DialWithDisabledEPSV(p.opts.DisableEPSV),
+	}
+	if p.opts.TLS != TLSNone {
+		conf := p.opts.TLSConfig
+		if conf == nil {
+			conf = &tls.Config{}
+		}
+		if conf.ServerName == "" && !conf.InsecureSkipVerify {
+			conf = conf.Clone()
+			conf.ServerName = hostOnly(p.addr)
+		}
+		if p.opts.TLS == TLSImplicit {
+			dialOpts = append(dialOpts, ftp.DialWithTLS(conf))
+		} else {
+			dialOpts = append(dialOpts, ftp.DialWithExplicitTLS(conf))
+		}
+	}
+
+	c, err := ftp.Dial(p.addr, dialOpts...)
+	if err != nil {
+		return nil, err
+	}
+	user := p.opts.User
+	if user == "" {
+		user = "anonymous"
+	}
+	if err := c.Login(user, p.opts.Password); err != nil {
+		_ = c.Quit()
+		return nil, err
+	}
+	return c, nil
+}
+
+// get returns an idle connection if there is one, and dials a new one
+// otherwise.  reused reports which of the two happened.
+func (p *connPool) get() (c *ftp.ServerConn, reused bool, err error) {
+	p.lk.Lock()
+	if p.closed {
+		p.lk.Unlock()
+		return nil, false, errStoreClosed
+	}
+	if n := len(p.idle); n > 0 {
+		c = p.idle[n-1]
+		p.idle = p.idle[:n-1]
+		p.lk.Unlock()
+		return c, true, nil
+	}
+	p.lk.Unlock()
+
+	c, err = p.dial()
+	return c, false, err
+}
+
+// put returns c to the pool, or closes it if it can no longer be trusted or
+// there are already enough idle connections.
+func (p *connPool) put(c *ftp.ServerConn, healthy bool) {
+	p.lk.Lock()
+	if healthy && !p.closed && len(p.idle) < p.opts.MaxIdleConns {
+		p.idle = append(p.idle, c)
+		p.lk.Unlock()
+		return
+	}
+	p.lk.Unlock()
+	_ = c.Quit()
+}
+
+// do runs op on a connection from the pool.  A protocol level error, such as
+// a missing file, leaves the connection usable.  Any other error discards
+// it, and if the connection had been sitting idle it is assumed to have gone
+// stale and op is tried once more on a fresh one.
+func (p *connPool) do(op func(*ftp.ServerConn) error) error {
+	for {
+		c, reused, err := p.get()
+		if err != nil {
+			return err
+		}
+		err = op(c)
+		healthy := err == nil || isProtocolError(err)
+		p.put(c, healthy)
+		if healthy || !reused {
+			return err
+		}
+	}
+}
+
+func (p *connPool) Close() error {
+	p.lk.Lock()
+	idle := p.idle
+	p.idle = nil
+	p.closed = true
+	p.lk.Unlock()
+
+	var err error
+	for _, c := range idle {
+		if e := c.Quit(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+func isProtocolError(err error) bool {
+	var te *textproto.Error
+	return errors.As(err, &te)
+}
+
+// isFileUnavailable reports whether err is a 550 reply, which servers use for
+// missing files, but also for anything else they will not act on.
+func isFileUnavailable(err error) bool {
+	var te *textproto.Error
+	return errors.As(err, &te) && te.Code == ftp.StatusFileUnavailable
+}
+
+// isNotImplemented reports whether err means the server does not support the
+// command.
+func isNotImplemented(err error) bool {
+	var te *textproto.Error
+	if !errors.As(err, &te) {
+		return false
+	}
+	switch te.Code {
+	case ftp.StatusNotImplemented, ftp.StatusBadCommand, ftp.StatusNotImplementedParameter:
+		return true
+	}
+	return false
+}
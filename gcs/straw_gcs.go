@@ -9,10 +9,12 @@ import (
 	"os"
 	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
 
 	"cloud.google.com/go/storage"
 	"github.com/uw-labs/straw"
+	"github.com/uw-labs/straw/cache"
 	"google.golang.org/api/googleapi"
 	"google.golang.org/api/iterator"
 	"google.golang.org/api/option"
@@ -22,17 +24,89 @@ var _ straw.StreamStore = &gcsStreamStore{}
 
 func init() {
 	straw.Register("gs", func(u *url.URL) (straw.StreamStore, error) {
-		creds := u.Query().Get("credentialsfile")
-		if creds == "" {
-			return nil, fmt.Errorf("gs URLs must provide a `credentialsfile` parameter")
+		opts, err := optionsFromURL(u)
+		if err != nil {
+			return nil, err
+		}
+		ss, err := newGCSStreamStore(u.Host, opts)
+		if err != nil {
+			return nil, err
+		}
+		// A path in the URL roots the store at that prefix in the bucket.
+		if u.Path != "" && u.Path != "/" {
+			return straw.Sub(ss, u.Path), nil
 		}
-		return newGCSStreamStore(creds, u.Host)
+		return ss, nil
 	})
 }
 
-func newGCSStreamStore(credentialsFile string, bucket string) (*gcsStreamStore, error) {
+// Options configures a gcs backed StreamStore.  The zero value uses
+// Application Default Credentials against the real GCS endpoint, or the
+// emulator named by the `STORAGE_EMULATOR_HOST` environment variable if it
+// is set.
+type Options struct {
+	// CredentialsFile is a service account or refresh token JSON file.  If
+	// empty, Application Default Credentials are used.
+	CredentialsFile string
+	// Endpoint overrides the GCS JSON API endpoint, e.g.
+	// `http://localhost:4443` for fake-gcs-server.
+	Endpoint string
+	// Anonymous disables authentication entirely, which is useful for public
+	// buckets and emulators.
+	Anonymous bool
+	// TTLOptions sets how long the results of lookups are cached for.
+	cache.TTLOptions
+}
+
+// NewStreamStore returns a StreamStore for the given bucket.
+func NewStreamStore(bucket string, opts Options) (straw.StreamStore, error) {
+	return newGCSStreamStore(bucket, opts)
+}
+
+// optionsFromURL reads the `credentialsfile`, `endpoint`, `anonymous`,
+// `metadata_ttl` and `negative_metadata_ttl` query parameters.
+func optionsFromURL(u *url.URL) (Options, error) {
+	q := u.Query()
+	opts := Options{
+		CredentialsFile: q.Get("credentialsfile"),
+		Endpoint:        q.Get("endpoint"),
+	}
+	if anon := q.Get("anonymous"); anon != "" {
+		b, err := strconv.ParseBool(anon)
+		if err != nil {
+			return Options{}, fmt.Errorf("invalid %q query parameter: %w", "anonymous", err)
+		}
+		opts.Anonymous = b
+	}
+	if opts.Anonymous && opts.CredentialsFile != "" {
+		return Options{}, errors.New("gs URLs can not set both `anonymous` and `credentialsfile`")
+	}
+	ttls, err := cache.TTLOptionsFromQuery(q)
+	if err != nil {
+		return Options{}, err
+	}
+	opts.TTLOptions = ttls
+	return opts, nil
+}
+
+func newGCSStreamStore(bucket string, opts Options) (*gcsStreamStore, error) {
+	var clientOpts []option.ClientOption
+	if opts.CredentialsFile != "" {
+		clientOpts = append(clientOpts, option.WithCredentialsFile(opts.CredentialsFile))
+	}
+	if opts.Anonymous {
+		clientOpts = append(clientOpts, option.WithoutAuthentication())
+	}
+	if opts.Endpoint != "" {
+		endpoint, err := jsonAPIEndpoint(opts.Endpoint)
+		if err != nil {
+			return nil, err
+		}
+		clientOpts = append(clientOpts, option.WithEndpoint(endpoint))
+	}
+
 	ctx := context.Background()
-	gcsClient, err := storage.NewClient(ctx, option.WithCredentialsFile(credentialsFile))
+	gcsClient, err := storage.NewClient(ctx, clientOpts...)
 	if err != nil {
 		return nil, err
 	}
@@ -41,15 +115,35 @@ func newGCSStreamStore(credentialsFile string, bucket string) (*gcsStreamStore,
 		client: gcsClient,
 		bucket: bucket,
 		ctx:    ctx,
+		meta:   opts.TTLOptions.Cache(),
 	}
 
 	return ss, nil
 }
 
+// jsonAPIEndpoint turns a bare host URL such as `http://localhost:4443` into
+// the JSON API base path the storage client expects.  Endpoints that already
+// have a path are used unchanged.
+func jsonAPIEndpoint(endpoint string) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", fmt.Errorf("invalid gcs endpoint %q: %w", endpoint, err)
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return "", fmt.Errorf("invalid gcs endpoint %q: scheme and host are required", endpoint)
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/storage/v1/"
+	}
+	return u.String(), nil
+}
+
 type gcsStreamStore struct {
 	client *storage.Client
 	bucket string
 	ctx    context.Context
+	// meta caches Stat and Readdir results, if enabled.
+	meta *cache.MetadataCache
 }
 
 func (fs *gcsStreamStore) Close() error {
@@ -62,6 +156,14 @@ func (fs *gcsStreamStore) Lstat(name string) (os.FileInfo, error) {
 }
 
 func (fs *gcsStreamStore) Stat(name string) (os.FileInfo, error) {
+	return fs.meta.Stat(name, fs.stat)
+}
+
+// stat first fetches the attributes of the exact object, and only if that is
+// not found falls back to listing a single object beneath `name/` to detect
+// an implicit directory.  When an object `name` and objects beneath `name/`
+// both exist, the object takes precedence and Stat reports a file.
+func (fs *gcsStreamStore) stat(name string) (os.FileInfo, error) {
 	name = fs.noSlashPrefix(name)
 	name = fs.noSlashSuffix(name)
 
@@ -73,68 +175,78 @@ func (fs *gcsStreamStore) Stat(name string) (os.FileInfo, error) {
 		}, nil
 	}
 
-	input := storage.Query{
-		Prefix:    name,
-		Delimiter: "/",
+	attrs, err := fs.client.Bucket(fs.bucket).Object(name).Attrs(fs.ctx)
+	if err == nil {
+		return &gcsStatResult{
+			name:    fs.lastElem(name),
+			modTime: attrs.Updated,
+			size:    attrs.Size,
+			etag:    strconv.FormatInt(attrs.Generation, 10),
+		}, nil
+	}
+	if err != storage.ErrObjectNotExist {
+		return nil, err
 	}
-	iter := fs.client.Bucket(fs.bucket).Objects(fs.ctx, &input)
 
-	var matching []os.FileInfo
+	return fs.statDir(name)
+}
 
-attrLoop:
-	for {
-		attrs, err := iter.Next()
-		if err != nil {
-			if err == iterator.Done {
-				break attrLoop
-			}
-			return nil, err
-		}
-		if attrs.Name == name {
-			matching = append(matching, &gcsStatResult{
-				name:    fs.lastElem(name),
-				modTime: attrs.Updated,
-				size:    attrs.Size,
-			})
-		} else if fs.noSlashSuffix(attrs.Prefix) == name {
-			matching = append(matching, &gcsStatResult{
-				name:  fs.lastElem(name),
-				isDir: true,
-				// modTime: ??,
-				size: 4096,
-			})
-		}
-	}
+// statDir reports name as a directory if any object exists beneath `name/`,
+// which is either an explicit directory marker or an implicit directory.
+func (fs *gcsStreamStore) statDir(name string) (os.FileInfo, error) {
+	prefix := name + "/"
+	iter := fs.client.Bucket(fs.bucket).Objects(fs.ctx, &storage.Query{Prefix: prefix})
+	iter.PageInfo().MaxSize = 1
 
-	switch len(matching) {
-	case 0:
+	attrs, err := iter.Next()
+	if err == iterator.Done {
 		return nil, os.ErrNotExist
-	case 1:
-		return matching[0], nil
-	default:
-		panic("bug?")
 	}
-}
-
-func (fs *gcsStreamStore) OpenReadCloser(name string) (straw.StrawReader, error) {
-	fi, err := fs.Stat(name)
 	if err != nil {
 		return nil, err
 	}
-	if fi.IsDir() {
+
+	res := &gcsStatResult{
+		name:  fs.lastElem(name),
+		isDir: true,
+		size:  4096,
+	}
+	// The directory marker, if there is one, sorts before any other object
+	// with the same prefix.
+	if attrs.Name == prefix {
+		res.modTime = attrs.Updated
+	}
+	return res, nil
+}
+
+// OpenReadCloser opens the object straight away, so size, mtime and
+// existence all come from a single request.  Only when there is no such
+// object does it list beneath `name/` to tell a directory from a missing
+// file.
+func (fs *gcsStreamStore) OpenReadCloser(name string) (straw.StrawReader, error) {
+	objName := fs.noSlashSuffix(fs.noSlashPrefix(name))
+	if objName == "" {
 		return nil, fmt.Errorf("%s is a directory", name)
 	}
 
-	nameNoSlash := fs.noSlashPrefix(name)
-	r, err := fs.client.Bucket(fs.bucket).Object(nameNoSlash).NewReader(fs.ctx)
+	r, err := fs.client.Bucket(fs.bucket).Object(objName).NewReader(fs.ctx)
 	if err != nil {
-		if err == storage.ErrObjectNotExist {
-			return nil, os.ErrNotExist
+		if err != storage.ErrObjectNotExist {
+			return nil, err
 		}
-		return nil, err
+		if _, err := fs.statDir(objName); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%s is a directory", name)
 	}
 
-	return &gcsReader{r, fs, nameNoSlash, fs.ctx, -1}, nil
+	fi := &gcsStatResult{
+		name:    fs.lastElem(objName),
+		modTime: r.Attrs.LastModified,
+		size:    r.Attrs.Size,
+		etag:    strconv.FormatInt(r.Attrs.Generation, 10),
+	}
+	return &gcsReader{r, fs, objName, fs.ctx, -1, fi}, nil
 }
 
 type gcsReader struct {
@@ -145,6 +257,14 @@ type gcsReader struct {
 
 	// -1 means don't seek
 	seek int64
+
+	fi os.FileInfo
+}
+
+// Stat returns the FileInfo from the initial read of the object, without
+// making another request.
+func (r *gcsReader) Stat() (os.FileInfo, error) {
+	return r.fi, nil
 }
 
 func (r *gcsReader) Seek(start int64, whence int) (int64, error) {
@@ -223,7 +343,9 @@ func (fs *gcsStreamStore) Mkdir(name string, mode os.FileMode) error {
 		_ = w.Close()
 		return err
 	}
-	return w.Close()
+	err := w.Close()
+	fs.meta.Created(name)
+	return err
 }
 
 func (fs *gcsStreamStore) checkParentDir(child string) error {
@@ -261,7 +383,9 @@ func (fs *gcsStreamStore) Remove(name string) error {
 		name = fs.fixTrailingSlash(name, true)
 	}
 
-	return fs.client.Bucket(fs.bucket).Object(name).Delete(fs.ctx)
+	err = fs.client.Bucket(fs.bucket).Object(name).Delete(fs.ctx)
+	fs.meta.Removed(name)
+	return err
 }
 
 func (fs *gcsStreamStore) CreateWriteCloser(name string) (straw.StrawWriter, error) {
@@ -275,7 +399,24 @@ func (fs *gcsStreamStore) CreateWriteCloser(name string) (straw.StrawWriter, err
 		return nil, fmt.Errorf("%s is a directory", name)
 	}
 
-	return fs.client.Bucket(fs.bucket).Object(name).NewWriter(fs.ctx), nil
+	w := fs.client.Bucket(fs.bucket).Object(name).NewWriter(fs.ctx)
+	if fs.meta == nil {
+		return w, nil
+	}
+	return &gcsWriter{w, fs, name}, nil
+}
+
+// gcsWriter keeps the metadata cache up to date once the object is written.
+type gcsWriter struct {
+	*storage.Writer
+	fs   *gcsStreamStore
+	name string
+}
+
+func (w *gcsWriter) Close() error {
+	err := w.Writer.Close()
+	w.fs.meta.Created(w.name)
+	return err
 }
 
 func (fs *gcsStreamStore) noSlashPrefix(s string) string {
@@ -305,6 +446,10 @@ func (fs *gcsStreamStore) lastElem(s string) string {
 }
 
 func (fs *gcsStreamStore) Readdir(name string) ([]os.FileInfo, error) {
+	return fs.meta.Readdir(name, fs.readdir)
+}
+
+func (fs *gcsStreamStore) readdir(name string) ([]os.FileInfo, error) {
 	if !strings.HasSuffix(name, "/") {
 		name = name + "/"
 	}
@@ -333,6 +478,7 @@ attrLoop:
 					name:    strings.TrimPrefix(attrs.Name, name),
 					modTime: attrs.Updated,
 					size:    attrs.Size,
+					etag:    strconv.FormatInt(attrs.Generation, 10),
 				}
 				results = append(results, result)
 			}
@@ -10,6 +10,7 @@ type gcsStatResult struct {
 	isDir   bool
 	modTime time.Time
 	size    int64
+	etag    string
 }
 
 func (sr *gcsStatResult) Name() string {
@@ -28,6 +29,12 @@ func (sr *gcsStatResult) ModTime() time.Time {
 	return sr.modTime
 }
 
+// ETag returns the object's generation, which is also what a reader reports,
+// unlike the object's actual ETag.
+func (sr *gcsStatResult) ETag() string {
+	return sr.etag
+}
+
 func (sr *gcsStatResult) Mode() os.FileMode {
 	if sr.IsDir() {
 		return os.ModeDir | 0755
@@ -0,0 +1,469 @@
+package git
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/uw-labs/straw"
+)
+
+var _ straw.StreamStore = &gitStreamStore{}
+
+func init() {
+	straw.Register("git", func(u *url.URL) (straw.StreamStore, error) {
+		if u.Host != "" {
+			return nil, errors.New("git urls name a local repository, e.g. `git:///path/to/repo.git`")
+		}
+		repo, err := git.PlainOpen(u.Path)
+		if err != nil {
+			return nil, err
+		}
+		ss, err := newGitStreamStore(repo, optionsFromURL(u))
+		if err != nil {
+			closeStorer(repo)
+			return nil, err
+		}
+		ss.closeRepo = true
+		return ss, nil
+	})
+}
+
+// Options configures a git backed StreamStore.
+type Options struct {
+	// Ref is the revision whose tree is presented, in any form `git
+	// rev-parse` understands, such as a branch, tag or commit hash.
+	// Defaults to `HEAD`.
+	Ref string
+}
+
+// NewStreamStore returns a read only StreamStore presenting the tree of
+// the commit named by opts.Ref.  Every entry has the commit time as its
+// modification time.  Closing the returned StreamStore does not close
+// repo.
+func NewStreamStore(repo *git.Repository, opts Options) (straw.StreamStore, error) {
+	return newGitStreamStore(repo, opts)
+}
+
+// optionsFromURL reads the `ref` query parameter.
+func optionsFromURL(u *url.URL) Options {
+	return Options{Ref: u.Query().Get("ref")}
+}
+
+func newGitStreamStore(repo *git.Repository, opts Options) (*gitStreamStore, error) {
+	if opts.Ref == "" {
+		opts.Ref = "HEAD"
+	}
+	hash, err := repo.ResolveRevision(plumbing.Revision(opts.Ref))
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve %q: %w", opts.Ref, err)
+	}
+	commit, err := repo.CommitObject(*hash)
+	if err != nil {
+		return nil, err
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, err
+	}
+	return &gitStreamStore{repo: repo, tree: tree, modTime: commit.Committer.When}, nil
+}
+
+func closeStorer(repo *git.Repository) error {
+	if c, ok := repo.Storer.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+type gitStreamStore struct {
+	// lk serialises access to the repository, whose storage is not safe
+	// for concurrent use.
+	lk      sync.Mutex
+	repo    *git.Repository
+	tree    *object.Tree
+	modTime time.Time
+	// closeRepo is set when the repository was opened from a URL.
+	closeRepo bool
+}
+
+func (fs *gitStreamStore) Close() error {
+	if fs.closeRepo {
+		return closeStorer(fs.repo)
+	}
+	return nil
+}
+
+// gitEntry is a tree entry, along with the size of its blob.
+type gitEntry struct {
+	name    string
+	mode    filemode.FileMode
+	hash    plumbing.Hash
+	size    int64
+	modTime time.Time
+	// symlink is the clean absolute target of a symlink.
+	symlink string
+}
+
+func (e *gitEntry) isDir() bool {
+	// Submodule commits aren't in this repository, so submodules are
+	// presented as empty directories.
+	return e.mode == filemode.Dir || e.mode == filemode.Submodule
+}
+
+func (e *gitEntry) Name() string {
+	return e.name
+}
+
+func (e *gitEntry) IsDir() bool {
+	return e.isDir()
+}
+
+func (e *gitEntry) Size() int64 {
+	if e.isDir() {
+		return 4096
+	}
+	return e.size
+}
+
+func (e *gitEntry) ModTime() time.Time {
+	return e.modTime
+}
+
+func (e *gitEntry) Mode() os.FileMode {
+	if e.isDir() {
+		return os.ModeDir | 0755
+	}
+	m, err := e.mode.ToOSFileMode()
+	if err != nil {
+		return 0644
+	}
+	return m
+}
+
+func (e *gitEntry) Sys() interface{} {
+	return nil
+}
+
+// entry fills in a gitEntry for te, which is in directory dir.  The caller
+// must hold fs.lk.
+func (fs *gitStreamStore) entry(dir string, te *object.TreeEntry) (*gitEntry, error) {
+	e := &gitEntry{name: te.Name, mode: te.Mode, hash: te.Hash, modTime: fs.modTime}
+	if e.isDir() {
+		return e, nil
+	}
+	blob, err := fs.repo.BlobObject(te.Hash)
+	if err != nil {
+		return nil, err
+	}
+	e.size = blob.Size
+	if te.Mode == filemode.Symlink {
+		rc, err := blob.Reader()
+		if err != nil {
+			return nil, err
+		}
+		target, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return nil, err
+		}
+		t := string(target)
+		if !path.IsAbs(t) {
+			t = path.Join(dir, t)
+		}
+		e.symlink = path.Clean(t)
+	}
+	return e, nil
+}
+
+// maxSymlinks is how many symlinks are followed before giving up, as with
+// ELOOP.
+const maxSymlinks = 40
+
+// lookup returns the entry for name, following symlinks if follow is set.
+// The caller must hold fs.lk.
+func (fs *gitStreamStore) lookup(op, name string, follow bool) (*gitEntry, error) {
+	e, _, err := fs.resolve(op, name, follow)
+	return e, err
+}
+
+// resolve returns the entry for name and its path with every symlink
+// resolved.  Symlinks are followed wherever they are in the path but the
+// last component, where they are only followed if follow is set.  The
+// caller must hold fs.lk.
+func (fs *gitStreamStore) resolve(op, name string, follow bool) (*gitEntry, string, error) {
+	notExist := &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+	root := &gitEntry{name: "/", mode: filemode.Dir, hash: fs.tree.Hash, modTime: fs.modTime}
+
+	rest := split(name)
+	dir, tree, e := "/", fs.tree, root
+	for links := 0; len(rest) != 0; {
+		var te *object.TreeEntry
+		for i := range tree.Entries {
+			if tree.Entries[i].Name == rest[0] {
+				te = &tree.Entries[i]
+				break
+			}
+		}
+		if te == nil {
+			return nil, "", notExist
+		}
+		var err error
+		if e, err = fs.entry(dir, te); err != nil {
+			return nil, "", err
+		}
+
+		if e.symlink != "" && (follow || len(rest) > 1) {
+			if links == maxSymlinks {
+				return nil, "", &os.PathError{Op: op, Path: name, Err: errors.New("too many levels of symbolic links")}
+			}
+			links++
+			// Start again from the root with the target in place of the
+			// symlink.
+			rest = split(path.Join(append([]string{e.symlink}, rest[1:]...)...))
+			dir, tree, e = "/", fs.tree, root
+			continue
+		}
+
+		dir = path.Join(dir, rest[0])
+		rest = rest[1:]
+		if len(rest) == 0 {
+			break
+		}
+		if !e.isDir() || e.mode == filemode.Submodule {
+			return nil, "", notExist
+		}
+		if tree, err = fs.repo.TreeObject(e.hash); err != nil {
+			return nil, "", err
+		}
+	}
+	return e, dir, nil
+}
+
+// split returns the components of the cleaned path p.
+func split(p string) []string {
+	p = path.Clean("/" + p)
+	if p == "/" {
+		return nil
+	}
+	return strings.Split(p[1:], "/")
+}
+
+func (fs *gitStreamStore) Lstat(name string) (os.FileInfo, error) {
+	fs.lk.Lock()
+	defer fs.lk.Unlock()
+
+	e, err := fs.lookup("lstat", name, false)
+	if err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// Stat follows symlinks, but reports the name it was given.
+func (fs *gitStreamStore) Stat(name string) (os.FileInfo, error) {
+	fs.lk.Lock()
+	defer fs.lk.Unlock()
+
+	e, err := fs.lookup("stat", name, true)
+	if err != nil {
+		return nil, err
+	}
+	if e.name != "/" {
+		named := *e
+		named.name = path.Base(path.Clean("/" + name))
+		e = &named
+	}
+	return e, nil
+}
+
+// Readdir reports symlinks as themselves, as Lstat does, so that
+// straw.Walk does not follow them.
+func (fs *gitStreamStore) Readdir(name string) ([]os.FileInfo, error) {
+	fs.lk.Lock()
+	defer fs.lk.Unlock()
+
+	e, dir, err := fs.resolve("readdir", name, true)
+	if err != nil {
+		return nil, err
+	}
+	if !e.isDir() {
+		return nil, fmt.Errorf("%s not a directory", name)
+	}
+	if e.mode == filemode.Submodule {
+		return nil, nil
+	}
+
+	tree, err := fs.repo.TreeObject(e.hash)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]os.FileInfo, 0, len(tree.Entries))
+	for i := range tree.Entries {
+		ce, err := fs.entry(dir, &tree.Entries[i])
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, ce)
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].Name() < results[j].Name() })
+	return results, nil
+}
+
+// OpenReadCloser streams the blob from the object store.  Blobs are stored
+// compressed, so seeking backwards starts reading the blob again.
+func (fs *gitStreamStore) OpenReadCloser(name string) (straw.StrawReader, error) {
+	fs.lk.Lock()
+	defer fs.lk.Unlock()
+
+	e, err := fs.lookup("open", name, true)
+	if err != nil {
+		return nil, err
+	}
+	if e.isDir() {
+		return nil, fmt.Errorf("%s is a directory", name)
+	}
+	blob, err := fs.repo.BlobObject(e.hash)
+	if err != nil {
+		return nil, err
+	}
+	rc, err := blob.Reader()
+	if err != nil {
+		return nil, err
+	}
+	named := *e
+	named.name = path.Base(path.Clean("/" + name))
+	return &gitReader{fs: fs, blob: blob, rc: rc, size: e.size, fi: &named}, nil
+}
+
+type gitReader struct {
+	fs   *gitStreamStore
+	blob *object.Blob
+	size int64
+
+	// rc is positioned at pos, while seek is where the next Read should
+	// start from.
+	rc   io.ReadCloser
+	pos  int64
+	seek int64
+
+	fi os.FileInfo
+}
+
+// Stat returns the FileInfo the reader was opened with.
+func (r *gitReader) Stat() (os.FileInfo, error) {
+	return r.fi, nil
+}
+
+func (r *gitReader) Seek(offset int64, whence int) (int64, error) {
+	var abs int64
+	switch whence {
+	case io.SeekStart:
+		abs = offset
+	case io.SeekCurrent:
+		abs = r.seek + offset
+	case io.SeekEnd:
+		abs = r.size + offset
+	default:
+		return 0, fmt.Errorf("invalid whence %d", whence)
+	}
+	if abs < 0 {
+		return 0, errors.New("invalid seek position")
+	}
+	r.seek = abs
+	return abs, nil
+}
+
+func (r *gitReader) Read(buf []byte) (int, error) {
+	r.fs.lk.Lock()
+	defer r.fs.lk.Unlock()
+
+	if r.rc == nil {
+		return 0, os.ErrClosed
+	}
+	if r.seek != r.pos {
+		if r.seek < r.pos {
+			rc, err := r.blob.Reader()
+			if err != nil {
+				return 0, err
+			}
+			_ = r.rc.Close()
+			r.rc, r.pos = rc, 0
+		}
+		n, err := io.CopyN(ioutil.Discard, r.rc, r.seek-r.pos)
+		r.pos += n
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := r.rc.Read(buf)
+	r.pos += int64(n)
+	r.seek = r.pos
+	return n, err
+}
+
+// ReadAt reads the blob from the start with a reader of its own, so it does
+// not disturb Read.
+func (r *gitReader) ReadAt(buf []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("invalid offset")
+	}
+	if off >= r.size {
+		return 0, io.EOF
+	}
+
+	r.fs.lk.Lock()
+	defer r.fs.lk.Unlock()
+
+	rc, err := r.blob.Reader()
+	if err != nil {
+		return 0, err
+	}
+	defer rc.Close()
+
+	if _, err := io.CopyN(ioutil.Discard, rc, off); err != nil {
+		return 0, err
+	}
+	n, err := io.ReadFull(rc, buf)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (r *gitReader) Close() error {
+	r.fs.lk.Lock()
+	defer r.fs.lk.Unlock()
+
+	if r.rc == nil {
+		return nil
+	}
+	err := r.rc.Close()
+	r.rc = nil
+	return err
+}
+
+func (fs *gitStreamStore) Mkdir(name string, mode os.FileMode) error {
+	return &os.PathError{Op: "mkdir", Path: name, Err: os.ErrPermission}
+}
+
+func (fs *gitStreamStore) Remove(name string) error {
+	return &os.PathError{Op: "remove", Path: name, Err: os.ErrPermission}
+}
+
+func (fs *gitStreamStore) CreateWriteCloser(name string) (straw.StrawWriter, error) {
+	return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrPermission}
+}
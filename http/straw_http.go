@@ -0,0 +1,434 @@
+package http
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	nethttp "net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/uw-labs/straw"
+	"github.com/uw-labs/straw/internal/httpio"
+	"golang.org/x/net/html"
+)
+
+var _ straw.StreamStore = &httpStreamStore{}
+
+func init() {
+	open := func(u *url.URL) (straw.StreamStore, error) {
+		opts, err := optionsFromURL(u)
+		if err != nil {
+			return nil, err
+		}
+		base := *u
+		base.RawQuery = ""
+		base.User = nil
+		return newHTTPStreamStore(base.String(), opts)
+	}
+	straw.Register("http", open)
+	straw.Register("https", open)
+}
+
+const (
+	// IndexHTML lists directories by parsing the links in the HTML index
+	// page a server returns for them, as produced by nginx autoindex,
+	// Apache mod_autoindex or Go's http.FileServer.
+	IndexHTML = "html"
+	// IndexJSON lists directories by requesting them with an
+	// `Accept: application/json` header, and expects a JSON array of
+	// objects with `name`, `size`, `mod_time` and `is_dir` fields, as
+	// produced by Caddy's file_server.
+	IndexJSON = "json"
+	// IndexNone disables directory listing.
+	IndexNone = "none"
+)
+
+// Options configures an http backed StreamStore.
+type Options struct {
+	// Client is used for all requests.  Defaults to http.DefaultClient.
+	Client *nethttp.Client
+	// Index selects how Readdir lists directories, one of IndexHTML,
+	// IndexJSON or IndexNone.  Defaults to IndexHTML.
+	Index string
+	// Username and Password, if set, are sent as basic auth with every
+	// request.
+	Username string
+	Password string
+}
+
+// NewStreamStore returns a read only StreamStore rooted at baseURL.
+func NewStreamStore(baseURL string, opts Options) (straw.StreamStore, error) {
+	return newHTTPStreamStore(baseURL, opts)
+}
+
+// optionsFromURL reads the `index` query parameter, and basic auth
+// credentials from the URL's user info.
+func optionsFromURL(u *url.URL) (Options, error) {
+	opts := Options{
+		Index: u.Query().Get("index"),
+	}
+	if u.User != nil {
+		opts.Username = u.User.Username()
+		opts.Password, _ = u.User.Password()
+	}
+	return opts, nil
+}
+
+func newHTTPStreamStore(baseURL string, opts Options) (*httpStreamStore, error) {
+	base, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, err
+	}
+	if base.Scheme != "http" && base.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported url scheme %q", base.Scheme)
+	}
+	base.Path = strings.TrimSuffix(base.Path, "/")
+	base.RawPath = ""
+
+	switch opts.Index {
+	case "":
+		opts.Index = IndexHTML
+	case IndexHTML, IndexJSON, IndexNone:
+	default:
+		return nil, fmt.Errorf("invalid index type %q", opts.Index)
+	}
+	if opts.Client == nil {
+		opts.Client = nethttp.DefaultClient
+	}
+
+	return &httpStreamStore{
+		base:     base,
+		client:   opts.Client,
+		index:    opts.Index,
+		username: opts.Username,
+		password: opts.Password,
+	}, nil
+}
+
+type httpStreamStore struct {
+	base     *url.URL
+	client   *nethttp.Client
+	index    string
+	username string
+	password string
+}
+
+func (fs *httpStreamStore) Close() error {
+	return nil
+}
+
+// urlFor returns the URL for name, relative to the base URL.
+func (fs *httpStreamStore) urlFor(name string, dir bool) *url.URL {
+	u := *fs.base
+	p := path.Clean("/" + name)
+	if p == "/" {
+		p = ""
+	}
+	u.Path = fs.base.Path + p
+	if dir {
+		u.Path += "/"
+	}
+	return &u
+}
+
+func (fs *httpStreamStore) do(method string, u *url.URL, header nethttp.Header) (*nethttp.Response, error) {
+	req, err := nethttp.NewRequest(method, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if fs.username != "" || fs.password != "" {
+		req.SetBasicAuth(fs.username, fs.password)
+	}
+	return fs.client.Do(req)
+}
+
+// isDirResponse reports whether the response was for a directory, which we
+// can only tell from a trailing slash on the final URL, after any redirect.
+func isDirResponse(resp *nethttp.Response) bool {
+	return strings.HasSuffix(resp.Request.URL.Path, "/")
+}
+
+func (fs *httpStreamStore) Lstat(name string) (os.FileInfo, error) {
+	// http has no concept of symlinks
+	return fs.Stat(name)
+}
+
+// Stat issues a HEAD request for name.  Servers that redirect `name` to
+// `name/`, as most do for directories, are reported as directories.
+func (fs *httpStreamStore) Stat(name string) (os.FileInfo, error) {
+	u := fs.urlFor(name, false)
+	if u.Path == fs.base.Path {
+		return &httpStatResult{name: "/", isDir: true, size: 4096}, nil
+	}
+
+	resp, err := fs.do(nethttp.MethodHead, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != nethttp.StatusOK {
+		return nil, httpio.StatusError("stat", name, resp)
+	}
+	return fileInfoFromResponse(path.Base(u.Path), resp), nil
+}
+
+func fileInfoFromResponse(name string, resp *nethttp.Response) *httpStatResult {
+	fi := &httpStatResult{name: name}
+	if isDirResponse(resp) {
+		fi.isDir = true
+		fi.size = 4096
+	} else if resp.ContentLength > 0 {
+		fi.size = resp.ContentLength
+	}
+	if lm := resp.Header.Get("Last-Modified"); lm != "" {
+		if t, err := nethttp.ParseTime(lm); err == nil {
+			fi.modTime = t
+		}
+	}
+	fi.etag = resp.Header.Get("ETag")
+	return fi
+}
+
+type httpStatResult struct {
+	name    string
+	isDir   bool
+	modTime time.Time
+	size    int64
+	etag    string
+}
+
+func (sr *httpStatResult) Name() string {
+	return sr.name
+}
+
+func (sr *httpStatResult) IsDir() bool {
+	return sr.isDir
+}
+
+func (sr *httpStatResult) Size() int64 {
+	return sr.size
+}
+
+func (sr *httpStatResult) ModTime() time.Time {
+	return sr.modTime
+}
+
+func (sr *httpStatResult) ETag() string {
+	return sr.etag
+}
+
+func (sr *httpStatResult) Mode() os.FileMode {
+	if sr.IsDir() {
+		return os.ModeDir | 0555
+	}
+	return 0444
+}
+
+func (sr *httpStatResult) Sys() interface{} {
+	return nil
+}
+
+func (fs *httpStreamStore) OpenReadCloser(name string) (straw.StrawReader, error) {
+	u := fs.urlFor(name, false)
+	if u.Path == fs.base.Path {
+		return nil, fmt.Errorf("%s is a directory", name)
+	}
+
+	resp, err := fs.do(nethttp.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != nethttp.StatusOK {
+		resp.Body.Close()
+		return nil, httpio.StatusError("open", name, resp)
+	}
+	if isDirResponse(resp) {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s is a directory", name)
+	}
+
+	fi := fileInfoFromResponse(path.Base(u.Path), resp)
+	// Read from the final URL, so that range requests do not have to
+	// follow the same redirects again.
+	return httpio.NewReader(fs.do, "http", name, resp.Request.URL, resp.Body, fi), nil
+}
+
+// Readdir lists name according to the configured index type.  Entries
+// found in an HTML index carry no size or modification time, so each file
+// is also sent a HEAD request.
+func (fs *httpStreamStore) Readdir(name string) ([]os.FileInfo, error) {
+	fi, err := fs.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return nil, fmt.Errorf("%s not a directory", name)
+	}
+
+	var results []os.FileInfo
+	switch fs.index {
+	case IndexJSON:
+		results, err = fs.readdirJSON(name)
+	case IndexHTML:
+		results, err = fs.readdirHTML(name)
+	default:
+		return nil, &os.PathError{Op: "readdir", Path: name, Err: os.ErrPermission}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(results, func(i, j int) bool { return results[i].Name() < results[j].Name() })
+	return results, nil
+}
+
+type jsonEntry struct {
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	IsDir   bool      `json:"is_dir"`
+}
+
+func (fs *httpStreamStore) readdirJSON(name string) ([]os.FileInfo, error) {
+	resp, err := fs.do(nethttp.MethodGet, fs.urlFor(name, true), nethttp.Header{"Accept": {"application/json"}})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != nethttp.StatusOK {
+		return nil, httpio.StatusError("readdir", name, resp)
+	}
+
+	var entries []jsonEntry
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return nil, fmt.Errorf("failed to parse directory listing for %s: %w", name, err)
+	}
+
+	var results []os.FileInfo
+	for _, e := range entries {
+		n := strings.TrimSuffix(e.Name, "/")
+		if n == "" || n == "." || n == ".." || strings.Contains(n, "/") {
+			continue
+		}
+		fi := &httpStatResult{name: n, isDir: e.IsDir, modTime: e.ModTime, size: e.Size}
+		if fi.isDir {
+			fi.size = 4096
+		}
+		results = append(results, fi)
+	}
+	return results, nil
+}
+
+func (fs *httpStreamStore) readdirHTML(name string) ([]os.FileInfo, error) {
+	dirURL := fs.urlFor(name, true)
+	resp, err := fs.do(nethttp.MethodGet, dirURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != nethttp.StatusOK {
+		return nil, httpio.StatusError("readdir", name, resp)
+	}
+	if ct, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); ct != "" && ct != "text/html" {
+		return nil, fmt.Errorf("directory listing for %s is %s, not html", name, ct)
+	}
+
+	children, err := htmlChildren(resp.Request.URL, resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []os.FileInfo
+	for _, c := range children {
+		if strings.HasSuffix(c, "/") {
+			results = append(results, &httpStatResult{
+				name:  strings.TrimSuffix(c, "/"),
+				isDir: true,
+				size:  4096,
+			})
+			continue
+		}
+		fi, err := fs.Stat(path.Join(name, c))
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, fi)
+	}
+	return results, nil
+}
+
+// htmlChildren returns the names of the direct children of dirURL linked to
+// from the page, with a trailing slash on directories.  Links elsewhere,
+// including to the parent and to sort orders, are ignored.
+func htmlChildren(dirURL *url.URL, body io.Reader) ([]string, error) {
+	seen := map[string]bool{}
+	var children []string
+
+	z := html.NewTokenizer(body)
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			if z.Err() == io.EOF {
+				return children, nil
+			}
+			return nil, z.Err()
+		case html.StartTagToken, html.SelfClosingTagToken:
+			tn, hasAttr := z.TagName()
+			if string(tn) != "a" || !hasAttr {
+				continue
+			}
+			for {
+				key, val, more := z.TagAttr()
+				if string(key) == "href" {
+					if c, ok := childName(dirURL, string(val)); ok && !seen[c] {
+						seen[c] = true
+						children = append(children, c)
+					}
+				}
+				if !more {
+					break
+				}
+			}
+		}
+	}
+}
+
+func childName(dirURL *url.URL, href string) (string, bool) {
+	ref, err := url.Parse(href)
+	if err != nil || ref.RawQuery != "" {
+		return "", false
+	}
+	u := dirURL.ResolveReference(ref)
+	if u.Scheme != dirURL.Scheme || u.Host != dirURL.Host {
+		return "", false
+	}
+	rest := strings.TrimPrefix(u.Path, dirURL.Path)
+	if rest == u.Path || rest == "" {
+		return "", false
+	}
+	if i := strings.Index(rest, "/"); i >= 0 && i != len(rest)-1 {
+		return "", false
+	}
+	return rest, true
+}
+
+func (fs *httpStreamStore) Mkdir(name string, mode os.FileMode) error {
+	return &os.PathError{Op: "mkdir", Path: name, Err: os.ErrPermission}
+}
+
+func (fs *httpStreamStore) Remove(name string) error {
+	return &os.PathError{Op: "remove", Path: name, Err: os.ErrPermission}
+}
+
+func (fs *httpStreamStore) CreateWriteCloser(name string) (straw.StrawWriter, error) {
+	return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrPermission}
+}
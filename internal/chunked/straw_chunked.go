@@ -0,0 +1,286 @@
+package chunked
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// StageSize is how much a Writer holds in memory before storing it, so
+// that backends can store several chunks in one round trip or transaction.
+const StageSize = 4 << 20
+
+// Source fetches the chunks of one file's content.
+type Source interface {
+	// Fetch returns chunks first to last inclusive, the first from byte
+	// start within it, and the last up to byte end within it, exclusive.
+	// It stops early at any chunk that is missing, and may return a chunk
+	// short if it has changed, which the Reader reports.
+	Fetch(first, last, start, end int64) ([][]byte, error)
+}
+
+// Trim cuts whole chunks first to last down to start and end, for Sources
+// that can only fetch whole chunks.  A short run is left alone for the
+// Reader to reject.
+func Trim(chunks [][]byte, first, last, start, end int64) [][]byte {
+	if int64(len(chunks)) != last-first+1 {
+		return chunks
+	}
+	if l := chunks[len(chunks)-1]; end <= int64(len(l)) {
+		chunks[len(chunks)-1] = l[:end]
+	}
+	if start <= int64(len(chunks[0])) {
+		chunks[0] = chunks[0][start:]
+	}
+	return chunks
+}
+
+// Reader reads content of a known size, split into chunks of chunkSize
+// but for the last, from a Source.
+type Reader struct {
+	src       Source
+	name      string
+	fi        os.FileInfo
+	size      int64
+	chunkSize int64
+
+	pos    int64
+	closed bool
+
+	// chunk is the last chunk fetched by Read, number chunkSeq.
+	chunk    []byte
+	chunkSeq int64
+}
+
+// NewReader returns a Reader for the content of the file name, which fi
+// describes.
+func NewReader(src Source, name string, fi os.FileInfo, chunkSize int64) *Reader {
+	return &Reader{src: src, name: name, fi: fi, size: fi.Size(), chunkSize: chunkSize, chunkSeq: -1}
+}
+
+// Stat returns the FileInfo of the content being read.
+func (r *Reader) Stat() (os.FileInfo, error) {
+	return r.fi, nil
+}
+
+func (r *Reader) Seek(offset int64, whence int) (int64, error) {
+	var abs int64
+	switch whence {
+	case io.SeekStart:
+		abs = offset
+	case io.SeekCurrent:
+		abs = r.pos + offset
+	case io.SeekEnd:
+		abs = r.size + offset
+	default:
+		return 0, fmt.Errorf("invalid whence %d", whence)
+	}
+	if abs < 0 {
+		return 0, errors.New("invalid seek position")
+	}
+	r.pos = abs
+	return abs, nil
+}
+
+// Read fetches whole chunks, and keeps the last one for the reads that
+// follow.
+func (r *Reader) Read(buf []byte) (int, error) {
+	if r.closed {
+		return 0, os.ErrClosed
+	}
+	if r.pos >= r.size {
+		return 0, io.EOF
+	}
+	if len(buf) == 0 {
+		return 0, nil
+	}
+
+	cs := r.chunkSize
+	seq := r.pos / cs
+	if seq != r.chunkSeq {
+		end := r.size - seq*cs
+		if end > cs {
+			end = cs
+		}
+		chunks, err := r.fetch(seq, seq, 0, end)
+		if err != nil {
+			return 0, err
+		}
+		r.chunk, r.chunkSeq = chunks[0], seq
+	}
+	n := copy(buf, r.chunk[r.pos-seq*cs:])
+	r.pos += int64(n)
+	return n, nil
+}
+
+// ReadAt fetches just the parts of the chunks overlapping buf, and leaves
+// the position used by Read alone, so it is safe to call concurrently.
+func (r *Reader) ReadAt(buf []byte, off int64) (int, error) {
+	if r.closed {
+		return 0, os.ErrClosed
+	}
+	if off < 0 {
+		return 0, errors.New("invalid offset")
+	}
+	if off >= r.size {
+		return 0, io.EOF
+	}
+	if len(buf) == 0 {
+		return 0, nil
+	}
+
+	end := off + int64(len(buf))
+	if end > r.size {
+		end = r.size
+	}
+	cs := r.chunkSize
+	first, last := off/cs, (end-1)/cs
+	chunks, err := r.fetch(first, last, off-first*cs, end-last*cs)
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for _, c := range chunks {
+		n += copy(buf[n:], c)
+	}
+	if n < len(buf) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// fetch gets chunks from the Source, and checks they are all there in
+// full.
+func (r *Reader) fetch(first, last, start, end int64) ([][]byte, error) {
+	chunks, err := r.src.Fetch(first, last, start, end)
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(chunks)) != last-first+1 {
+		return nil, fmt.Errorf("%s changed while being read", r.name)
+	}
+	for i, c := range chunks {
+		want := r.chunkSize
+		if i == len(chunks)-1 {
+			want = end
+		}
+		if i == 0 {
+			want -= start
+		}
+		if int64(len(c)) != want {
+			return nil, fmt.Errorf("%s changed while being read", r.name)
+		}
+	}
+	return chunks, nil
+}
+
+func (r *Reader) Close() error {
+	r.closed = true
+	r.chunk = nil
+	return nil
+}
+
+// Sink stores the chunks of one file's content as a Writer fills them.
+type Sink interface {
+	// Put stores chunks, numbered from first.  They are reused once it
+	// returns.
+	Put(first int64, chunks [][]byte) error
+	// Commit stores the remaining chunks, numbered from first, of which
+	// there may be none, and makes the content, size bytes in all, the
+	// file's.
+	Commit(first int64, chunks [][]byte, size int64) error
+	// Discard deletes the first n chunks once Put or Commit has failed.  It
+	// is best effort, as the content was never visible.
+	Discard(n int64)
+}
+
+// Writer splits what is written into chunks of chunkSize, and stores them
+// in a Sink StageSize at a time.
+type Writer struct {
+	sink      Sink
+	chunkSize int
+	stage     int
+
+	// buf holds the chunks from seq on, and grows to stage.
+	buf  []byte
+	seq  int64
+	size int64
+
+	// err is the first error, after which the writer is unusable.
+	err    error
+	closed bool
+}
+
+// NewWriter returns a Writer storing its chunks in sink.
+func NewWriter(sink Sink, chunkSize int) *Writer {
+	stage := StageSize / chunkSize * chunkSize
+	if stage == 0 {
+		stage = chunkSize
+	}
+	return &Writer{sink: sink, chunkSize: chunkSize, stage: stage}
+}
+
+func (w *Writer) Write(data []byte) (int, error) {
+	if w.closed {
+		return 0, os.ErrClosed
+	}
+	if w.err != nil {
+		return 0, w.err
+	}
+
+	written := 0
+	for len(data) > 0 {
+		n := w.stage - len(w.buf)
+		if n > len(data) {
+			n = len(data)
+		}
+		w.buf = append(w.buf, data[:n]...)
+		data = data[n:]
+		written += n
+		w.size += int64(n)
+		if len(w.buf) == w.stage {
+			chunks := w.chunks()
+			if err := w.sink.Put(w.seq, chunks); err != nil {
+				w.err = err
+				return written, err
+			}
+			w.seq += int64(len(chunks))
+			w.buf = w.buf[:0]
+		}
+	}
+	return written, nil
+}
+
+// chunks splits buf into chunks.
+func (w *Writer) chunks() [][]byte {
+	var chunks [][]byte
+	for b := w.buf; len(b) > 0; {
+		n := w.chunkSize
+		if len(b) < n {
+			n = len(b)
+		}
+		chunks = append(chunks, b[:n])
+		b = b[n:]
+	}
+	return chunks
+}
+
+func (w *Writer) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	defer func() { w.buf = nil }()
+
+	chunks := w.chunks()
+	if w.err == nil {
+		w.err = w.sink.Commit(w.seq, chunks, w.size)
+		if w.err == nil {
+			return nil
+		}
+	}
+	w.sink.Discard(w.seq + int64(len(chunks)))
+	return w.err
+}
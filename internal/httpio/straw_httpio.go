@@ -0,0 +1,205 @@
+package httpio
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+)
+
+// DoFunc sends a request without a body, adding whatever authentication
+// the backend uses.
+type DoFunc func(method string, u *url.URL, header http.Header) (*http.Response, error)
+
+// StatusError turns a failed response into an error, mapping the status
+// codes that have an os equivalent.
+func StatusError(op, name string, resp *http.Response) error {
+	switch resp.StatusCode {
+	case http.StatusNotFound, http.StatusGone:
+		return &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return &os.PathError{Op: op, Path: name, Err: os.ErrPermission}
+	default:
+		return &os.PathError{Op: op, Path: name, Err: fmt.Errorf("unexpected http status %s", resp.Status)}
+	}
+}
+
+// Reader reads a file from the body of a GET response, and serves seeks
+// and ReadAt with range requests to the same URL.
+type Reader struct {
+	rc io.ReadCloser
+
+	do      DoFunc
+	backend string
+	name    string
+	u       *url.URL
+
+	// -1 means don't seek
+	seek int64
+
+	fi os.FileInfo
+}
+
+// NewReader returns a Reader for name that starts by reading body, the
+// response to a GET of u.  fi is returned by Stat, and backend names the
+// backend in errors.
+func NewReader(do DoFunc, backend, name string, u *url.URL, body io.ReadCloser, fi os.FileInfo) *Reader {
+	return &Reader{body, do, backend, name, u, -1, fi}
+}
+
+// Stat returns the FileInfo from the response to the initial GET, without
+// making another request.
+func (r *Reader) Stat() (os.FileInfo, error) {
+	return r.fi, nil
+}
+
+func (r *Reader) Seek(start int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+		if start < 0 {
+			return 0, errors.New("invalid seek position")
+		}
+		r.seek = start
+		return start, nil
+	default:
+		return 0, fmt.Errorf("seek %d not currently supported in %s backend", whence, r.backend)
+	}
+}
+
+// getRange requests the bytes from start to end inclusive, or to the end
+// of the file if end is negative.  Servers that ignore the Range header and
+// send the whole body have the leading bytes skipped here instead.
+func (r *Reader) getRange(start, end int64) (io.ReadCloser, error) {
+	rng := fmt.Sprintf("bytes=%d-", start)
+	if end >= 0 {
+		rng += fmt.Sprint(end)
+	}
+	resp, err := r.do(http.MethodGet, r.u, http.Header{"Range": {rng}})
+	if err != nil {
+		return nil, err
+	}
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		return resp.Body, nil
+	case http.StatusRequestedRangeNotSatisfiable:
+		resp.Body.Close()
+		return nil, io.EOF
+	case http.StatusOK:
+		if _, err := io.CopyN(ioutil.Discard, resp.Body, start); err != nil {
+			resp.Body.Close()
+			if err == io.EOF {
+				return nil, io.EOF
+			}
+			return nil, err
+		}
+		if end < 0 {
+			return resp.Body, nil
+		}
+		return struct {
+			io.Reader
+			io.Closer
+		}{io.LimitReader(resp.Body, end-start+1), resp.Body}, nil
+	default:
+		resp.Body.Close()
+		return nil, StatusError("read", r.name, resp)
+	}
+}
+
+func (r *Reader) Read(buf []byte) (int, error) {
+	if r.seek != -1 {
+		// we have a deferred seek to do before we read.
+		err := r.rc.Close()
+		if err != nil {
+			return 0, err
+		}
+		r.rc = eofRdr
+
+		rc, err := r.getRange(r.seek, -1)
+		if err != nil {
+			return 0, err
+		}
+		r.rc = rc
+		r.seek = -1
+	}
+
+	return r.rc.Read(buf)
+}
+
+func (r *Reader) Close() error {
+	return r.rc.Close()
+}
+
+func (r *Reader) ReadAt(buf []byte, start int64) (int, error) {
+	if len(buf) == 0 {
+		return 0, nil
+	}
+	rc, err := r.getRange(start, start+int64(len(buf))-1)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.ReadFull(rc, buf)
+	cerr := rc.Close()
+
+	switch err {
+	case nil:
+		return n, cerr
+	case io.ErrUnexpectedEOF:
+		return n, io.EOF
+	default:
+		return n, err
+	}
+}
+
+// Uploader streams what is written to it into the body of a single
+// request, which completes when the Uploader is closed.
+type Uploader struct {
+	errCh chan error
+	wc    io.WriteCloser
+}
+
+// NewUploader starts upload in the background, with a body that yields
+// whatever is written to the returned Uploader.
+func NewUploader(upload func(body io.Reader) error) *Uploader {
+	pr, pw := io.Pipe()
+
+	errCh := make(chan error, 1)
+
+	go func() {
+		err := upload(pr)
+		// Unblock any writer if the server gave up early.
+		pr.CloseWithError(err)
+		errCh <- err
+	}()
+
+	return &Uploader{errCh, pw}
+}
+
+func (wc *Uploader) Write(data []byte) (int, error) {
+	return wc.wc.Write(data)
+}
+
+func (wc *Uploader) Close() error {
+	err := wc.wc.Close()
+	if err != nil {
+		return err
+	}
+	return <-wc.errCh
+}
+
+var (
+	eofRdr = &eofReader{}
+)
+
+type eofReader struct{}
+
+func (r *eofReader) Read(buf []byte) (int, error) {
+	return 0, io.EOF
+}
+
+func (r *eofReader) Close() error {
+	return nil
+}
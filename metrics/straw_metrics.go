@@ -0,0 +1,353 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/uw-labs/straw"
+)
+
+var _ straw.StreamStore = &metricsStreamStore{}
+
+// The operations that are measured, as they appear in the `op` label.
+// OpCloseWriter measures closing a writer, which is when many backends
+// finish the upload.  Reads and writes are too many to count and time one
+// by one, so OpRead, which covers ReadAt too, and OpWrite only appear in
+// the errors, other than io.EOF.
+const (
+	OpStat              = "Stat"
+	OpLstat             = "Lstat"
+	OpReaddir           = "Readdir"
+	OpOpenReadCloser    = "OpenReadCloser"
+	OpCreateWriteCloser = "CreateWriteCloser"
+	OpMkdir             = "Mkdir"
+	OpRemove            = "Remove"
+	OpCloseWriter       = "CloseWriter"
+	OpRead              = "Read"
+	OpWrite             = "Write"
+)
+
+// The classes of error, as they appear in the `class` label.
+const (
+	ClassNotExist   = "not_exist"
+	ClassExist      = "exist"
+	ClassPermission = "permission"
+	ClassTimeout    = "timeout"
+	ClassCanceled   = "canceled"
+	ClassOther      = "other"
+)
+
+// Options configures the metrics of a StreamStore.
+type Options struct {
+	// Registerer is where the metrics are registered.  Required.  Any
+	// number of StreamStores can share one, as long as they have the same
+	// Namespace and Buckets.
+	Registerer prometheus.Registerer
+	// Scheme is the value of the `scheme` label, which tells apart the
+	// StreamStores sharing a Registerer.  Typically the scheme of the URL
+	// the store was opened with, such as `s3`.
+	Scheme string
+	// Namespace prefixes every metric name.  Defaults to `straw`.
+	Namespace string
+	// Buckets are the bounds, in seconds, of the latency histogram.
+	// Defaults to prometheus.DefBuckets.
+	Buckets []float64
+}
+
+// NewStreamStore returns a StreamStore that forwards everything to ss, and
+// counts and times each operation, counts its errors by class, counts the
+// bytes read and written through its readers and writers, and tracks how
+// many of those are open.  Closing the returned StreamStore closes ss.
+func NewStreamStore(ss straw.StreamStore, opts Options) (straw.StreamStore, error) {
+	if opts.Registerer == nil {
+		return nil, errors.New("no prometheus registerer given")
+	}
+	if opts.Namespace == "" {
+		opts.Namespace = "straw"
+	}
+	if opts.Buckets == nil {
+		opts.Buckets = prometheus.DefBuckets
+	}
+
+	c := &collectors{
+		operations: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: opts.Namespace,
+			Name:      "operations_total",
+			Help:      "Operations started, by scheme and operation.",
+		}, []string{"scheme", "op"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: opts.Namespace,
+			Name:      "operation_duration_seconds",
+			Help:      "Time taken by operations, by scheme and operation.",
+			Buckets:   opts.Buckets,
+		}, []string{"scheme", "op"}),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: opts.Namespace,
+			Name:      "errors_total",
+			Help:      "Operations that failed, by scheme, operation and class of error.",
+		}, []string{"scheme", "op", "class"}),
+		readBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: opts.Namespace,
+			Name:      "read_bytes_total",
+			Help:      "Bytes read through readers, by scheme.",
+		}, []string{"scheme"}),
+		writtenBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: opts.Namespace,
+			Name:      "written_bytes_total",
+			Help:      "Bytes written through writers, by scheme.",
+		}, []string{"scheme"}),
+		openReaders: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: opts.Namespace,
+			Name:      "open_readers",
+			Help:      "Readers opened but not yet closed, by scheme.",
+		}, []string{"scheme"}),
+		openWriters: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: opts.Namespace,
+			Name:      "open_writers",
+			Help:      "Writers opened but not yet closed, by scheme.",
+		}, []string{"scheme"}),
+	}
+	if err := c.register(opts.Registerer); err != nil {
+		return nil, err
+	}
+
+	return &metricsStreamStore{
+		ss:           ss,
+		c:            c,
+		scheme:       opts.Scheme,
+		readBytes:    c.readBytes.WithLabelValues(opts.Scheme),
+		writtenBytes: c.writtenBytes.WithLabelValues(opts.Scheme),
+		openReaders:  c.openReaders.WithLabelValues(opts.Scheme),
+		openWriters:  c.openWriters.WithLabelValues(opts.Scheme),
+	}, nil
+}
+
+type collectors struct {
+	operations   *prometheus.CounterVec
+	duration     *prometheus.HistogramVec
+	errors       *prometheus.CounterVec
+	readBytes    *prometheus.CounterVec
+	writtenBytes *prometheus.CounterVec
+	openReaders  *prometheus.GaugeVec
+	openWriters  *prometheus.GaugeVec
+}
+
+// register registers each collector, or switches to the one already
+// registered by an earlier StreamStore.
+func (c *collectors) register(reg prometheus.Registerer) error {
+	var err error
+	if c.operations, err = register(reg, c.operations); err != nil {
+		return err
+	}
+	if c.duration, err = register(reg, c.duration); err != nil {
+		return err
+	}
+	if c.errors, err = register(reg, c.errors); err != nil {
+		return err
+	}
+	if c.readBytes, err = register(reg, c.readBytes); err != nil {
+		return err
+	}
+	if c.writtenBytes, err = register(reg, c.writtenBytes); err != nil {
+		return err
+	}
+	if c.openReaders, err = register(reg, c.openReaders); err != nil {
+		return err
+	}
+	if c.openWriters, err = register(reg, c.openWriters); err != nil {
+		return err
+	}
+	return nil
+}
+
+// register registers v, or returns the equivalent collector that is already
+// registered.
+func register[C prometheus.Collector](reg prometheus.Registerer, v C) (C, error) {
+	err := reg.Register(v)
+	if err == nil {
+		return v, nil
+	}
+	var are prometheus.AlreadyRegisteredError
+	if !errors.As(err, &are) {
+		return v, err
+	}
+	existing, ok := are.ExistingCollector.(C)
+	if !ok {
+		return v, errors.New("a different metric with the same name is already registered")
+	}
+	return existing, nil
+}
+
+// ErrorClass returns the class of err used in the `class` label.
+func ErrorClass(err error) string {
+	switch {
+	case errors.Is(err, os.ErrNotExist) || os.IsNotExist(err):
+		return ClassNotExist
+	case errors.Is(err, os.ErrExist) || os.IsExist(err):
+		return ClassExist
+	case errors.Is(err, os.ErrPermission) || os.IsPermission(err):
+		return ClassPermission
+	case errors.Is(err, context.DeadlineExceeded) || os.IsTimeout(err):
+		return ClassTimeout
+	case errors.Is(err, context.Canceled):
+		return ClassCanceled
+	default:
+		return ClassOther
+	}
+}
+
+type metricsStreamStore struct {
+	ss     straw.StreamStore
+	c      *collectors
+	scheme string
+
+	readBytes    prometheus.Counter
+	writtenBytes prometheus.Counter
+	openReaders  prometheus.Gauge
+	openWriters  prometheus.Gauge
+}
+
+// observe records an operation that began at start.
+func (fs *metricsStreamStore) observe(op string, start time.Time, err error) {
+	fs.c.operations.WithLabelValues(fs.scheme, op).Inc()
+	fs.c.duration.WithLabelValues(fs.scheme, op).Observe(time.Since(start).Seconds())
+	if err != nil {
+		fs.c.errors.WithLabelValues(fs.scheme, op, ErrorClass(err)).Inc()
+	}
+}
+
+// fail counts err, if it is an error, against op without counting op
+// itself.
+func (fs *metricsStreamStore) fail(op string, err error) {
+	if err != nil && err != io.EOF {
+		fs.c.errors.WithLabelValues(fs.scheme, op, ErrorClass(err)).Inc()
+	}
+}
+
+func (fs *metricsStreamStore) Close() error {
+	return fs.ss.Close()
+}
+
+func (fs *metricsStreamStore) Lstat(name string) (os.FileInfo, error) {
+	start := time.Now()
+	fi, err := fs.ss.Lstat(name)
+	fs.observe(OpLstat, start, err)
+	return fi, err
+}
+
+func (fs *metricsStreamStore) Stat(name string) (os.FileInfo, error) {
+	start := time.Now()
+	fi, err := fs.ss.Stat(name)
+	fs.observe(OpStat, start, err)
+	return fi, err
+}
+
+func (fs *metricsStreamStore) Readdir(name string) ([]os.FileInfo, error) {
+	start := time.Now()
+	fis, err := fs.ss.Readdir(name)
+	fs.observe(OpReaddir, start, err)
+	return fis, err
+}
+
+func (fs *metricsStreamStore) Mkdir(name string, mode os.FileMode) error {
+	start := time.Now()
+	err := fs.ss.Mkdir(name, mode)
+	fs.observe(OpMkdir, start, err)
+	return err
+}
+
+func (fs *metricsStreamStore) Remove(name string) error {
+	start := time.Now()
+	err := fs.ss.Remove(name)
+	fs.observe(OpRemove, start, err)
+	return err
+}
+
+func (fs *metricsStreamStore) OpenReadCloser(name string) (straw.StrawReader, error) {
+	start := time.Now()
+	r, err := fs.ss.OpenReadCloser(name)
+	fs.observe(OpOpenReadCloser, start, err)
+	if err != nil {
+		return nil, err
+	}
+	fs.openReaders.Inc()
+	rd := &reader{StrawReader: r, fs: fs}
+	if _, ok := r.(straw.Statter); ok {
+		return &statReader{rd}, nil
+	}
+	return rd, nil
+}
+
+func (fs *metricsStreamStore) CreateWriteCloser(name string) (straw.StrawWriter, error) {
+	start := time.Now()
+	w, err := fs.ss.CreateWriteCloser(name)
+	fs.observe(OpCreateWriteCloser, start, err)
+	if err != nil {
+		return nil, err
+	}
+	fs.openWriters.Inc()
+	return &writer{StrawWriter: w, fs: fs}, nil
+}
+
+type reader struct {
+	straw.StrawReader
+	fs   *metricsStreamStore
+	once sync.Once
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	n, err := r.StrawReader.Read(p)
+	r.fs.readBytes.Add(float64(n))
+	r.fs.fail(OpRead, err)
+	return n, err
+}
+
+func (r *reader) ReadAt(p []byte, off int64) (int, error) {
+	n, err := r.StrawReader.ReadAt(p, off)
+	r.fs.readBytes.Add(float64(n))
+	r.fs.fail(OpRead, err)
+	return n, err
+}
+
+func (r *reader) Close() error {
+	r.once.Do(r.fs.openReaders.Dec)
+	return r.StrawReader.Close()
+}
+
+// statReader is a reader over one that exposes its FileInfo, which it
+// passes on.
+type statReader struct {
+	*reader
+}
+
+func (r *statReader) Stat() (os.FileInfo, error) {
+	return r.StrawReader.(straw.Statter).Stat()
+}
+
+type writer struct {
+	straw.StrawWriter
+	fs   *metricsStreamStore
+	once sync.Once
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	n, err := w.StrawWriter.Write(p)
+	w.fs.writtenBytes.Add(float64(n))
+	w.fs.fail(OpWrite, err)
+	return n, err
+}
+
+func (w *writer) Close() error {
+	start := time.Now()
+	err := w.StrawWriter.Close()
+	w.once.Do(func() {
+		w.fs.observe(OpCloseWriter, start, err)
+		w.fs.openWriters.Dec()
+	})
+	return err
+}
@@ -0,0 +1,293 @@
+package middleware
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/uw-labs/straw"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var _ straw.StreamStore = &middlewareStreamStore{}
+
+// InstrumentationName is the name of the tracer the spans come from.
+const InstrumentationName = "github.com/uw-labs/straw/middleware"
+
+// The attributes set on spans.  Log records carry the same values, keyed
+// without the `straw.` prefix.
+const (
+	PathKey         = attribute.Key("straw.path")
+	BytesReadKey    = attribute.Key("straw.bytes_read")
+	BytesWrittenKey = attribute.Key("straw.bytes_written")
+	EntriesKey      = attribute.Key("straw.entries")
+)
+
+// Options configures the logging and tracing of a StreamStore.
+type Options struct {
+	// Logger receives a record for every operation.  If nil, nothing is
+	// logged.
+	Logger *slog.Logger
+	// Level is the level of the records for operations that succeed.
+	// Those for failures are logged at slog.LevelWarn, or Level if that is
+	// higher.
+	Level slog.Level
+	// TracerProvider creates the spans.  Defaults to the global provider
+	// from otel.GetTracerProvider.
+	TracerProvider trace.TracerProvider
+}
+
+// NewStreamStore returns a StreamStore that forwards everything to ss, and
+// logs and traces each operation with the path it was given, how long it
+// took and any error.  The spans of OpenReadCloser and CreateWriteCloser
+// last until the reader or writer is closed, and carry the number of bytes
+// read or written through it.  As StreamStore methods take no
+// context.Context, every span is the root of its own trace.  Closing the
+// returned StreamStore closes ss.
+func NewStreamStore(ss straw.StreamStore, opts Options) straw.StreamStore {
+	tp := opts.TracerProvider
+	if tp == nil {
+		tp = otel.GetTracerProvider()
+	}
+	return &middlewareStreamStore{
+		ss:     ss,
+		logger: opts.Logger,
+		level:  opts.Level,
+		tracer: tp.Tracer(InstrumentationName),
+	}
+}
+
+type middlewareStreamStore struct {
+	ss     straw.StreamStore
+	logger *slog.Logger
+	level  slog.Level
+	tracer trace.Tracer
+}
+
+// op is an operation in progress.
+type op struct {
+	fs    *middlewareStreamStore
+	name  string
+	path  string
+	start time.Time
+	ctx   context.Context
+	span  trace.Span
+}
+
+func (fs *middlewareStreamStore) start(name, path string) *op {
+	ctx, span := fs.tracer.Start(context.Background(), "straw."+name,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(PathKey.String(path)),
+	)
+	return &op{fs: fs, name: name, path: path, start: time.Now(), ctx: ctx, span: span}
+}
+
+// end finishes the span and logs the operation, along with any extra
+// attributes.
+func (o *op) end(err error, extra ...attribute.KeyValue) {
+	duration := time.Since(o.start)
+	o.span.SetAttributes(extra...)
+	if err != nil {
+		o.span.RecordError(err)
+		o.span.SetStatus(codes.Error, err.Error())
+	}
+	o.span.End()
+
+	logger := o.fs.logger
+	if logger == nil {
+		return
+	}
+	level := o.fs.level
+	if err != nil && level < slog.LevelWarn {
+		level = slog.LevelWarn
+	}
+	if !logger.Enabled(o.ctx, level) {
+		return
+	}
+	attrs := []slog.Attr{
+		slog.String("op", o.name),
+		slog.String("path", o.path),
+		slog.Duration("duration", duration),
+	}
+	for _, kv := range extra {
+		attrs = append(attrs, slog.Any(strings.TrimPrefix(string(kv.Key), "straw."), kv.Value.AsInterface()))
+	}
+	if err != nil {
+		attrs = append(attrs, slog.String("error", err.Error()))
+	}
+	logger.LogAttrs(o.ctx, level, "straw "+o.name, attrs...)
+}
+
+func (fs *middlewareStreamStore) Close() error {
+	o := fs.start("Close", "")
+	err := fs.ss.Close()
+	o.end(err)
+	return err
+}
+
+func (fs *middlewareStreamStore) Lstat(name string) (os.FileInfo, error) {
+	o := fs.start("Lstat", name)
+	fi, err := fs.ss.Lstat(name)
+	o.end(err)
+	return fi, err
+}
+
+func (fs *middlewareStreamStore) Stat(name string) (os.FileInfo, error) {
+	o := fs.start("Stat", name)
+	fi, err := fs.ss.Stat(name)
+	o.end(err)
+	return fi, err
+}
+
+func (fs *middlewareStreamStore) Readdir(name string) ([]os.FileInfo, error) {
+	o := fs.start("Readdir", name)
+	fis, err := fs.ss.Readdir(name)
+	o.end(err, EntriesKey.Int(len(fis)))
+	return fis, err
+}
+
+func (fs *middlewareStreamStore) Mkdir(name string, mode os.FileMode) error {
+	o := fs.start("Mkdir", name)
+	err := fs.ss.Mkdir(name, mode)
+	o.end(err)
+	return err
+}
+
+func (fs *middlewareStreamStore) Remove(name string) error {
+	o := fs.start("Remove", name)
+	err := fs.ss.Remove(name)
+	o.end(err)
+	return err
+}
+
+func (fs *middlewareStreamStore) OpenReadCloser(name string) (straw.StrawReader, error) {
+	o := fs.start("OpenReadCloser", name)
+	r, err := fs.ss.OpenReadCloser(name)
+	if err != nil {
+		o.end(err)
+		return nil, err
+	}
+	rd := &reader{r: r, op: o}
+	if _, ok := r.(straw.Statter); ok {
+		return &statReader{rd}, nil
+	}
+	return rd, nil
+}
+
+func (fs *middlewareStreamStore) CreateWriteCloser(name string) (straw.StrawWriter, error) {
+	o := fs.start("CreateWriteCloser", name)
+	w, err := fs.ss.CreateWriteCloser(name)
+	if err != nil {
+		o.end(err)
+		return nil, err
+	}
+	return &writer{w: w, op: o}, nil
+}
+
+// reader counts the bytes read, and remembers the first error other than
+// io.EOF, for the span that ends when it is closed.
+type reader struct {
+	r     straw.StrawReader
+	op    *op
+	bytes int64
+
+	lk   sync.Mutex
+	err  error
+	once sync.Once
+}
+
+func (r *reader) fail(err error) {
+	if err == nil || err == io.EOF {
+		return
+	}
+	r.lk.Lock()
+	if r.err == nil {
+		r.err = err
+	}
+	r.lk.Unlock()
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	atomic.AddInt64(&r.bytes, int64(n))
+	r.fail(err)
+	return n, err
+}
+
+func (r *reader) ReadAt(p []byte, off int64) (int, error) {
+	n, err := r.r.ReadAt(p, off)
+	atomic.AddInt64(&r.bytes, int64(n))
+	r.fail(err)
+	return n, err
+}
+
+func (r *reader) Seek(offset int64, whence int) (int64, error) {
+	pos, err := r.r.Seek(offset, whence)
+	r.fail(err)
+	return pos, err
+}
+
+func (r *reader) Close() error {
+	err := r.r.Close()
+	r.once.Do(func() {
+		spanErr := err
+		if spanErr == nil {
+			r.lk.Lock()
+			spanErr = r.err
+			r.lk.Unlock()
+		}
+		r.op.end(spanErr, BytesReadKey.Int64(atomic.LoadInt64(&r.bytes)))
+	})
+	return err
+}
+
+// statReader is a reader over one that exposes its FileInfo, which it
+// passes on.
+type statReader struct {
+	*reader
+}
+
+func (r *statReader) Stat() (os.FileInfo, error) {
+	fi, err := r.r.(straw.Statter).Stat()
+	r.fail(err)
+	return fi, err
+}
+
+// writer counts the bytes written, and remembers the first error, for the
+// span that ends when it is closed.
+type writer struct {
+	w     straw.StrawWriter
+	op    *op
+	bytes int64
+	err   error
+	once  sync.Once
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.bytes += int64(n)
+	if w.err == nil {
+		w.err = err
+	}
+	return n, err
+}
+
+func (w *writer) Close() error {
+	err := w.w.Close()
+	w.once.Do(func() {
+		spanErr := err
+		if spanErr == nil {
+			spanErr = w.err
+		}
+		w.op.end(spanErr, BytesWrittenKey.Int64(w.bytes))
+	})
+	return err
+}
@@ -0,0 +1,64 @@
+package straw
+
+import (
+	"os"
+)
+
+var _ StreamStore = &readOnlyStreamStore{}
+
+// ReadOnlyStreamStore is the part of StreamStore that can't change
+// anything.  Code that only needs to read can accept one, so that it can't
+// write even by mistake.
+type ReadOnlyStreamStore interface {
+	Close() error
+	OpenReadCloser(name string) (StrawReader, error)
+	Lstat(path string) (os.FileInfo, error)
+	Stat(path string) (os.FileInfo, error)
+	Readdir(path string) ([]os.FileInfo, error)
+}
+
+// ReadOnly returns a StreamStore that forwards reads to ss, and fails
+// anything that would change it with a permission *os.PathError.  Only the
+// methods of ReadOnlyStreamStore are forwarded, so any optional interfaces
+// ss implements are hidden.  Closing the returned StreamStore closes ss.
+// The same wrapper is applied to any URL passed to Open with a
+// `readonly=true` query parameter.
+func ReadOnly(ss ReadOnlyStreamStore) StreamStore {
+	return &readOnlyStreamStore{ss}
+}
+
+type readOnlyStreamStore struct {
+	ss ReadOnlyStreamStore
+}
+
+func (fs *readOnlyStreamStore) Close() error {
+	return fs.ss.Close()
+}
+
+func (fs *readOnlyStreamStore) OpenReadCloser(name string) (StrawReader, error) {
+	return fs.ss.OpenReadCloser(name)
+}
+
+func (fs *readOnlyStreamStore) Lstat(name string) (os.FileInfo, error) {
+	return fs.ss.Lstat(name)
+}
+
+func (fs *readOnlyStreamStore) Stat(name string) (os.FileInfo, error) {
+	return fs.ss.Stat(name)
+}
+
+func (fs *readOnlyStreamStore) Readdir(name string) ([]os.FileInfo, error) {
+	return fs.ss.Readdir(name)
+}
+
+func (fs *readOnlyStreamStore) CreateWriteCloser(name string) (StrawWriter, error) {
+	return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrPermission}
+}
+
+func (fs *readOnlyStreamStore) Mkdir(name string, mode os.FileMode) error {
+	return &os.PathError{Op: "mkdir", Path: name, Err: os.ErrPermission}
+}
+
+func (fs *readOnlyStreamStore) Remove(name string) error {
+	return &os.PathError{Op: "remove", Path: name, Err: os.ErrPermission}
+}
@@ -0,0 +1,111 @@
+package straw_test
+
+import (
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/uw-labs/straw"
+)
+
+func checkReadOnly(t *testing.T, ss straw.StreamStore, existing string) {
+	assert := assert.New(t)
+
+	_, err := ss.CreateWriteCloser("/new")
+	assert.True(os.IsPermission(err))
+	assert.IsType(&os.PathError{}, err)
+	_, err = ss.CreateWriteCloser(existing)
+	assert.True(os.IsPermission(err))
+	assert.True(os.IsPermission(ss.Mkdir("/newdir", 0755)))
+	assert.True(os.IsPermission(ss.Remove(existing)))
+
+	_, err = ss.Stat(existing)
+	assert.NoError(err, "unchanged")
+}
+
+func TestReadOnly(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	mem, _ := straw.Open("mem://")
+	require.NoError(mem.Mkdir("/dir", 0755))
+	w, err := mem.CreateWriteCloser("/dir/file")
+	require.NoError(err)
+	require.NoError(writeAll(w, []byte("hello")))
+	require.NoError(w.Close())
+
+	ss := straw.ReadOnly(mem)
+	checkReadOnly(t, ss, "/dir/file")
+
+	fi, err := ss.Stat("/dir/file")
+	require.NoError(err)
+	assert.Equal(int64(5), fi.Size())
+	fi, err = ss.Lstat("/dir")
+	require.NoError(err)
+	assert.True(fi.IsDir())
+	fis, err := ss.Readdir("/dir")
+	require.NoError(err)
+	assert.Equal(1, len(fis))
+
+	r, err := ss.OpenReadCloser("/dir/file")
+	require.NoError(err)
+	all, err := ioutil.ReadAll(r)
+	require.NoError(err)
+	assert.Equal("hello", string(all))
+	require.NoError(r.Close())
+
+	var walked []string
+	require.NoError(straw.Walk(ss, "/", func(p string, fi os.FileInfo, err error) error {
+		walked = append(walked, p)
+		return err
+	}))
+	assert.Equal([]string{"/", "/dir", "/dir/file"}, walked)
+}
+
+func TestReadOnlyURL(t *testing.T) {
+	require := require.New(t)
+
+	dir := tempDir()
+	defer os.RemoveAll(dir)
+	require.NoError(ioutil.WriteFile(filepath.Join(dir, "file"), []byte("hello"), 0644))
+
+	ss, err := straw.Open("file://" + dir + "?readonly=true")
+	require.NoError(err)
+	checkReadOnly(t, ss, "/file")
+
+	ss, err = straw.Open("file://" + dir + "?readonly=false")
+	require.NoError(err)
+	require.NoError(ss.Mkdir("/newdir", 0755))
+
+	_, err = straw.Open("file://" + dir + "?readonly=maybe")
+	require.Error(err)
+
+	// The parameter is removed before the backend sees the URL, as the
+	// redis client rejects options it doesn't know.
+	mr := miniredis.RunT(t)
+	ss, err = straw.Open("redis://" + mr.Addr() + "/?readonly=1")
+	require.NoError(err)
+	defer ss.Close()
+	_, err = ss.Stat("/")
+	require.NoError(err)
+	require.True(os.IsPermission(ss.Mkdir("/dir", 0755)))
+}
+
+func TestReadOnlyURLQuery(t *testing.T) {
+	mem, _ := straw.Open("mem://")
+	var rawQuery string
+	straw.Register("rawquery", func(u *url.URL) (straw.StreamStore, error) {
+		rawQuery = u.RawQuery
+		return mem, nil
+	})
+
+	// The other parameters reach the backend untouched.
+	_, err := straw.Open("rawquery:///?z=1&readonly=true&a=b%2Fc&a=%7E")
+	require.NoError(t, err)
+	assert.Equal(t, "z=1&a=b%2Fc&a=%7E", rawQuery)
+}
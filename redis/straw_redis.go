@@ -0,0 +1,645 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/uw-labs/straw"
+	"github.com/uw-labs/straw/internal/chunked"
+)
+
+var _ straw.StreamStore = &redisStreamStore{}
+
+func init() {
+	open := func(u *url.URL) (straw.StreamStore, error) {
+		opts, err := optionsFromURL(u)
+		if err != nil {
+			return nil, err
+		}
+		// The remaining parameters are for the client.
+		cu := *u
+		q := cu.Query()
+		for _, p := range []string{"prefix", "ttl", "chunk_size"} {
+			q.Del(p)
+		}
+		cu.RawQuery = q.Encode()
+		clientOpts, err := redis.ParseURL(cu.String())
+		if err != nil {
+			return nil, err
+		}
+		client := redis.NewClient(clientOpts)
+		ss, err := newRedisStreamStore(client, opts)
+		if err != nil {
+			client.Close()
+			return nil, err
+		}
+		ss.closeClient = true
+		return ss, nil
+	}
+	straw.Register("redis", open)
+	straw.Register("rediss", open)
+}
+
+// DefaultChunkSize is the size above which file content is split across
+// several strings.
+const DefaultChunkSize = 1024 * 1024
+
+// stagingTTL is how long the chunks of a writer that hasn't been closed are
+// kept for, so abandoned writes are cleaned up by redis itself.
+const stagingTTL = 24 * time.Hour
+
+// maxTxRetries bounds the retries of a transaction when watched keys keep
+// being changed by other clients.
+const maxTxRetries = 10
+
+// Options configures a redis backed StreamStore.
+type Options struct {
+	// Prefix is prepended to every key.  Defaults to `straw:`.  With redis
+	// cluster, it must contain a hash tag such as `{straw}:` so that all the
+	// keys of a store can be updated in one transaction.
+	Prefix string
+	// TTL, if set, is applied to every key a write creates or updates, so
+	// files and directories expire TTL after they, or something in them,
+	// were last written.
+	TTL time.Duration
+	// ChunkSize is the largest string file content is stored in.  Bigger
+	// files are split into chunks.  Defaults to DefaultChunkSize.
+	ChunkSize int
+}
+
+// NewStreamStore returns a StreamStore keeping its files in redis.
+// Closing the returned StreamStore does not close client.
+func NewStreamStore(client redis.UniversalClient, opts Options) (straw.StreamStore, error) {
+	return newRedisStreamStore(client, opts)
+}
+
+// optionsFromURL reads the `prefix`, `ttl` and `chunk_size` query
+// parameters.  Everything else in the URL is handled by redis.ParseURL.
+func optionsFromURL(u *url.URL) (Options, error) {
+	q := u.Query()
+	opts := Options{Prefix: q.Get("prefix")}
+	if t := q.Get("ttl"); t != "" {
+		d, err := time.ParseDuration(t)
+		if err != nil {
+			return Options{}, fmt.Errorf("invalid %q query parameter: %w", "ttl", err)
+		}
+		opts.TTL = d
+	}
+	if cs := q.Get("chunk_size"); cs != "" {
+		n, err := strconv.Atoi(cs)
+		if err != nil || n <= 0 {
+			return Options{}, fmt.Errorf("invalid %q query parameter: %q", "chunk_size", cs)
+		}
+		opts.ChunkSize = n
+	}
+	return opts, nil
+}
+
+func newRedisStreamStore(client redis.UniversalClient, opts Options) (*redisStreamStore, error) {
+	if opts.Prefix == "" {
+		opts.Prefix = "straw:"
+	}
+	if opts.ChunkSize == 0 {
+		opts.ChunkSize = DefaultChunkSize
+	}
+	if opts.ChunkSize < 0 {
+		return nil, errors.New("chunk size must be positive")
+	}
+	if opts.TTL < 0 {
+		return nil, errors.New("ttl must not be negative")
+	}
+	if err := client.Ping(context.Background()).Err(); err != nil {
+		return nil, err
+	}
+	return &redisStreamStore{
+		client:    client,
+		prefix:    opts.Prefix,
+		ttl:       opts.TTL,
+		chunkSize: opts.ChunkSize,
+	}, nil
+}
+
+// redisStreamStore keeps, for each path:
+//
+//	<prefix>meta:<path>   a hash of the entry's metadata
+//	<prefix>dir:<path>    for directories, a sorted set of the names in it
+//
+// File content is stored in strings <prefix>data:<id>:<n>, where id is
+// fresh for every write and n numbers the chunks.  The root directory has
+// no metadata of its own.
+type redisStreamStore struct {
+	client    redis.UniversalClient
+	prefix    string
+	ttl       time.Duration
+	chunkSize int
+	// closeClient is set when the client was created from a URL.
+	closeClient bool
+}
+
+func (fs *redisStreamStore) Close() error {
+	if fs.closeClient {
+		return fs.client.Close()
+	}
+	return nil
+}
+
+func cleanPath(name string) string {
+	return path.Clean("/" + name)
+}
+
+func (fs *redisStreamStore) metaKey(p string) string {
+	return fs.prefix + "meta:" + p
+}
+
+func (fs *redisStreamStore) dirKey(p string) string {
+	return fs.prefix + "dir:" + p
+}
+
+func (fs *redisStreamStore) chunkKey(id int64, n int64) string {
+	return fs.prefix + "data:" + strconv.FormatInt(id, 10) + ":" + strconv.FormatInt(n, 10)
+}
+
+// chunkKeys returns the keys holding the content of a file.
+func (fs *redisStreamStore) chunkKeys(sr *redisStatResult) []string {
+	var keys []string
+	for n := int64(0); n < sr.chunks(); n++ {
+		keys = append(keys, fs.chunkKey(sr.id, n))
+	}
+	return keys
+}
+
+type redisStatResult struct {
+	name      string
+	isDir     bool
+	mode      os.FileMode
+	modTime   time.Time
+	size      int64
+	id        int64
+	chunkSize int64
+}
+
+func (sr *redisStatResult) Name() string {
+	return sr.name
+}
+
+func (sr *redisStatResult) IsDir() bool {
+	return sr.isDir
+}
+
+func (sr *redisStatResult) Size() int64 {
+	if sr.isDir {
+		return 4096
+	}
+	return sr.size
+}
+
+func (sr *redisStatResult) ModTime() time.Time {
+	return sr.modTime
+}
+
+func (sr *redisStatResult) Mode() os.FileMode {
+	if sr.isDir {
+		return sr.mode | os.ModeDir
+	}
+	return sr.mode
+}
+
+func (sr *redisStatResult) Sys() interface{} {
+	return nil
+}
+
+func (sr *redisStatResult) chunks() int64 {
+	if sr.isDir || sr.size == 0 {
+		return 0
+	}
+	return (sr.size + sr.chunkSize - 1) / sr.chunkSize
+}
+
+func (sr *redisStatResult) fields() []interface{} {
+	dir := "0"
+	if sr.isDir {
+		dir = "1"
+	}
+	return []interface{}{
+		"dir", dir,
+		"mode", strconv.FormatUint(uint64(sr.mode), 10),
+		"mtime", strconv.FormatInt(sr.modTime.UnixNano(), 10),
+		"size", strconv.FormatInt(sr.size, 10),
+		"id", strconv.FormatInt(sr.id, 10),
+		"chunk", strconv.FormatInt(sr.chunkSize, 10),
+	}
+}
+
+// parseMeta returns the entry described by the hash h, or nil if h is
+// empty.
+func parseMeta(name string, h map[string]string) (*redisStatResult, error) {
+	if len(h) == 0 {
+		return nil, nil
+	}
+	sr := &redisStatResult{name: name, isDir: h["dir"] == "1"}
+	mode, err := strconv.ParseUint(h["mode"], 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("bad metadata for %s: %w", name, err)
+	}
+	sr.mode = os.FileMode(mode)
+	mtime, err := strconv.ParseInt(h["mtime"], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("bad metadata for %s: %w", name, err)
+	}
+	sr.modTime = time.Unix(0, mtime)
+	if !sr.isDir {
+		for _, f := range []struct {
+			field string
+			v     *int64
+		}{{"size", &sr.size}, {"id", &sr.id}, {"chunk", &sr.chunkSize}} {
+			if *f.v, err = strconv.ParseInt(h[f.field], 10, 64); err != nil {
+				return nil, fmt.Errorf("bad metadata for %s: %w", name, err)
+			}
+		}
+	}
+	return sr, nil
+}
+
+// lookup returns the entry for p, or nil if there isn't one.
+func (fs *redisStreamStore) lookup(ctx context.Context, c redis.Cmdable, p string) (*redisStatResult, error) {
+	if p == "/" {
+		return &redisStatResult{name: "/", isDir: true, mode: 0755}, nil
+	}
+	h, err := c.HGetAll(ctx, fs.metaKey(p)).Result()
+	if err != nil {
+		return nil, err
+	}
+	return parseMeta(path.Base(p), h)
+}
+
+// checkParentDir returns an error unless the parent of p is a directory.
+func (fs *redisStreamStore) checkParentDir(ctx context.Context, c redis.Cmdable, op, p string) error {
+	d := path.Dir(p)
+	parent, err := fs.lookup(ctx, c, d)
+	if err != nil {
+		return err
+	}
+	if parent == nil {
+		return &os.PathError{Op: op, Path: d, Err: os.ErrNotExist}
+	}
+	if !parent.isDir {
+		return fmt.Errorf("%s not a directory", d)
+	}
+	return nil
+}
+
+// watch runs f with keys watched, retrying if another client changes them
+// before f's transaction commits.
+func (fs *redisStreamStore) watch(ctx context.Context, f func(tx *redis.Tx) error, keys ...string) error {
+	for i := 0; i < maxTxRetries; i++ {
+		err := fs.client.Watch(ctx, f, keys...)
+		if err != redis.TxFailedErr {
+			return err
+		}
+	}
+	return redis.TxFailedErr
+}
+
+// touch sets the expiry of key when a TTL is configured.
+func (fs *redisStreamStore) touch(ctx context.Context, pipe redis.Pipeliner, keys ...string) {
+	if fs.ttl == 0 {
+		return
+	}
+	for _, k := range keys {
+		pipe.Expire(ctx, k, fs.ttl)
+	}
+}
+
+// touchParents refreshes the expiry of every directory above p.
+func (fs *redisStreamStore) touchParents(ctx context.Context, pipe redis.Pipeliner, p string) {
+	for d := path.Dir(p); ; d = path.Dir(d) {
+		if d != "/" {
+			fs.touch(ctx, pipe, fs.metaKey(d))
+		}
+		fs.touch(ctx, pipe, fs.dirKey(d))
+		if d == "/" {
+			return
+		}
+	}
+}
+
+func (fs *redisStreamStore) Lstat(name string) (os.FileInfo, error) {
+	return fs.Stat(name)
+}
+
+func (fs *redisStreamStore) Stat(name string) (os.FileInfo, error) {
+	sr, err := fs.lookup(context.Background(), fs.client, cleanPath(name))
+	if err != nil {
+		return nil, err
+	}
+	if sr == nil {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+	}
+	return sr, nil
+}
+
+// Readdir fetches the metadata of all the names in the directory's set in a
+// single pipeline.  Names whose metadata has expired are dropped from the
+// set.
+func (fs *redisStreamStore) Readdir(name string) ([]os.FileInfo, error) {
+	ctx := context.Background()
+	p := cleanPath(name)
+	dir, err := fs.lookup(ctx, fs.client, p)
+	if err != nil {
+		return nil, err
+	}
+	if dir == nil {
+		return nil, &os.PathError{Op: "readdir", Path: name, Err: os.ErrNotExist}
+	}
+	if !dir.isDir {
+		return nil, fmt.Errorf("%s not a directory", name)
+	}
+
+	// With a score of zero throughout, the set is ordered by name.
+	names, err := fs.client.ZRange(ctx, fs.dirKey(p), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	pipe := fs.client.Pipeline()
+	cmds := make([]*redis.MapStringStringCmd, len(names))
+	for i, n := range names {
+		cmds[i] = pipe.HGetAll(ctx, fs.metaKey(path.Join(p, n)))
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+
+	var results []os.FileInfo
+	var expired []interface{}
+	for i, cmd := range cmds {
+		sr, err := parseMeta(names[i], cmd.Val())
+		if err != nil {
+			return nil, err
+		}
+		if sr == nil {
+			expired = append(expired, names[i])
+			continue
+		}
+		results = append(results, sr)
+	}
+	if len(expired) != 0 {
+		_ = fs.client.ZRem(ctx, fs.dirKey(p), expired...).Err()
+	}
+	return results, nil
+}
+
+func (fs *redisStreamStore) Mkdir(name string, mode os.FileMode) error {
+	ctx := context.Background()
+	p := cleanPath(name)
+	if p == "/" {
+		return fmt.Errorf("%s : file exists", name)
+	}
+	mk := func(tx *redis.Tx) error {
+		if err := fs.checkParentDir(ctx, tx, "mkdir", p); err != nil {
+			return err
+		}
+		existing, err := fs.lookup(ctx, tx, p)
+		if err != nil {
+			return err
+		}
+		if existing != nil {
+			return fmt.Errorf("%s : file exists", name)
+		}
+		sr := &redisStatResult{isDir: true, mode: mode.Perm(), modTime: time.Now()}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.HSet(ctx, fs.metaKey(p), sr.fields()...)
+			pipe.ZAdd(ctx, fs.dirKey(path.Dir(p)), redis.Z{Member: path.Base(p)})
+			fs.touch(ctx, pipe, fs.metaKey(p))
+			fs.touchParents(ctx, pipe, p)
+			return nil
+		})
+		return err
+	}
+	return fs.watch(ctx, mk, fs.metaKey(path.Dir(p)), fs.metaKey(p))
+}
+
+func (fs *redisStreamStore) Remove(name string) error {
+	ctx := context.Background()
+	p := cleanPath(name)
+	if p == "/" {
+		return errors.New("cannot remove root directory")
+	}
+	rm := func(tx *redis.Tx) error {
+		existing, err := fs.lookup(ctx, tx, p)
+		if err != nil {
+			return err
+		}
+		if existing == nil {
+			return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+		}
+		if existing.isDir {
+			n, err := tx.ZCard(ctx, fs.dirKey(p)).Result()
+			if err != nil {
+				return err
+			}
+			if n != 0 {
+				return fmt.Errorf("%s : directory not empty", name)
+			}
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Del(ctx, append([]string{fs.metaKey(p), fs.dirKey(p)}, fs.chunkKeys(existing)...)...)
+			pipe.ZRem(ctx, fs.dirKey(path.Dir(p)), path.Base(p))
+			return nil
+		})
+		return err
+	}
+	return fs.watch(ctx, rm, fs.metaKey(p), fs.dirKey(p))
+}
+
+// OpenReadCloser reads the content current when it is opened.  ReadAt is
+// served with GETRANGE on just the parts of the chunks it covers, and Read
+// fetches a chunk at a time.  If the file is overwritten, removed or
+// expires while it is open, later reads fail.
+func (fs *redisStreamStore) OpenReadCloser(name string) (straw.StrawReader, error) {
+	sr, err := fs.lookup(context.Background(), fs.client, cleanPath(name))
+	if err != nil {
+		return nil, err
+	}
+	if sr == nil {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	if sr.isDir {
+		return nil, fmt.Errorf("%s is a directory", name)
+	}
+	return chunked.NewReader(&redisSource{fs: fs, id: sr.id, chunkSize: sr.chunkSize}, name, sr, sr.chunkSize), nil
+}
+
+// redisSource fetches the chunks of one content id.
+type redisSource struct {
+	fs        *redisStreamStore
+	id        int64
+	chunkSize int64
+}
+
+// Fetch issues a GETRANGE for each chunk in a single pipeline.  Missing
+// chunks come back empty.
+func (s *redisSource) Fetch(first, last, start, end int64) ([][]byte, error) {
+	ctx := context.Background()
+	var cmds []*redis.StringCmd
+	pipe := s.fs.client.Pipeline()
+	for n := first; n <= last; n++ {
+		from, to := int64(0), s.chunkSize
+		if n == first {
+			from = start
+		}
+		if n == last {
+			to = end
+		}
+		// GETRANGE takes an inclusive end offset.
+		cmds = append(cmds, pipe.GetRange(ctx, s.fs.chunkKey(s.id, n), from, to-1))
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+
+	chunks := make([][]byte, len(cmds))
+	for i, cmd := range cmds {
+		chunks[i] = []byte(cmd.Val())
+	}
+	return chunks, nil
+}
+
+// CreateWriteCloser stores each chunk as it fills, under a new content id
+// that nothing refers to yet, and with an expiry in case the writer is
+// abandoned.  Close then points the file's metadata at the new content and
+// deletes the old content in a single transaction, so readers see either
+// the old file or the new one, and a new file appears only once it is
+// complete.
+func (fs *redisStreamStore) CreateWriteCloser(name string) (straw.StrawWriter, error) {
+	ctx := context.Background()
+	p := cleanPath(name)
+	if p == "/" {
+		return nil, fmt.Errorf("%s is a directory", name)
+	}
+	if err := fs.checkParentDir(ctx, fs.client, "open", p); err != nil {
+		return nil, err
+	}
+	existing, err := fs.lookup(ctx, fs.client, p)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil && existing.isDir {
+		return nil, fmt.Errorf("%s is a directory", name)
+	}
+
+	id, err := fs.client.Incr(ctx, fs.prefix+"next_id").Result()
+	if err != nil {
+		return nil, err
+	}
+	sink := &redisSink{fs: fs, name: name, p: p, id: id, chunkSize: int64(fs.chunkSize)}
+	return chunked.NewWriter(sink, fs.chunkSize), nil
+}
+
+// redisSink stores chunks under a content id, and points the file's
+// metadata at it on commit.
+type redisSink struct {
+	fs        *redisStreamStore
+	name      string
+	p         string
+	id        int64
+	chunkSize int64
+}
+
+// Put stores the chunks in a single pipeline.
+func (s *redisSink) Put(first int64, chunks [][]byte) error {
+	if len(chunks) == 0 {
+		return nil
+	}
+	ctx := context.Background()
+	_, err := s.fs.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, c := range chunks {
+			pipe.Set(ctx, s.fs.chunkKey(s.id, first+int64(i)), c, stagingTTL)
+		}
+		return nil
+	})
+	return err
+}
+
+func (s *redisSink) Commit(first int64, chunks [][]byte, size int64) error {
+	if err := s.Put(first, chunks); err != nil {
+		return err
+	}
+	sr := &redisStatResult{
+		name:      path.Base(s.p),
+		mode:      0644,
+		size:      size,
+		id:        s.id,
+		chunkSize: s.chunkSize,
+	}
+	return s.fs.watch(context.Background(), func(tx *redis.Tx) error {
+		return s.commit(tx, sr)
+	}, s.fs.metaKey(path.Dir(s.p)), s.fs.metaKey(s.p))
+}
+
+func (s *redisSink) Discard(n int64) {
+	var keys []string
+	for i := int64(0); i < n; i++ {
+		keys = append(keys, s.fs.chunkKey(s.id, i))
+	}
+	if len(keys) != 0 {
+		_ = s.fs.client.Del(context.Background(), keys...).Err()
+	}
+}
+
+func (s *redisSink) commit(tx *redis.Tx, sr *redisStatResult) error {
+	ctx := context.Background()
+	fs := s.fs
+	if err := fs.checkParentDir(ctx, tx, "open", s.p); err != nil {
+		return err
+	}
+	existing, err := fs.lookup(ctx, tx, s.p)
+	if err != nil {
+		return err
+	}
+	if existing != nil && existing.isDir {
+		return fmt.Errorf("%s is a directory", s.name)
+	}
+
+	keys := fs.chunkKeys(sr)
+	if len(keys) != 0 {
+		// Staged chunks only expire if the writer was open for a long time.
+		n, err := tx.Exists(ctx, keys...).Result()
+		if err != nil {
+			return err
+		}
+		if n != int64(len(keys)) {
+			return fmt.Errorf("content for %s expired before it was closed", s.name)
+		}
+	}
+
+	sr.modTime = time.Now()
+	_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, fs.metaKey(s.p), sr.fields()...)
+		pipe.ZAdd(ctx, fs.dirKey(path.Dir(s.p)), redis.Z{Member: sr.name})
+		for _, k := range keys {
+			if fs.ttl == 0 {
+				pipe.Persist(ctx, k)
+			}
+		}
+		fs.touch(ctx, pipe, append(keys, fs.metaKey(s.p))...)
+		fs.touchParents(ctx, pipe, s.p)
+		if existing != nil {
+			if old := fs.chunkKeys(existing); len(old) != 0 {
+				pipe.Del(ctx, old...)
+			}
+		}
+		return nil
+	})
+	return err
+}
@@ -1,14 +1,17 @@
 package s3
 
 import (
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -18,19 +21,175 @@ import (
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/uw-labs/straw"
+	"github.com/uw-labs/straw/cache"
 )
 
 var _ straw.StreamStore = &s3StreamStore{}
 
 func init() {
 	straw.Register("s3", func(u *url.URL) (straw.StreamStore, error) {
-		return news3StreamStore(u.Host, u.Query().Get("sse"))
+		opts, err := optionsFromURL(u)
+		if err != nil {
+			return nil, err
+		}
+		ss, err := news3StreamStore(u.Host, opts)
+		if err != nil {
+			return nil, err
+		}
+		// A path in the URL roots the store at that prefix in the bucket.
+		if u.Path != "" && u.Path != "/" {
+			return straw.Sub(ss, u.Path), nil
+		}
+		return ss, nil
 	})
 }
 
-func news3StreamStore(bucket string, sseType string) (*s3StreamStore, error) {
+// Options configures an s3 backed StreamStore.  The zero value uses the
+// shared AWS configuration, which is the same behaviour as an `s3://bucket/`
+// URL with no query parameters.
+type Options struct {
+	// Endpoint overrides the S3 endpoint, e.g. `http://localhost:9000` for
+	// a local MinIO, Ceph RGW or LocalStack server.
+	Endpoint string
+	// Region overrides the region from the shared AWS configuration.
+	Region string
+	// ForcePathStyle addresses buckets as `endpoint/bucket/key` rather than
+	// `bucket.endpoint/key`.  Most S3-compatible servers require this.
+	ForcePathStyle bool
+	// DisableSSL uses plain http when talking to the endpoint.
+	DisableSSL bool
+	// Profile selects a named profile from the shared AWS configuration.
+	Profile string
+	// SSE is the server side encryption applied to uploads, e.g. `AES256`
+	// or `aws:kms`.
+	SSE string
+	// SSEKMSKeyID names the KMS key used for uploads.  Setting it implies
+	// an SSE of `aws:kms` if SSE is not set.
+	SSEKMSKeyID string
+	// SSEBucketKey enables an S3 Bucket Key for KMS encrypted uploads.
+	SSEBucketKey bool
+	// SSECustomerKey is a 256 bit key used for SSE-C.  It is sent with every
+	// upload, read and head request, so objects written with one key can only
+	// be read back with the same key.
+	SSECustomerKey []byte
+	// TTLOptions sets how long the results of lookups are cached for.
+	cache.TTLOptions
+}
+
+// NewStreamStore returns a StreamStore for the given bucket.
+func NewStreamStore(bucket string, opts Options) (straw.StreamStore, error) {
+	return news3StreamStore(bucket, opts)
+}
+
+// optionsFromURL reads the `endpoint`, `region`, `force_path_style`,
+// `disable_ssl`, `profile`, `sse`, `sse_kms_key_id`, `sse_bucket_key`,
+// `metadata_ttl` and `negative_metadata_ttl` query parameters.  SSE-C keys
+// are never taken from the URL itself, instead `sse_c_key_file` or
+// `sse_c_key_env` name a file or environment variable holding the key,
+// either raw or base64 encoded.
+func optionsFromURL(u *url.URL) (Options, error) {
+	q := u.Query()
+	opts := Options{
+		Endpoint:    q.Get("endpoint"),
+		Region:      q.Get("region"),
+		Profile:     q.Get("profile"),
+		SSE:         q.Get("sse"),
+		SSEKMSKeyID: q.Get("sse_kms_key_id"),
+	}
+	var err error
+	if opts.ForcePathStyle, err = boolParam(q, "force_path_style"); err != nil {
+		return Options{}, err
+	}
+	if opts.DisableSSL, err = boolParam(q, "disable_ssl"); err != nil {
+		return Options{}, err
+	}
+	if opts.SSEBucketKey, err = boolParam(q, "sse_bucket_key"); err != nil {
+		return Options{}, err
+	}
+	if opts.TTLOptions, err = cache.TTLOptionsFromQuery(q); err != nil {
+		return Options{}, err
+	}
+
+	keyFile, keyEnv := q.Get("sse_c_key_file"), q.Get("sse_c_key_env")
+	switch {
+	case keyFile != "" && keyEnv != "":
+		return Options{}, errors.New("only one of `sse_c_key_file` and `sse_c_key_env` may be set")
+	case keyFile != "":
+		data, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			return Options{}, fmt.Errorf("failed to read SSE-C key: %w", err)
+		}
+		if opts.SSECustomerKey, err = decodeCustomerKey(data); err != nil {
+			return Options{}, err
+		}
+	case keyEnv != "":
+		data, ok := os.LookupEnv(keyEnv)
+		if !ok {
+			return Options{}, fmt.Errorf("SSE-C key environment variable %s is not set", keyEnv)
+		}
+		if opts.SSECustomerKey, err = decodeCustomerKey([]byte(data)); err != nil {
+			return Options{}, err
+		}
+	}
+	return opts, nil
+}
+
+// decodeCustomerKey accepts either a raw 32 byte key or its base64 encoding.
+func decodeCustomerKey(data []byte) ([]byte, error) {
+	if len(data) == 32 {
+		return data, nil
+	}
+	trimmed := strings.TrimSpace(string(data))
+	decoded, err := base64.StdEncoding.DecodeString(trimmed)
+	if err == nil && len(decoded) == 32 {
+		return decoded, nil
+	}
+	return nil, errors.New("SSE-C key must be 32 bytes, or 32 bytes base64 encoded")
+}
+
+func boolParam(q url.Values, name string) (bool, error) {
+	v := q.Get(name)
+	if v == "" {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("invalid %q query parameter: %w", name, err)
+	}
+	return b, nil
+}
+
+func news3StreamStore(bucket string, opts Options) (*s3StreamStore, error) {
+	if len(opts.SSECustomerKey) != 0 {
+		if len(opts.SSECustomerKey) != 32 {
+			return nil, errors.New("SSE-C key must be 32 bytes")
+		}
+		if opts.SSE != "" || opts.SSEKMSKeyID != "" {
+			return nil, errors.New("SSE-C can not be combined with other server side encryption")
+		}
+	}
+	if opts.SSEKMSKeyID != "" && opts.SSE == "" {
+		opts.SSE = s3.ServerSideEncryptionAwsKms
+	}
+
+	config := aws.Config{}
+	if opts.Endpoint != "" {
+		config.Endpoint = aws.String(opts.Endpoint)
+	}
+	if opts.Region != "" {
+		config.Region = aws.String(opts.Region)
+	}
+	if opts.ForcePathStyle {
+		config.S3ForcePathStyle = aws.Bool(true)
+	}
+	if opts.DisableSSL {
+		config.DisableSSL = aws.Bool(true)
+	}
+
 	sess, err := session.NewSessionWithOptions(
 		session.Options{
+			Config:            config,
+			Profile:           opts.Profile,
 			SharedConfigState: session.SharedConfigEnable,
 		},
 	)
@@ -41,20 +200,80 @@ func news3StreamStore(bucket string, sseType string) (*s3StreamStore, error) {
 	svc := s3.New(sess)
 
 	ss := &s3StreamStore{
-		sess:    sess,
-		s3:      svc,
-		bucket:  bucket,
-		sseType: sseType,
+		sess:         sess,
+		s3:           svc,
+		bucket:       bucket,
+		sseType:      opts.SSE,
+		sseKMSKeyID:  opts.SSEKMSKeyID,
+		sseBucketKey: opts.SSEBucketKey,
+		sseCKey:      string(opts.SSECustomerKey),
+		meta:         opts.TTLOptions.Cache(),
 	}
 
 	return ss, nil
 }
 
 type s3StreamStore struct {
-	sess    *session.Session
-	s3      *s3.S3
-	bucket  string
-	sseType string
+	sess         *session.Session
+	s3           *s3.S3
+	bucket       string
+	sseType      string
+	sseKMSKeyID  string
+	sseBucketKey bool
+	// sseCKey is the raw SSE-C key, the sdk takes care of encoding it and
+	// computing its MD5.
+	sseCKey string
+	// meta caches Stat and Readdir results, if enabled.
+	meta *cache.MetadataCache
+}
+
+// sseCAlgorithm is the only algorithm S3 supports for SSE-C.
+const sseCAlgorithm = "AES256"
+
+func (fs *s3StreamStore) applyPutSSE(input *s3.PutObjectInput) {
+	if fs.sseType != "" {
+		input.ServerSideEncryption = aws.String(fs.sseType)
+	}
+	if fs.sseKMSKeyID != "" {
+		input.SSEKMSKeyId = aws.String(fs.sseKMSKeyID)
+	}
+	if fs.sseBucketKey {
+		input.BucketKeyEnabled = aws.Bool(true)
+	}
+	if fs.sseCKey != "" {
+		input.SSECustomerAlgorithm = aws.String(sseCAlgorithm)
+		input.SSECustomerKey = aws.String(fs.sseCKey)
+	}
+}
+
+func (fs *s3StreamStore) applyUploadSSE(input *s3manager.UploadInput) {
+	if fs.sseType != "" {
+		input.ServerSideEncryption = aws.String(fs.sseType)
+	}
+	if fs.sseKMSKeyID != "" {
+		input.SSEKMSKeyId = aws.String(fs.sseKMSKeyID)
+	}
+	if fs.sseBucketKey {
+		input.BucketKeyEnabled = aws.Bool(true)
+	}
+	if fs.sseCKey != "" {
+		input.SSECustomerAlgorithm = aws.String(sseCAlgorithm)
+		input.SSECustomerKey = aws.String(fs.sseCKey)
+	}
+}
+
+func (fs *s3StreamStore) applyHeadSSE(input *s3.HeadObjectInput) {
+	if fs.sseCKey != "" {
+		input.SSECustomerAlgorithm = aws.String(sseCAlgorithm)
+		input.SSECustomerKey = aws.String(fs.sseCKey)
+	}
+}
+
+func (fs *s3StreamStore) applyGetSSE(input *s3.GetObjectInput) {
+	if fs.sseCKey != "" {
+		input.SSECustomerAlgorithm = aws.String(sseCAlgorithm)
+		input.SSECustomerKey = aws.String(fs.sseCKey)
+	}
 }
 
 func (fs *s3StreamStore) Close() error {
@@ -68,6 +287,14 @@ func (fs *s3StreamStore) Lstat(name string) (os.FileInfo, error) {
 }
 
 func (fs *s3StreamStore) Stat(name string) (os.FileInfo, error) {
+	return fs.meta.Stat(name, fs.stat)
+}
+
+// stat first tries a HeadObject for the exact key, and only if that is not
+// found falls back to listing a single key beneath `name/` to detect an
+// implicit directory.  When an object `name` and keys beneath `name/` both
+// exist, the object takes precedence and Stat reports a file.
+func (fs *s3StreamStore) stat(name string) (os.FileInfo, error) {
 	name = fs.noSlashPrefix(name)
 	name = fs.noSlashSuffix(name)
 
@@ -79,48 +306,67 @@ func (fs *s3StreamStore) Stat(name string) (os.FileInfo, error) {
 		}, nil
 	}
 
+	input := &s3.HeadObjectInput{
+		Bucket: aws.String(fs.bucket),
+		Key:    aws.String(name),
+	}
+	fs.applyHeadSSE(input)
+	out, err := fs.s3.HeadObject(input)
+	if err == nil {
+		return &s3StatResult{
+			name:    fs.lastElem(name),
+			modTime: aws.TimeValue(out.LastModified),
+			size:    aws.Int64Value(out.ContentLength),
+			etag:    aws.StringValue(out.ETag),
+		}, nil
+	}
+	if !isNotFound(err) {
+		return nil, err
+	}
+
+	return fs.statDir(name)
+}
+
+// statDir reports name as a directory if any key exists beneath `name/`,
+// which is either an explicit directory marker or an implicit directory.
+func (fs *s3StreamStore) statDir(name string) (os.FileInfo, error) {
+	prefix := name + "/"
 	input := &s3.ListObjectsV2Input{
-		Bucket:    aws.String(fs.bucket),
-		MaxKeys:   aws.Int64(2),
-		Prefix:    aws.String(name),
-		Delimiter: aws.String("/"),
+		Bucket:  aws.String(fs.bucket),
+		MaxKeys: aws.Int64(1),
+		Prefix:  aws.String(prefix),
 	}
 	out, err := fs.s3.ListObjectsV2(input)
 	if err != nil {
 		return nil, err
 	}
-
-	var matching []os.FileInfo
-
-	for _, cont := range out.Contents {
-		if *cont.Key == name {
-			matching = append(matching, &s3StatResult{
-				name:    fs.lastElem(*cont.Key),
-				modTime: *cont.LastModified,
-				size:    *cont.Size,
-			})
-		}
+	if len(out.Contents) == 0 {
+		return nil, os.ErrNotExist
 	}
 
-	for _, prefix := range out.CommonPrefixes {
-		if *prefix.Prefix == name+"/" {
-			matching = append(matching, &s3StatResult{
-				name:  fs.lastElem(name),
-				isDir: true,
-				// modTime: ??,
-				size: 4096,
-			})
-		}
+	res := &s3StatResult{
+		name:  fs.lastElem(name),
+		isDir: true,
+		size:  4096,
+	}
+	// The directory marker, if there is one, sorts before any other key
+	// with the same prefix.
+	if *out.Contents[0].Key == prefix {
+		res.modTime = aws.TimeValue(out.Contents[0].LastModified)
 	}
+	return res, nil
+}
 
-	switch len(matching) {
-	case 0:
-		return nil, os.ErrNotExist
-	case 2:
-		panic("bug?")
-	default:
-		return matching[0], nil
+// isNotFound reports whether err is a missing key.  HeadObject has no
+// response body, so only the status code is available in that case.
+func isNotFound(err error) bool {
+	if e, ok := err.(awserr.RequestFailure); ok && e.StatusCode() == http.StatusNotFound {
+		return true
 	}
+	if e, ok := err.(awserr.Error); ok {
+		return e.Code() == s3.ErrCodeNoSuchKey || e.Code() == "NotFound"
+	}
+	return false
 }
 
 type s3StatResult struct {
@@ -128,6 +374,7 @@ type s3StatResult struct {
 	isDir   bool
 	modTime time.Time
 	size    int64
+	etag    string
 }
 
 func (sr *s3StatResult) Name() string {
@@ -146,6 +393,10 @@ func (sr *s3StatResult) ModTime() time.Time {
 	return sr.modTime
 }
 
+func (sr *s3StatResult) ETag() string {
+	return sr.etag
+}
+
 func (sr *s3StatResult) Mode() os.FileMode {
 	if sr.IsDir() {
 		return os.ModeDir | 0755
@@ -157,30 +408,40 @@ func (sr *s3StatResult) Sys() interface{} {
 	return nil
 }
 
+// OpenReadCloser issues the GET for the object straight away, so size, mtime
+// and existence all come from a single request.  Only when there is no such
+// object does it list beneath `name/` to tell a directory from a missing
+// file.
 func (fs *s3StreamStore) OpenReadCloser(name string) (straw.StrawReader, error) {
-	fi, err := fs.Stat(name)
-	if err != nil {
-		return nil, err
-	}
-	if fi.IsDir() {
+	key := fs.noSlashSuffix(fs.noSlashPrefix(name))
+	if key == "" {
 		return nil, fmt.Errorf("%s is a directory", name)
 	}
 
 	input := s3.GetObjectInput{
 		Bucket: &fs.bucket,
-		Key:    aws.String(name),
+		Key:    aws.String(key),
 	}
+	fs.applyGetSSE(&input)
 
 	out, err := fs.s3.GetObject(&input)
 	if err != nil {
-		if e, ok := err.(awserr.Error); ok {
-			if e.Code() == s3.ErrCodeNoSuchKey {
-				return nil, os.ErrNotExist
-			}
+		if !isNotFound(err) {
+			return nil, err
 		}
-		return nil, err
+		if _, err := fs.statDir(key); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%s is a directory", name)
+	}
+
+	fi := &s3StatResult{
+		name:    fs.lastElem(key),
+		modTime: aws.TimeValue(out.LastModified),
+		size:    aws.Int64Value(out.ContentLength),
+		etag:    aws.StringValue(out.ETag),
 	}
-	return &s3Reader{out.Body, fs.s3, input, -1}, nil
+	return &s3Reader{out.Body, fs.s3, input, -1, fi}, nil
 }
 
 type s3Reader struct {
@@ -191,6 +452,14 @@ type s3Reader struct {
 
 	// -1 means don't seek
 	seek int64
+
+	fi os.FileInfo
+}
+
+// Stat returns the FileInfo from the response to the initial GET, without
+// making another request.
+func (r *s3Reader) Stat() (os.FileInfo, error) {
+	return r.fi, nil
 }
 
 func (r *s3Reader) Seek(start int64, whence int) (int64, error) {
@@ -240,9 +509,12 @@ func (r *s3Reader) Close() error {
 }
 
 func (r *s3Reader) ReadAt(buf []byte, start int64) (int, error) {
+	// Take a copy of the input so that concurrent ReadAt calls, and the
+	// deferred seek in Read, do not see each other's ranges.
+	input := r.input
 	end := int64(len(buf)) + start - 1
-	r.input.Range = aws.String(fmt.Sprintf("bytes=%d-%d", start, end))
-	out, err := r.s3.GetObject(&r.input)
+	input.Range = aws.String(fmt.Sprintf("bytes=%d-%d", start, end))
+	out, err := r.s3.GetObject(&input)
 	if err != nil {
 		if e, ok := err.(awserr.Error); ok {
 			if e.Code() == s3.ErrCodeNoSuchKey {
@@ -289,12 +561,10 @@ func (fs *s3StreamStore) Mkdir(name string, mode os.FileMode) error {
 		Key:         aws.String(name),
 		ContentType: aws.String("application/x-directory"),
 	}
-
-	if fs.sseType != "" {
-		input.ServerSideEncryption = aws.String(fs.sseType)
-	}
+	fs.applyPutSSE(input)
 
 	_, err := fs.s3.PutObject(input)
+	fs.meta.Created(name)
 	return err
 }
 
@@ -335,6 +605,7 @@ func (fs *s3StreamStore) Remove(name string) error {
 		Key:    aws.String(fs.fixTrailingSlash(name, fi.IsDir())),
 	}
 	_, err = fs.s3.DeleteObject(input)
+	fs.meta.Removed(name)
 	return err
 }
 
@@ -358,10 +629,7 @@ func (fs *s3StreamStore) CreateWriteCloser(name string) (straw.StrawWriter, erro
 		Key:    aws.String(name),
 		Bucket: aws.String(fs.bucket),
 	}
-
-	if fs.sseType != "" {
-		input.ServerSideEncryption = aws.String(fs.sseType)
-	}
+	fs.applyUploadSSE(input)
 
 	errCh := make(chan error, 1)
 
@@ -373,6 +641,7 @@ func (fs *s3StreamStore) CreateWriteCloser(name string) (straw.StrawWriter, erro
 	ul := &s3uploader{
 		errCh,
 		pw,
+		func() { fs.meta.Created(name) },
 	}
 	return ul, nil
 }
@@ -412,6 +681,8 @@ func (fs *s3StreamStore) lastElem(s string) string {
 type s3uploader struct {
 	errCh chan error
 	wc    io.WriteCloser
+	// done is called once the upload has finished.
+	done func()
 }
 
 func (wc *s3uploader) Write(data []byte) (int, error) {
@@ -423,10 +694,16 @@ func (wc *s3uploader) Close() error {
 	if err != nil {
 		return err
 	}
-	return <-wc.errCh
+	err = <-wc.errCh
+	wc.done()
+	return err
 }
 
 func (fs *s3StreamStore) Readdir(name string) ([]os.FileInfo, error) {
+	return fs.meta.Readdir(name, fs.readdir)
+}
+
+func (fs *s3StreamStore) readdir(name string) ([]os.FileInfo, error) {
 
 	if !strings.HasSuffix(name, "/") {
 		name = name + "/"
@@ -453,6 +730,7 @@ func (fs *s3StreamStore) Readdir(name string) ([]os.FileInfo, error) {
 					name:    strings.TrimPrefix(*content.Key, name),
 					modTime: *content.LastModified,
 					size:    *content.Size,
+					etag:    aws.StringValue(content.ETag),
 				}
 				results = append(results, result)
 			}
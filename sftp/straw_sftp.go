@@ -5,16 +5,23 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"net"
 	"net/url"
 	"os"
 	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/pkg/sftp"
 	"github.com/uw-labs/straw"
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
 )
 
 var _ straw.StreamStore = &sftpStreamStore{}
@@ -24,85 +31,328 @@ const hostKeyQueryParam = "host_key"
 
 func init() {
 	straw.Register("sftp", func(u *url.URL) (straw.StreamStore, error) {
-		return newSFTPStreamStore(u.String())
+		opts, err := optionsFromURL(u)
+		if err != nil {
+			return nil, err
+		}
+		return newSFTPStreamStore(u.Host, opts)
 	})
 }
 
-type sftpStreamStore struct {
-	sshClient  *ssh.Client
-	sftpClient *sftp.Client
+// Options configures an sftp backed StreamStore.  At least one of Password,
+// PrivateKeyFiles or UseAgent must be set.
+type Options struct {
+	User     string
+	Password string
+
+	// PrivateKeyFiles are PEM encoded private keys to authenticate with.
+	PrivateKeyFiles []string
+	// Passphrase decrypts any encrypted keys in PrivateKeyFiles.
+	Passphrase string
+	// UseAgent authenticates with the keys held by the ssh-agent listening
+	// on the socket named by the `SSH_AUTH_SOCK` environment variable.
+	UseAgent bool
+	// KeyboardInteractive answers every keyboard-interactive challenge with
+	// Password, for servers that do not allow plain password auth.
+	KeyboardInteractive bool
+
+	// HostKey is the only host key accepted.
+	HostKey ssh.PublicKey
+	// KnownHostsFiles are OpenSSH known_hosts files to verify the host key
+	// against.  If neither HostKey nor KnownHostsFiles is set, the host key
+	// is not verified at all.
+	KnownHostsFiles []string
+
+	// KeepaliveInterval is how often a keepalive request is sent.  A
+	// connection that does not answer within the interval is treated as
+	// dead.  Zero disables keepalives.
+	KeepaliveInterval time.Duration
+	// MaxRetries is how many times an idempotent operation (Stat, Lstat,
+	// Readdir, Mkdir and opening a reader) is retried on a new connection
+	// after the connection it was using is lost.  A dead connection is
+	// always replaced before the next operation, regardless of MaxRetries.
+	MaxRetries int
+	// ReconnectBackoff is the pause before each retry.
+	ReconnectBackoff time.Duration
+
+	// PoolSize is the number of ssh connections, each with its own sftp
+	// session, that operations are spread across.  Each reader and writer
+	// stays on the connection it was opened on.  Zero means one connection.
+	PoolSize int
 }
 
-func newSFTPStreamStore(urlString string) (*sftpStreamStore, error) {
-	u, err := url.Parse(urlString)
-	if err != nil {
-		return nil, err
-	}
+// Defaults used for `sftp://` URLs when the corresponding query parameter is
+// absent.
+const (
+	defaultKeepaliveInterval = 30 * time.Second
+	defaultMaxRetries        = 2
+	defaultReconnectBackoff  = 100 * time.Millisecond
+)
+
+// NewStreamStore returns a StreamStore connected to the sftp server at addr,
+// which is a `host:port` pair.
+func NewStreamStore(addr string, opts Options) (straw.StreamStore, error) {
+	return newSFTPStreamStore(addr, opts)
+}
 
-	pass, passSet := u.User.Password()
-	if u.User.Username() == "" || !passSet {
-		return nil, errors.New("username and password are required in the url")
+// optionsFromURL reads the user and password from the URL, along with the
+// `key_file` (may be repeated), `passphrase`, `agent`,
+// `keyboard_interactive`, `known_hosts` (may be repeated), `host_key`,
+// `keepalive`, `max_retries`, `reconnect_backoff` and `pool_size` query
+// parameters.
+func optionsFromURL(u *url.URL) (Options, error) {
+	q := u.Query()
+	pass, _ := u.User.Password()
+	opts := Options{
+		User:              u.User.Username(),
+		Password:          pass,
+		PrivateKeyFiles:   q["key_file"],
+		Passphrase:        q.Get("passphrase"),
+		KnownHostsFiles:   q["known_hosts"],
+		KeepaliveInterval: defaultKeepaliveInterval,
+		MaxRetries:        defaultMaxRetries,
+		ReconnectBackoff:  defaultReconnectBackoff,
 	}
 
-	hkCallback := ssh.InsecureIgnoreHostKey()
+	var err error
+	if opts.UseAgent, err = boolParam(q, "agent"); err != nil {
+		return Options{}, err
+	}
+	if opts.KeyboardInteractive, err = boolParam(q, "keyboard_interactive"); err != nil {
+		return Options{}, err
+	}
+	if err = durationParam(q, "keepalive", &opts.KeepaliveInterval); err != nil {
+		return Options{}, err
+	}
+	if err = durationParam(q, "reconnect_backoff", &opts.ReconnectBackoff); err != nil {
+		return Options{}, err
+	}
+	if v := q.Get("max_retries"); v != "" {
+		if opts.MaxRetries, err = strconv.Atoi(v); err != nil || opts.MaxRetries < 0 {
+			return Options{}, fmt.Errorf("invalid %q query parameter: %q", "max_retries", v)
+		}
+	}
+	if v := q.Get("pool_size"); v != "" {
+		if opts.PoolSize, err = strconv.Atoi(v); err != nil || opts.PoolSize < 1 {
+			return Options{}, fmt.Errorf("invalid %q query parameter: %q", "pool_size", v)
+		}
+	}
 
 	// Check for HostKey and use if found
-	hostKeyEncodedString := u.Query().Get(hostKeyQueryParam)
+	hostKeyEncodedString := q.Get(hostKeyQueryParam)
 	if len(hostKeyEncodedString) > 0 {
 		decoded, err := base64.URLEncoding.DecodeString(hostKeyEncodedString)
 		if err != nil {
-			return nil, fmt.Errorf("failed to decode %q query parameter: %w ", hostKeyQueryParam, err)
+			return Options{}, fmt.Errorf("failed to decode %q query parameter: %w ", hostKeyQueryParam, err)
 		}
 		hostKey, err := ssh.ParsePublicKey(decoded)
 		if err != nil {
-			return nil, fmt.Errorf("failed parsing key, err: %v", err)
+			return Options{}, fmt.Errorf("failed parsing key, err: %v", err)
 		}
-		hkCallback = ssh.FixedHostKey(hostKey)
+		opts.HostKey = hostKey
 	}
+	return opts, nil
+}
 
-	config := &ssh.ClientConfig{
-		User: u.User.Username(),
-		Auth: []ssh.AuthMethod{
-			ssh.Password(pass),
-		},
-		HostKeyCallback: hkCallback,
+func boolParam(q url.Values, name string) (bool, error) {
+	v := q.Get(name)
+	if v == "" {
+		return false, nil
 	}
-
-	client, err := ssh.Dial("tcp", u.Host, config)
+	b, err := strconv.ParseBool(v)
 	if err != nil {
+		return false, fmt.Errorf("invalid %q query parameter: %w", name, err)
+	}
+	return b, nil
+}
+
+// durationParam leaves *d untouched if the parameter is absent.
+func durationParam(q url.Values, name string, d *time.Duration) error {
+	v := q.Get(name)
+	if v == "" {
+		return nil
+	}
+	parsed, err := time.ParseDuration(v)
+	if err != nil || parsed < 0 {
+		return fmt.Errorf("invalid %q query parameter: %q", name, v)
+	}
+	*d = parsed
+	return nil
+}
+
+type sftpStreamStore struct {
+	pool []*connSlot
+	next uint32
+}
+
+func newSFTPStreamStore(addr string, opts Options) (*sftpStreamStore, error) {
+	size := opts.PoolSize
+	if size < 1 {
+		size = 1
+	}
+	pool := make([]*connSlot, size)
+	for i := range pool {
+		pool[i] = &connSlot{addr: addr, opts: opts}
+	}
+
+	// Connect the first slot straight away so that bad addresses and
+	// credentials are reported by Open.  The rest connect on first use.
+	if _, err := pool[0].get(); err != nil {
 		return nil, err
 	}
 
-	sclient, err := sftp.NewClient(client)
+	return &sftpStreamStore{pool: pool}, nil
+}
+
+// conns picks the next connection in the pool, round robin.
+func (s *sftpStreamStore) conns() *connSlot {
+	n := atomic.AddUint32(&s.next, 1)
+	return s.pool[int(n)%len(s.pool)]
+}
+
+// dial connects and authenticates to addr.  Any ssh-agent connection is only
+// held open for the duration of the handshake.
+func dial(addr string, opts Options) (*ssh.Client, error) {
+	if opts.User == "" {
+		return nil, errors.New("username is required in the url")
+	}
+
+	hkCallback, err := hostKeyCallback(opts)
 	if err != nil {
-		client.Close()
 		return nil, err
 	}
 
-	ss := &sftpStreamStore{client, sclient}
+	var (
+		auth    []ssh.AuthMethod
+		signers []ssh.Signer
+	)
+	for _, keyFile := range opts.PrivateKeyFiles {
+		signer, err := loadPrivateKey(keyFile, opts.Passphrase)
+		if err != nil {
+			return nil, err
+		}
+		signers = append(signers, signer)
+	}
+	if len(signers) != 0 {
+		auth = append(auth, ssh.PublicKeys(signers...))
+	}
+	if opts.UseAgent {
+		sock := os.Getenv("SSH_AUTH_SOCK")
+		if sock == "" {
+			return nil, errors.New("ssh-agent requested but SSH_AUTH_SOCK is not set")
+		}
+		conn, err := net.Dial("unix", sock)
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to ssh-agent: %w", err)
+		}
+		defer conn.Close()
+		auth = append(auth, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+	}
+	if opts.Password != "" {
+		auth = append(auth, ssh.Password(opts.Password))
+		if opts.KeyboardInteractive {
+			auth = append(auth, ssh.KeyboardInteractive(answerAll(opts.Password)))
+		}
+	}
+	if len(auth) == 0 {
+		return nil, errors.New("one of password, private key or ssh-agent authentication is required")
+	}
+
+	config := &ssh.ClientConfig{
+		User:            opts.User,
+		Auth:            auth,
+		HostKeyCallback: hkCallback,
+	}
+
+	return ssh.Dial("tcp", addr, config)
+}
+
+func hostKeyCallback(opts Options) (ssh.HostKeyCallback, error) {
+	switch {
+	case opts.HostKey != nil && len(opts.KnownHostsFiles) != 0:
+		return nil, errors.New("only one of host key and known_hosts may be set")
+	case opts.HostKey != nil:
+		return ssh.FixedHostKey(opts.HostKey), nil
+	case len(opts.KnownHostsFiles) != 0:
+		cb, err := knownhosts.New(opts.KnownHostsFiles...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load known_hosts: %w", err)
+		}
+		return cb, nil
+	default:
+		return ssh.InsecureIgnoreHostKey(), nil
+	}
+}
+
+func loadPrivateKey(keyFile string, passphrase string) (ssh.Signer, error) {
+	pemBytes, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read private key: %w", err)
+	}
+	signer, err := ssh.ParsePrivateKey(pemBytes)
+	if _, ok := err.(*ssh.PassphraseMissingError); ok && passphrase != "" {
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(pemBytes, []byte(passphrase))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse private key %s: %w", keyFile, err)
+	}
+	return signer, nil
+}
 
-	return ss, nil
+// answerAll responds to every keyboard-interactive question with the same
+// answer, which in practice is the password.
+func answerAll(answer string) ssh.KeyboardInteractiveChallenge {
+	return func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+		answers := make([]string, len(questions))
+		for i := range answers {
+			answers[i] = answer
+		}
+		return answers, nil
+	}
 }
 
 func (s *sftpStreamStore) Close() error {
-	e1 := s.sftpClient.Close()
-	e2 := s.sshClient.Close()
-	if e1 != nil {
-		return e1
+	var firstErr error
+	for _, cs := range s.pool {
+		if err := cs.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
 	}
-	return e2
+	return firstErr
 }
 
 func (s *sftpStreamStore) Lstat(filename string) (os.FileInfo, error) {
-	return s.sftpClient.Lstat(filename)
+	var fi os.FileInfo
+	err := s.conns().retry(func(c *sftpConn) (err error) {
+		fi, err = c.sftpClient.Lstat(filename)
+		return err
+	})
+	return fi, err
 }
 
 func (s *sftpStreamStore) Stat(filename string) (os.FileInfo, error) {
-	return s.sftpClient.Stat(filename)
+	var fi os.FileInfo
+	err := s.conns().retry(func(c *sftpConn) (err error) {
+		fi, err = c.sftpClient.Stat(filename)
+		return err
+	})
+	return fi, err
 }
 
 func (s *sftpStreamStore) Mkdir(path string, mode os.FileMode) error {
-	err := s.sftpClient.Mkdir(path)
+	// The connection may have been lost after the server made the
+	// directory, so a retry that finds one there has succeeded.
+	attempts := 0
+	err := s.conns().retry(func(c *sftpConn) error {
+		attempts++
+		err := c.sftpClient.Mkdir(path)
+		if err != nil && attempts > 1 {
+			if fi, serr := c.sftpClient.Stat(path); serr == nil && fi.IsDir() {
+				return nil
+			}
+		}
+		return err
+	})
 	if err != nil && strings.Contains(err.Error(), ": file exists") {
 		d, _ := filepath.Split(path)
 		return fmt.Errorf("%s file exists", d)
@@ -111,7 +361,11 @@ func (s *sftpStreamStore) Mkdir(path string, mode os.FileMode) error {
 }
 
 func (s *sftpStreamStore) OpenReadCloser(name string) (straw.StrawReader, error) {
-	sr, err := s.sftpClient.Open(name)
+	var sr *sftp.File
+	err := s.conns().retry(func(c *sftpConn) (err error) {
+		sr, err = c.sftpClient.Open(name)
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -128,7 +382,11 @@ func (s *sftpStreamStore) OpenReadCloser(name string) (straw.StrawReader, error)
 }
 
 func (s *sftpStreamStore) Remove(name string) error {
-	err := s.sftpClient.Remove(name)
+	c, err := s.conns().get()
+	if err != nil {
+		return err
+	}
+	err = c.sftpClient.Remove(name)
 	if err != nil && strings.Contains(err.Error(), ": directory not empty") {
 		return fmt.Errorf("%s directory not empty", name)
 	}
@@ -141,16 +399,27 @@ func (s *sftpStreamStore) CreateWriteCloser(name string) (straw.StrawWriter, err
 		return nil, fmt.Errorf("%s is a directory", name)
 	}
 
-	sw, err := s.sftpClient.Create(name)
-	if err != nil && strings.Contains(err.Error(), ": not a directory") {
-		d, _ := filepath.Split(name)
-		return nil, fmt.Errorf("%s not a directory", d)
+	c, err := s.conns().get()
+	if err != nil {
+		return nil, err
+	}
+	sw, err := c.sftpClient.Create(name)
+	if err != nil {
+		if strings.Contains(err.Error(), ": not a directory") {
+			d, _ := filepath.Split(name)
+			return nil, fmt.Errorf("%s not a directory", d)
+		}
+		return nil, err
 	}
 	return sw, nil
 }
 
 func (s *sftpStreamStore) Readdir(name string) ([]os.FileInfo, error) {
-	fi, err := s.sftpClient.ReadDir(name)
+	var fi []os.FileInfo
+	err := s.conns().retry(func(c *sftpConn) (err error) {
+		fi, err = c.sftpClient.ReadDir(name)
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -158,6 +427,8 @@ func (s *sftpStreamStore) Readdir(name string) ([]os.FileInfo, error) {
 	return fi, nil
 }
 
+// sftpReader serialises Read and Seek, which share the file position, but
+// ReadAt issues its own requests at explicit offsets and so needs no lock.
 type sftpReader struct {
 	lk sync.Mutex
 	f  *sftp.File
@@ -183,30 +454,9 @@ func (r *sftpReader) Seek(offset int64, whence int) (int64, error) {
 }
 
 func (r *sftpReader) ReadAt(buf []byte, offset int64) (int, error) {
-	r.lk.Lock()
-	defer r.lk.Unlock()
-	// get current offset
-	oldOffset, err := r.f.Seek(0, io.SeekCurrent)
-	if err != nil {
-		return 0, err
-	}
-	// seek to offset
-	off, err := r.f.Seek(offset, io.SeekStart)
-	if err != nil {
-		return 0, err
-	}
-	if off != offset {
-		panic("bug in offset handling")
-	}
-	j, err := io.ReadFull(r.f, buf)
+	j, err := r.f.ReadAt(buf, offset)
 	if err == io.ErrUnexpectedEOF {
 		err = io.EOF
 	}
-
-	// put the original offset back
-	if _, err := r.f.Seek(oldOffset, io.SeekStart); err != nil {
-		return j, err
-	}
-
 	return j, err
 }
@@ -0,0 +1,187 @@
+package sftp
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+var errStoreClosed = errors.New("sftp stream store is closed")
+
+// sftpConn is a single ssh connection and the sftp session running over it.
+type sftpConn struct {
+	sshClient  *ssh.Client
+	sftpClient *sftp.Client
+
+	// dead is closed once the underlying ssh connection has gone away, for
+	// whatever reason.
+	dead chan struct{}
+}
+
+func newSFTPConn(addr string, opts Options) (*sftpConn, error) {
+	client, err := dial(addr, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	sclient, err := sftp.NewClient(client)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	c := &sftpConn{
+		sshClient:  client,
+		sftpClient: sclient,
+		dead:       make(chan struct{}),
+	}
+	go func() {
+		_ = client.Wait()
+		close(c.dead)
+	}()
+	if opts.KeepaliveInterval > 0 {
+		go c.keepalive(opts.KeepaliveInterval)
+	}
+	return c, nil
+}
+
+func (c *sftpConn) isDead() bool {
+	select {
+	case <-c.dead:
+		return true
+	default:
+		return false
+	}
+}
+
+// keepalive sends an OpenSSH style keepalive request every interval, and
+// closes the connection if the server fails to reply within the interval.
+// Any reply, even a refusal, shows the server is still there.
+func (c *sftpConn) keepalive(interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-c.dead:
+			return
+		case <-t.C:
+		}
+
+		replied := make(chan error, 1)
+		go func() {
+			_, _, err := c.sshClient.SendRequest("keepalive@openssh.com", true, nil)
+			replied <- err
+		}()
+
+		select {
+		case err := <-replied:
+			if err != nil {
+				c.sshClient.Close()
+				return
+			}
+		case <-time.After(interval):
+			c.sshClient.Close()
+			return
+		case <-c.dead:
+			return
+		}
+	}
+}
+
+// lost reports whether err was caused by the connection going away, rather
+// than by the operation itself.
+func (c *sftpConn) lost(err error) bool {
+	if errors.Is(err, sftp.ErrSSHFxConnectionLost) || errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+		return true
+	}
+	return c.isDead()
+}
+
+func (c *sftpConn) Close() error {
+	e1 := c.sftpClient.Close()
+	e2 := c.sshClient.Close()
+	if e1 != nil {
+		return e1
+	}
+	return e2
+}
+
+// connSlot holds a connection that is re-established on demand after it
+// dies.
+type connSlot struct {
+	addr string
+	opts Options
+
+	lk     sync.Mutex
+	conn   *sftpConn
+	closed bool
+}
+
+// get returns the live connection, dialling a new one if the previous one
+// has died.
+func (cs *connSlot) get() (*sftpConn, error) {
+	cs.lk.Lock()
+	defer cs.lk.Unlock()
+
+	if cs.closed {
+		return nil, errStoreClosed
+	}
+	if cs.conn != nil && !cs.conn.isDead() {
+		return cs.conn, nil
+	}
+	if cs.conn != nil {
+		_ = cs.conn.Close()
+		cs.conn = nil
+	}
+
+	c, err := newSFTPConn(cs.addr, cs.opts)
+	if err != nil {
+		return nil, err
+	}
+	cs.conn = c
+	return c, nil
+}
+
+// retry runs op, and if it fails because the connection was lost, runs it
+// again on a fresh connection up to MaxRetries times.  It must only be used
+// for idempotent operations.
+func (cs *connSlot) retry(op func(*sftpConn) error) error {
+	for attempt := 0; ; attempt++ {
+		c, err := cs.get()
+		if err == nil {
+			err = op(c)
+			if err == nil || !c.lost(err) {
+				return err
+			}
+			// Make sure the next attempt does not reuse this connection,
+			// even if the ssh layer has not noticed it is gone yet.
+			c.sshClient.Close()
+		} else if err == errStoreClosed {
+			return err
+		}
+
+		if attempt >= cs.opts.MaxRetries {
+			return err
+		}
+		time.Sleep(cs.opts.ReconnectBackoff)
+	}
+}
+
+func (cs *connSlot) Close() error {
+	cs.lk.Lock()
+	defer cs.lk.Unlock()
+
+	cs.closed = true
+	if cs.conn == nil {
+		return nil
+	}
+	err := cs.conn.Close()
+	cs.conn = nil
+	return err
+}
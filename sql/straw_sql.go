@@ -0,0 +1,613 @@
+package sql
+
+import (
+	"crypto/rand"
+	stdsql "database/sql"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/uw-labs/straw"
+	"github.com/uw-labs/straw/internal/chunked"
+
+	// The drivers openURL uses by default.
+	_ "github.com/lib/pq"
+	_ "modernc.org/sqlite"
+)
+
+var _ straw.StreamStore = &sqlStreamStore{}
+
+func init() {
+	straw.Register("sqlite", func(u *url.URL) (straw.StreamStore, error) {
+		return openURL(u, DialectSQLite)
+	})
+	straw.Register("postgres", func(u *url.URL) (straw.StreamStore, error) {
+		return openURL(u, DialectPostgres)
+	})
+	straw.Register("postgresql", func(u *url.URL) (straw.StreamStore, error) {
+		return openURL(u, DialectPostgres)
+	})
+}
+
+// Dialect selects the SQL flavour spoken to the database.
+type Dialect string
+
+const (
+	DialectSQLite   Dialect = "sqlite"
+	DialectPostgres Dialect = "postgres"
+)
+
+// DefaultChunkSize is the size of the pieces file content is stored in.
+const DefaultChunkSize = 256 * 1024
+
+// Options configures an SQL backed StreamStore.
+type Options struct {
+	// Dialect must be set to match the database.
+	Dialect Dialect
+	// Table prefixes the names of the tables used, `<Table>_files` and
+	// `<Table>_chunks`.  Defaults to `straw`.
+	Table string
+	// ChunkSize is the size of the chunks new content is split into.
+	// Defaults to DefaultChunkSize.  Existing files keep the chunk size they
+	// were written with.
+	ChunkSize int
+}
+
+// NewStreamStore returns a StreamStore keeping its files in db, creating
+// the tables it needs if they don't already exist.  This package registers
+// the modernc.org/sqlite and github.com/lib/pq drivers, and any other must
+// be registered by the caller.  Closing the returned StreamStore does not
+// close db.
+func NewStreamStore(db *stdsql.DB, opts Options) (straw.StreamStore, error) {
+	return newSQLStreamStore(db, opts)
+}
+
+// openURL opens the database named by u with the driver from the `driver`
+// query parameter, which defaults to `sqlite` (modernc.org/sqlite) or
+// `postgres` (github.com/lib/pq).  The `table` and `chunk_size` parameters
+// set the matching Options, and any other parameters are passed on to the
+// driver.  For sqlite the database is the file at the URL's path, and for
+// postgres the URL itself is the connection string.
+func openURL(u *url.URL, dialect Dialect) (straw.StreamStore, error) {
+	q := u.Query()
+	opts := Options{Dialect: dialect, Table: q.Get("table")}
+	if cs := q.Get("chunk_size"); cs != "" {
+		n, err := strconv.Atoi(cs)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid %q query parameter: %q", "chunk_size", cs)
+		}
+		opts.ChunkSize = n
+	}
+	driver := q.Get("driver")
+	for _, p := range []string{"driver", "table", "chunk_size"} {
+		q.Del(p)
+	}
+
+	var dsn string
+	switch dialect {
+	case DialectSQLite:
+		if u.Host != "" || u.Path == "" {
+			return nil, errors.New("sqlite urls name a local database file, e.g. `sqlite:///path/to/straw.db`")
+		}
+		if driver == "" {
+			driver = "sqlite"
+		}
+		dsn = u.Path
+		if len(q) != 0 {
+			dsn += "?" + q.Encode()
+		}
+	case DialectPostgres:
+		if driver == "" {
+			driver = "postgres"
+		}
+		pu := *u
+		pu.Scheme = "postgres"
+		pu.RawQuery = q.Encode()
+		dsn = pu.String()
+	}
+
+	db, err := stdsql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	if dialect == DialectSQLite {
+		// SQLite allows a single writer at a time, and a single connection
+		// queues them up rather than failing with SQLITE_BUSY.
+		db.SetMaxOpenConns(1)
+	}
+	ss, err := newSQLStreamStore(db, opts)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	ss.closeDB = true
+	return ss, nil
+}
+
+var tableRE = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+func newSQLStreamStore(db *stdsql.DB, opts Options) (*sqlStreamStore, error) {
+	if opts.Table == "" {
+		opts.Table = "straw"
+	}
+	if !tableRE.MatchString(opts.Table) {
+		return nil, fmt.Errorf("invalid table name %q", opts.Table)
+	}
+	if opts.ChunkSize == 0 {
+		opts.ChunkSize = DefaultChunkSize
+	}
+	if opts.ChunkSize < 0 {
+		return nil, errors.New("chunk size must be positive")
+	}
+
+	var blobType string
+	switch opts.Dialect {
+	case DialectSQLite:
+		blobType = "BLOB"
+	case DialectPostgres:
+		blobType = "BYTEA"
+	default:
+		return nil, fmt.Errorf("unsupported sql dialect %q", opts.Dialect)
+	}
+
+	fs := &sqlStreamStore{
+		db:        db,
+		dialect:   opts.Dialect,
+		files:     opts.Table + "_files",
+		chunks:    opts.Table + "_chunks",
+		chunkSize: opts.ChunkSize,
+	}
+
+	for _, stmt := range []string{
+		`CREATE TABLE IF NOT EXISTS ` + fs.files + ` (
+			path TEXT PRIMARY KEY,
+			parent TEXT NOT NULL,
+			name TEXT NOT NULL,
+			is_dir BOOLEAN NOT NULL,
+			mode INTEGER NOT NULL,
+			mtime BIGINT NOT NULL,
+			size BIGINT NOT NULL,
+			content_id BIGINT NOT NULL,
+			chunk_size INTEGER NOT NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS ` + fs.files + `_parent ON ` + fs.files + ` (parent)`,
+		`CREATE TABLE IF NOT EXISTS ` + fs.chunks + ` (
+			content_id BIGINT NOT NULL,
+			seq BIGINT NOT NULL,
+			data ` + blobType + ` NOT NULL,
+			PRIMARY KEY (content_id, seq)
+		)`,
+	} {
+		if _, err := db.Exec(stmt); err != nil {
+			return nil, err
+		}
+	}
+	return fs, nil
+}
+
+// sqlStreamStore keeps one row per file or directory, keyed by its cleaned
+// absolute path.  File content lives in a separate table, split into
+// numbered chunks under a content id which is fresh for every write.
+type sqlStreamStore struct {
+	db        *stdsql.DB
+	dialect   Dialect
+	files     string
+	chunks    string
+	chunkSize int
+	// closeDB is set when the database was opened from a URL.
+	closeDB bool
+}
+
+// querier is satisfied by both *sql.DB and *sql.Tx.
+type querier interface {
+	Exec(query string, args ...interface{}) (stdsql.Result, error)
+	Query(query string, args ...interface{}) (*stdsql.Rows, error)
+	QueryRow(query string, args ...interface{}) *stdsql.Row
+}
+
+// q rewrites the `?` placeholders in query for the dialect.
+func (fs *sqlStreamStore) q(query string) string {
+	if fs.dialect != DialectPostgres {
+		return query
+	}
+	var sb strings.Builder
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n++
+			sb.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		sb.WriteRune(c)
+	}
+	return sb.String()
+}
+
+func (fs *sqlStreamStore) Close() error {
+	if fs.closeDB {
+		return fs.db.Close()
+	}
+	return nil
+}
+
+func cleanPath(name string) string {
+	return path.Clean("/" + name)
+}
+
+func newContentID() (int64, error) {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return 0, err
+	}
+	return int64(binary.BigEndian.Uint64(b[:]) >> 1), nil
+}
+
+type sqlStatResult struct {
+	name      string
+	isDir     bool
+	mode      os.FileMode
+	modTime   time.Time
+	size      int64
+	contentID int64
+	chunkSize int
+}
+
+func (sr *sqlStatResult) Name() string {
+	return sr.name
+}
+
+func (sr *sqlStatResult) IsDir() bool {
+	return sr.isDir
+}
+
+func (sr *sqlStatResult) Size() int64 {
+	if sr.isDir {
+		return 4096
+	}
+	return sr.size
+}
+
+func (sr *sqlStatResult) ModTime() time.Time {
+	return sr.modTime
+}
+
+func (sr *sqlStatResult) Mode() os.FileMode {
+	if sr.isDir {
+		return sr.mode | os.ModeDir
+	}
+	return sr.mode
+}
+
+func (sr *sqlStatResult) Sys() interface{} {
+	return nil
+}
+
+var rootStat = &sqlStatResult{name: "/", isDir: true, mode: 0755}
+
+// lookup returns the row for p, or nil if there isn't one.
+func (fs *sqlStreamStore) lookup(db querier, p string) (*sqlStatResult, error) {
+	if p == "/" {
+		return rootStat, nil
+	}
+	sr := &sqlStatResult{}
+	var mode uint32
+	var mtime int64
+	err := db.QueryRow(
+		fs.q(`SELECT name, is_dir, mode, mtime, size, content_id, chunk_size FROM `+fs.files+` WHERE path = ?`), p,
+	).Scan(&sr.name, &sr.isDir, &mode, &mtime, &sr.size, &sr.contentID, &sr.chunkSize)
+	if err == stdsql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	sr.mode = os.FileMode(mode)
+	sr.modTime = time.Unix(0, mtime)
+	return sr, nil
+}
+
+func (fs *sqlStreamStore) Lstat(name string) (os.FileInfo, error) {
+	return fs.Stat(name)
+}
+
+func (fs *sqlStreamStore) Stat(name string) (os.FileInfo, error) {
+	sr, err := fs.lookup(fs.db, cleanPath(name))
+	if err != nil {
+		return nil, err
+	}
+	if sr == nil {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+	}
+	return sr, nil
+}
+
+func (fs *sqlStreamStore) Readdir(name string) ([]os.FileInfo, error) {
+	p := cleanPath(name)
+	dir, err := fs.lookup(fs.db, p)
+	if err != nil {
+		return nil, err
+	}
+	if dir == nil {
+		return nil, &os.PathError{Op: "readdir", Path: name, Err: os.ErrNotExist}
+	}
+	if !dir.isDir {
+		return nil, fmt.Errorf("%s not a directory", name)
+	}
+
+	rows, err := fs.db.Query(
+		fs.q(`SELECT name, is_dir, mode, mtime, size, content_id, chunk_size FROM `+fs.files+` WHERE parent = ?`), p,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var results []os.FileInfo
+	for rows.Next() {
+		sr := &sqlStatResult{}
+		var mode uint32
+		var mtime int64
+		if err := rows.Scan(&sr.name, &sr.isDir, &mode, &mtime, &sr.size, &sr.contentID, &sr.chunkSize); err != nil {
+			return nil, err
+		}
+		sr.mode = os.FileMode(mode)
+		sr.modTime = time.Unix(0, mtime)
+		results = append(results, sr)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].Name() < results[j].Name() })
+	return results, nil
+}
+
+// checkParentDir returns an error unless the parent of p is a directory.
+func (fs *sqlStreamStore) checkParentDir(db querier, op, p string) error {
+	d := path.Dir(p)
+	parent, err := fs.lookup(db, d)
+	if err != nil {
+		return err
+	}
+	if parent == nil {
+		return &os.PathError{Op: op, Path: d, Err: os.ErrNotExist}
+	}
+	if !parent.isDir {
+		return fmt.Errorf("%s not a directory", d)
+	}
+	return nil
+}
+
+// inTx runs f in a transaction, committing if it succeeds.
+func (fs *sqlStreamStore) inTx(f func(tx *stdsql.Tx) error) error {
+	tx, err := fs.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := f(tx); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (fs *sqlStreamStore) Mkdir(name string, mode os.FileMode) error {
+	p := cleanPath(name)
+	if p == "/" {
+		return fmt.Errorf("%s : file exists", name)
+	}
+	return fs.inTx(func(tx *stdsql.Tx) error {
+		if err := fs.checkParentDir(tx, "mkdir", p); err != nil {
+			return err
+		}
+		existing, err := fs.lookup(tx, p)
+		if err != nil {
+			return err
+		}
+		if existing != nil {
+			return fmt.Errorf("%s : file exists", name)
+		}
+		_, err = tx.Exec(
+			fs.q(`INSERT INTO `+fs.files+` (path, parent, name, is_dir, mode, mtime, size, content_id, chunk_size) VALUES (?, ?, ?, ?, ?, ?, 0, 0, 0)`),
+			p, path.Dir(p), path.Base(p), true, uint32(mode.Perm()), time.Now().UnixNano(),
+		)
+		return err
+	})
+}
+
+func (fs *sqlStreamStore) Remove(name string) error {
+	p := cleanPath(name)
+	if p == "/" {
+		return errors.New("cannot remove root directory")
+	}
+	return fs.inTx(func(tx *stdsql.Tx) error {
+		existing, err := fs.lookup(tx, p)
+		if err != nil {
+			return err
+		}
+		if existing == nil {
+			return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+		}
+		if existing.isDir {
+			var one int
+			err := tx.QueryRow(fs.q(`SELECT 1 FROM `+fs.files+` WHERE parent = ? LIMIT 1`), p).Scan(&one)
+			switch err {
+			case nil:
+				return fmt.Errorf("%s : directory not empty", name)
+			case stdsql.ErrNoRows:
+			default:
+				return err
+			}
+		}
+		if _, err := tx.Exec(fs.q(`DELETE FROM `+fs.files+` WHERE path = ?`), p); err != nil {
+			return err
+		}
+		if !existing.isDir {
+			if _, err := tx.Exec(fs.q(`DELETE FROM `+fs.chunks+` WHERE content_id = ?`), existing.contentID); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// OpenReadCloser reads the content current when it is opened.  Chunks are
+// fetched as they are needed, so seeking and ReadAt never load more of the
+// file than they return.  If the file is overwritten or removed while it is
+// open, reads of chunks not already fetched fail.
+func (fs *sqlStreamStore) OpenReadCloser(name string) (straw.StrawReader, error) {
+	sr, err := fs.lookup(fs.db, cleanPath(name))
+	if err != nil {
+		return nil, err
+	}
+	if sr == nil {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	if sr.isDir {
+		return nil, fmt.Errorf("%s is a directory", name)
+	}
+	return chunked.NewReader(&sqlSource{fs: fs, contentID: sr.contentID}, name, sr, int64(sr.chunkSize)), nil
+}
+
+// sqlSource fetches the chunks of one content id.
+type sqlSource struct {
+	fs        *sqlStreamStore
+	contentID int64
+}
+
+func (s *sqlSource) Fetch(first, last, start, end int64) ([][]byte, error) {
+	rows, err := s.fs.db.Query(
+		s.fs.q(`SELECT seq, data FROM `+s.fs.chunks+` WHERE content_id = ? AND seq >= ? AND seq <= ? ORDER BY seq`),
+		s.contentID, first, last,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	chunks := make([][]byte, 0, last-first+1)
+	for rows.Next() {
+		var seq int64
+		var data []byte
+		if err := rows.Scan(&seq, &data); err != nil {
+			return nil, err
+		}
+		if seq != first+int64(len(chunks)) {
+			break
+		}
+		chunks = append(chunks, data)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return chunked.Trim(chunks, first, last, start, end), nil
+}
+
+// CreateWriteCloser stores chunks as they fill, under a new content id that
+// nothing refers to yet.  Close then points the file's row at the new
+// content and drops the old content in a single transaction, so readers
+// see either the old file or the new one, and a new file appears only once
+// it is complete.  Content written by a writer that is never closed is left
+// behind unreferenced.
+func (fs *sqlStreamStore) CreateWriteCloser(name string) (straw.StrawWriter, error) {
+	p := cleanPath(name)
+	if p == "/" {
+		return nil, fmt.Errorf("%s is a directory", name)
+	}
+	if err := fs.checkParentDir(fs.db, "open", p); err != nil {
+		return nil, err
+	}
+	existing, err := fs.lookup(fs.db, p)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil && existing.isDir {
+		return nil, fmt.Errorf("%s is a directory", name)
+	}
+
+	id, err := newContentID()
+	if err != nil {
+		return nil, err
+	}
+	sink := &sqlSink{fs: fs, name: name, p: p, contentID: id, chunkSize: fs.chunkSize}
+	return chunked.NewWriter(sink, fs.chunkSize), nil
+}
+
+// sqlSink stores chunks under a content id, and points the file at it on
+// commit.
+type sqlSink struct {
+	fs        *sqlStreamStore
+	name      string
+	p         string
+	contentID int64
+	chunkSize int
+}
+
+// Put stores the chunks in one transaction, so that SQLite syncs once for
+// them rather than once per chunk.
+func (s *sqlSink) Put(first int64, chunks [][]byte) error {
+	return s.fs.inTx(func(tx *stdsql.Tx) error {
+		return s.insert(tx, first, chunks)
+	})
+}
+
+func (s *sqlSink) insert(tx *stdsql.Tx, first int64, chunks [][]byte) error {
+	for i, c := range chunks {
+		_, err := tx.Exec(
+			s.fs.q(`INSERT INTO `+s.fs.chunks+` (content_id, seq, data) VALUES (?, ?, ?)`),
+			s.contentID, first+int64(i), c,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *sqlSink) Commit(first int64, chunks [][]byte, size int64) error {
+	fs := s.fs
+	return fs.inTx(func(tx *stdsql.Tx) error {
+		if err := s.insert(tx, first, chunks); err != nil {
+			return err
+		}
+		if err := fs.checkParentDir(tx, "open", s.p); err != nil {
+			return err
+		}
+		existing, err := fs.lookup(tx, s.p)
+		if err != nil {
+			return err
+		}
+		mtime := time.Now().UnixNano()
+
+		if existing == nil {
+			_, err = tx.Exec(
+				fs.q(`INSERT INTO `+fs.files+` (path, parent, name, is_dir, mode, mtime, size, content_id, chunk_size) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`),
+				s.p, path.Dir(s.p), path.Base(s.p), false, uint32(0644), mtime, size, s.contentID, s.chunkSize,
+			)
+			return err
+		}
+		if existing.isDir {
+			return fmt.Errorf("%s is a directory", s.name)
+		}
+		_, err = tx.Exec(
+			fs.q(`UPDATE `+fs.files+` SET mtime = ?, size = ?, content_id = ?, chunk_size = ? WHERE path = ?`),
+			mtime, size, s.contentID, s.chunkSize, s.p,
+		)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(fs.q(`DELETE FROM `+fs.chunks+` WHERE content_id = ?`), existing.contentID)
+		return err
+	})
+}
+
+func (s *sqlSink) Discard(n int64) {
+	_, _ = s.fs.db.Exec(s.fs.q(`DELETE FROM `+s.fs.chunks+` WHERE content_id = ?`), s.contentID)
+}
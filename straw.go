@@ -29,6 +29,22 @@ type StreamStore interface {
 	Remove(path string) error
 }
 
+// ETagger is implemented by the FileInfos of backends that know a version
+// identifier for a file's content, such as an HTTP ETag.  The value changes
+// whenever the content does, so it can be used to validate cached copies.
+// An empty ETag means none is known.
+type ETagger interface {
+	ETag() string
+}
+
+// Statter is implemented by the StrawReaders of backends that can return
+// the FileInfo of the file as it was opened, which may differ from what
+// Stat on the StreamStore now returns.  Wrappers pass it on when the reader
+// they wrap implements it.
+type Statter interface {
+	Stat() (os.FileInfo, error)
+}
+
 func MkdirAll(ss StreamStore, path string, perm os.FileMode) error {
 	// Fast path: if we can tell whether path is a directory or file, stop with success or error.
 	dir, err := ss.Stat(path)
@@ -36,7 +52,7 @@ func MkdirAll(ss StreamStore, path string, perm os.FileMode) error {
 		if dir.IsDir() {
 			return nil
 		}
-		return &os.PathError{"mkdir", path, syscall.ENOTDIR}
+		return &os.PathError{Op: "mkdir", Path: path, Err: syscall.ENOTDIR}
 	}
 
 	// Slow path: make sure parent exists and then call Mkdir for path.
@@ -0,0 +1,112 @@
+package straw_test
+
+import (
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/uw-labs/straw"
+	strawbolt "github.com/uw-labs/straw/bolt"
+	"go.etcd.io/bbolt"
+)
+
+func boltTestPath(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "straw_bolt_test")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return filepath.Join(dir, "straw.db")
+}
+
+func TestBoltPersistence(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	name := boltTestPath(t)
+
+	ss, err := straw.Open("bolt://" + name)
+	require.NoError(err)
+	require.NoError(ss.Mkdir("/dir", 0700))
+	w, err := ss.CreateWriteCloser("/dir/file")
+	require.NoError(err)
+	require.NoError(writeAll(w, []byte("hello")))
+	require.NoError(w.Close())
+
+	// Never closed, so its content is discarded when the store is reopened.
+	w, err = ss.CreateWriteCloser("/dir/abandoned")
+	require.NoError(err)
+	require.NoError(writeAll(w, make([]byte, 3*strawbolt.DefaultPageSize)))
+	require.NoError(ss.Close())
+
+	ss, err = straw.Open("bolt://" + name)
+	require.NoError(err)
+
+	fi, err := ss.Stat("/dir")
+	require.NoError(err)
+	assert.True(fi.IsDir())
+	assert.Equal(os.ModeDir|0700, fi.Mode())
+
+	fis, err := ss.Readdir("/dir")
+	require.NoError(err)
+	require.Equal(1, len(fis))
+	assert.Equal("file", fis[0].Name())
+	assert.Equal(int64(5), fis[0].Size())
+	require.NoError(ss.Close())
+
+	db, err := bbolt.Open(name, 0600, nil)
+	require.NoError(err)
+	defer db.Close()
+	require.NoError(db.View(func(tx *bbolt.Tx) error {
+		assert.Equal(1, tx.Bucket([]byte("straw")).Bucket([]byte("content")).Stats().BucketN-1)
+		return nil
+	}))
+}
+
+func TestBoltSharedBucket(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	db, err := bbolt.Open(boltTestPath(t), 0600, nil)
+	require.NoError(err)
+	defer db.Close()
+
+	ss, err := strawbolt.NewStreamStore(db, strawbolt.Options{})
+	require.NoError(err)
+	defer ss.Close()
+	w, err := ss.CreateWriteCloser("/file")
+	require.NoError(err)
+	data := make([]byte, 3*strawbolt.DefaultPageSize)
+	_, err = rand.Read(data)
+	require.NoError(err)
+	require.NoError(writeAll(w, data))
+
+	// Another store opening on the bucket leaves the open writer's content
+	// alone.
+	other, err := strawbolt.NewStreamStore(db, strawbolt.Options{})
+	require.NoError(err)
+	defer other.Close()
+	require.NoError(w.Close())
+
+	r, err := other.OpenReadCloser("/file")
+	require.NoError(err)
+	all, err := ioutil.ReadAll(r)
+	require.NoError(err)
+	assert.Equal(data, all)
+	require.NoError(r.Close())
+}
+
+func TestBoltLocked(t *testing.T) {
+	require := require.New(t)
+
+	name := boltTestPath(t)
+	ss, err := straw.Open("bolt://" + name)
+	require.NoError(err)
+	defer ss.Close()
+
+	// bbolt holds an exclusive lock on the file while it is open.
+	_, err = straw.Open("bolt://" + name + "?timeout=100ms")
+	require.Error(err)
+}
@@ -0,0 +1,374 @@
+package straw_test
+
+import (
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/uw-labs/straw"
+	strawcache "github.com/uw-labs/straw/cache"
+)
+
+// countingStreamStore counts the files opened for reading, and the bytes
+// read from them.
+type countingStreamStore struct {
+	straw.StreamStore
+	opens int64
+	bytes int64
+}
+
+func (fs *countingStreamStore) OpenReadCloser(name string) (straw.StrawReader, error) {
+	r, err := fs.StreamStore.OpenReadCloser(name)
+	if err != nil {
+		return nil, err
+	}
+	atomic.AddInt64(&fs.opens, 1)
+	return &countingReader{r, fs}, nil
+}
+
+type countingReader struct {
+	straw.StrawReader
+	fs *countingStreamStore
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.StrawReader.Read(p)
+	atomic.AddInt64(&r.fs.bytes, int64(n))
+	return n, err
+}
+
+func (r *countingReader) ReadAt(p []byte, off int64) (int, error) {
+	n, err := r.StrawReader.ReadAt(p, off)
+	atomic.AddInt64(&r.fs.bytes, int64(n))
+	return n, err
+}
+
+// etagStreamStore reports the ETags in etags for the files it Stats.
+type etagStreamStore struct {
+	straw.StreamStore
+	etags map[string]string
+}
+
+type etagFileInfo struct {
+	os.FileInfo
+	etag string
+}
+
+func (fi *etagFileInfo) ETag() string {
+	return fi.etag
+}
+
+func (fs *etagStreamStore) Stat(name string) (os.FileInfo, error) {
+	fi, err := fs.StreamStore.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	return &etagFileInfo{fi, fs.etags[name]}, nil
+}
+
+func writeStoreFile(t *testing.T, ss straw.StreamStore, name string, data []byte) {
+	w, err := ss.CreateWriteCloser(name)
+	require.NoError(t, err)
+	require.NoError(t, writeAll(w, data))
+	require.NoError(t, w.Close())
+}
+
+func readStoreFile(t *testing.T, ss straw.StreamStore, name string) []byte {
+	r, err := ss.OpenReadCloser(name)
+	require.NoError(t, err)
+	defer r.Close()
+	all, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	return all
+}
+
+func cacheEntries(t *testing.T, cache straw.StreamStore) (int, int64) {
+	fis, err := cache.Readdir("/")
+	require.NoError(t, err)
+	var size int64
+	for _, fi := range fis {
+		size += fi.Size()
+	}
+	return len(fis), size
+}
+
+func TestCacheFS(t *testing.T) {
+	for name, opts := range map[string]strawcache.Options{
+		"cachefs":      {},
+		"cacheblockfs": {BlockSize: 3},
+	} {
+		testFS(t, name, func() straw.StreamStore {
+			origin, _ := straw.Open("mem://")
+			cache, _ := straw.Open("mem://")
+			ss, err := strawcache.NewStreamStore(origin, cache, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return &TestLogStreamStore{t, ss}
+		}, "/")
+	}
+}
+
+func TestCacheHits(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	mem, _ := straw.Open("mem://")
+	origin := &countingStreamStore{StreamStore: mem}
+	cache, _ := straw.Open("mem://")
+	ss, err := strawcache.NewStreamStore(origin, cache, strawcache.Options{})
+	require.NoError(err)
+
+	writeStoreFile(t, mem, "/file", []byte("hello world"))
+
+	assert.Equal("hello world", string(readStoreFile(t, ss, "/file")))
+	assert.Equal(int64(1), origin.opens)
+	assert.Equal("hello world", string(readStoreFile(t, ss, "/file")))
+	assert.Equal(int64(1), origin.opens)
+
+	// A hit is as seekable as any other reader.
+	r, err := ss.OpenReadCloser("/file")
+	require.NoError(err)
+	defer r.Close()
+	buf := make([]byte, 5)
+	n, err := r.ReadAt(buf, 6)
+	require.NoError(err)
+	assert.Equal("world", string(buf[:n]))
+	_, err = r.Seek(-5, io.SeekEnd)
+	require.NoError(err)
+	all, err := ioutil.ReadAll(r)
+	require.NoError(err)
+	assert.Equal("world", string(all))
+	fi, err := r.(straw.Statter).Stat()
+	require.NoError(err)
+	assert.Equal("file", fi.Name())
+	assert.Equal(int64(1), origin.opens)
+
+	// Changed behind the cache's back.
+	writeStoreFile(t, mem, "/file", []byte("goodbye"))
+	assert.Equal("goodbye", string(readStoreFile(t, ss, "/file")))
+	assert.Equal(int64(2), origin.opens)
+
+	_, err = ss.OpenReadCloser("/missing")
+	assert.True(os.IsNotExist(err))
+}
+
+func TestCacheValidation(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	dir := tempDir()
+	defer os.RemoveAll(dir)
+	osfs, err := straw.Open("file://" + dir)
+	require.NoError(err)
+	etags := &etagStreamStore{osfs, map[string]string{"/file": "v1"}}
+	origin := &countingStreamStore{StreamStore: etags}
+	cache, _ := straw.Open("mem://")
+	ss, err := strawcache.NewStreamStore(origin, cache, strawcache.Options{})
+	require.NoError(err)
+
+	p := filepath.Join(dir, "file")
+	require.NoError(ioutil.WriteFile(p, []byte("one"), 0644))
+	assert.Equal("one", string(readStoreFile(t, ss, "/file")))
+
+	// Same size, but a different mtime.
+	require.NoError(ioutil.WriteFile(p, []byte("two"), 0644))
+	require.NoError(os.Chtimes(p, time.Now(), time.Now().Add(time.Hour)))
+	assert.Equal("two", string(readStoreFile(t, ss, "/file")))
+	assert.Equal(int64(2), origin.opens)
+
+	// Same size and mtime, but a different ETag.
+	fi, err := os.Stat(p)
+	require.NoError(err)
+	require.NoError(ioutil.WriteFile(p, []byte("six"), 0644))
+	require.NoError(os.Chtimes(p, fi.ModTime(), fi.ModTime()))
+	etags.etags["/file"] = "v2"
+	assert.Equal("six", string(readStoreFile(t, ss, "/file")))
+	assert.Equal(int64(3), origin.opens)
+
+	assert.Equal("six", string(readStoreFile(t, ss, "/file")))
+	assert.Equal(int64(3), origin.opens)
+}
+
+func TestCacheWritesInvalidate(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	mem, _ := straw.Open("mem://")
+	origin := &countingStreamStore{StreamStore: mem}
+	cache, _ := straw.Open("mem://")
+	ss, err := strawcache.NewStreamStore(origin, cache, strawcache.Options{})
+	require.NoError(err)
+
+	writeStoreFile(t, ss, "/a", []byte("aaa"))
+	writeStoreFile(t, ss, "/b", []byte("bbb"))
+	readStoreFile(t, ss, "/a")
+	readStoreFile(t, ss, "/b")
+	n, _ := cacheEntries(t, cache)
+	assert.Equal(2, n)
+
+	// The same size, and mem has no mtimes, so only the invalidation keeps
+	// the old content from being served.
+	writeStoreFile(t, ss, "/a", []byte("AAA"))
+	n, _ = cacheEntries(t, cache)
+	assert.Equal(1, n)
+	assert.Equal("AAA", string(readStoreFile(t, ss, "/a")))
+
+	require.NoError(ss.Remove("/b"))
+	n, _ = cacheEntries(t, cache)
+	assert.Equal(1, n)
+	_, err = ss.OpenReadCloser("/b")
+	assert.True(os.IsNotExist(err))
+}
+
+func TestCacheEviction(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	mem, _ := straw.Open("mem://")
+	origin := &countingStreamStore{StreamStore: mem}
+	cache, _ := straw.Open("mem://")
+	ss, err := strawcache.NewStreamStore(origin, cache, strawcache.Options{MaxSize: 25})
+	require.NoError(err)
+
+	for _, name := range []string{"/a", "/b", "/c"} {
+		writeStoreFile(t, mem, name, []byte("0123456789"))
+	}
+	readStoreFile(t, ss, "/a")
+	readStoreFile(t, ss, "/b")
+	readStoreFile(t, ss, "/a")
+	// Evicts b, the least recently used.
+	readStoreFile(t, ss, "/c")
+	n, size := cacheEntries(t, cache)
+	assert.Equal(2, n)
+	assert.Equal(int64(20), size)
+	assert.Equal(int64(3), origin.opens)
+
+	readStoreFile(t, ss, "/a")
+	readStoreFile(t, ss, "/c")
+	assert.Equal(int64(3), origin.opens)
+	readStoreFile(t, ss, "/b")
+	assert.Equal(int64(4), origin.opens)
+
+	// Entries in use aren't evicted.
+	r, err := ss.OpenReadCloser("/b")
+	require.NoError(err)
+	readStoreFile(t, ss, "/a")
+	readStoreFile(t, ss, "/c")
+	all, err := ioutil.ReadAll(r)
+	require.NoError(err)
+	assert.Equal("0123456789", string(all))
+	require.NoError(r.Close())
+	_, size = cacheEntries(t, cache)
+	assert.True(size <= 25)
+
+	// Too big to cache at all.
+	writeStoreFile(t, mem, "/big", make([]byte, 30))
+	assert.Equal(30, len(readStoreFile(t, ss, "/big")))
+	_, size = cacheEntries(t, cache)
+	assert.True(size <= 25)
+}
+
+func TestCacheBlocks(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	mem, _ := straw.Open("mem://")
+	origin := &countingStreamStore{StreamStore: mem}
+	cache, _ := straw.Open("mem://")
+	ss, err := strawcache.NewStreamStore(origin, cache, strawcache.Options{BlockSize: 1024})
+	require.NoError(err)
+
+	data := make([]byte, 10*1024+100)
+	_, err = rand.Read(data)
+	require.NoError(err)
+	writeStoreFile(t, mem, "/file", data)
+
+	r, err := ss.OpenReadCloser("/file")
+	require.NoError(err)
+	buf := make([]byte, 1500)
+	n, err := r.ReadAt(buf, 3000)
+	require.NoError(err)
+	assert.Equal(data[3000:4500], buf[:n])
+	require.NoError(r.Close())
+	// A closed reader doesn't reopen the file.
+	_, err = r.ReadAt(buf, 6000)
+	assert.Equal(os.ErrClosed, err)
+	_, err = r.Read(buf)
+	assert.Equal(os.ErrClosed, err)
+	assert.Equal(int64(1), origin.opens)
+	// Only blocks 2 to 4 were fetched.
+	assert.Equal(int64(3*1024), origin.bytes)
+	n2, _ := cacheEntries(t, cache)
+	assert.Equal(3, n2)
+
+	assert.Equal(data, readStoreFile(t, ss, "/file"))
+	assert.Equal(int64(len(data)), origin.bytes)
+	n2, size := cacheEntries(t, cache)
+	assert.Equal(11, n2)
+	assert.Equal(int64(len(data)), size)
+
+	// All from the cache now.
+	r, err = ss.OpenReadCloser("/file")
+	require.NoError(err)
+	defer r.Close()
+	_, err = r.Seek(10*1024, io.SeekStart)
+	require.NoError(err)
+	all, err := ioutil.ReadAll(r)
+	require.NoError(err)
+	assert.Equal(data[10*1024:], all)
+	n, err = r.ReadAt(buf, int64(len(data)-10))
+	assert.Equal(io.EOF, err)
+	assert.Equal(data[len(data)-10:], buf[:n])
+	assert.Equal(int64(len(data)), origin.bytes)
+}
+
+func TestCachePersistence(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	dir := tempDir()
+	defer os.RemoveAll(dir)
+
+	mem, _ := straw.Open("mem://")
+	writeStoreFile(t, mem, "/file", []byte("hello"))
+	origin := &countingStreamStore{StreamStore: mem}
+
+	cache, err := straw.Open("file://" + dir)
+	require.NoError(err)
+	require.NoError(ioutil.WriteFile(filepath.Join(dir, "unrelated"), []byte("keep me"), 0644))
+	ss, err := strawcache.NewStreamStore(origin, cache, strawcache.Options{})
+	require.NoError(err)
+	assert.Equal("hello", string(readStoreFile(t, ss, "/file")))
+
+	cache, err = straw.Open("file://" + dir)
+	require.NoError(err)
+	ss, err = strawcache.NewStreamStore(origin, cache, strawcache.Options{})
+	require.NoError(err)
+	assert.Equal("hello", string(readStoreFile(t, ss, "/file")))
+	assert.Equal(int64(1), origin.opens)
+
+	// Other files are left alone, and don't count towards the size.
+	ss, err = strawcache.NewStreamStore(origin, cache, strawcache.Options{MaxSize: 5})
+	require.NoError(err)
+	_, err = os.Stat(filepath.Join(dir, "unrelated"))
+	assert.NoError(err)
+	assert.Equal("hello", string(readStoreFile(t, ss, "/file")))
+	assert.Equal(int64(1), origin.opens)
+}
+
+func TestCacheNewStreamStore(t *testing.T) {
+	mem, _ := straw.Open("mem://")
+	cache, _ := straw.Open("mem://")
+	_, err := strawcache.NewStreamStore(mem, cache, strawcache.Options{MaxSize: -1})
+	assert.Error(t, err)
+	_, err = strawcache.NewStreamStore(mem, cache, strawcache.Options{MaxSize: 10, BlockSize: 20})
+	assert.Error(t, err)
+}
@@ -0,0 +1,217 @@
+package straw_test
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/uw-labs/straw"
+	strawbolt "github.com/uw-labs/straw/bolt"
+	strawredis "github.com/uw-labs/straw/redis"
+	strawsql "github.com/uw-labs/straw/sql"
+	"go.etcd.io/bbolt"
+)
+
+// chunkedStores open the backends that split content into chunks of a
+// given size.
+var chunkedStores = []struct {
+	name string
+	open func(t *testing.T, chunkSize int) (straw.StreamStore, error)
+}{
+	{"sql", func(t *testing.T, chunkSize int) (straw.StreamStore, error) {
+		return straw.Open(sqliteTestURL(t, fmt.Sprintf("?chunk_size=%d", chunkSize)))
+	}},
+	{"bolt", func(t *testing.T, chunkSize int) (straw.StreamStore, error) {
+		return straw.Open(fmt.Sprintf("bolt://%s?page_size=%d", boltTestPath(t), chunkSize))
+	}},
+	{"redis", func(t *testing.T, chunkSize int) (straw.StreamStore, error) {
+		return straw.Open(fmt.Sprintf("redis://%s/?chunk_size=%d", miniredis.RunT(t).Addr(), chunkSize))
+	}},
+}
+
+func TestChunkedRead(t *testing.T) {
+	for _, cs := range chunkedStores {
+		// The larger size is stored in several batches.
+		for _, size := range []int{10500, 4<<20 + 10500} {
+			t.Run(fmt.Sprintf("%s_%d", cs.name, size), func(t *testing.T) {
+				testChunkedRead(t, cs.open, size)
+			})
+		}
+	}
+}
+
+func testChunkedRead(t *testing.T, open func(*testing.T, int) (straw.StreamStore, error), size int) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	ss, err := open(t, 1000)
+	require.NoError(err)
+	defer ss.Close()
+
+	data := make([]byte, size)
+	_, err = rand.Read(data)
+	require.NoError(err)
+
+	w, err := ss.CreateWriteCloser("/file")
+	require.NoError(err)
+	// Odd sized writes, so chunks are filled from several of them.
+	for i := 0; i < len(data); i += 333 {
+		end := i + 333
+		if end > len(data) {
+			end = len(data)
+		}
+		require.NoError(writeAll(w, data[i:end]))
+	}
+	require.NoError(w.Close())
+
+	fi, err := ss.Stat("/file")
+	require.NoError(err)
+	assert.Equal(int64(len(data)), fi.Size())
+
+	r, err := ss.OpenReadCloser("/file")
+	require.NoError(err)
+	defer r.Close()
+
+	all, err := ioutil.ReadAll(r)
+	require.NoError(err)
+	assert.Equal(data, all)
+
+	// Spanning several chunks, starting and ending part way through them.
+	buf := make([]byte, 2500)
+	n, err := r.ReadAt(buf, 1999)
+	require.NoError(err)
+	assert.Equal(2500, n)
+	assert.Equal(data[1999:4499], buf)
+
+	n, err = r.ReadAt(buf, int64(size-1500))
+	assert.Equal(io.EOF, err)
+	assert.Equal(1500, n)
+	assert.Equal(data[size-1500:], buf[:n])
+
+	_, err = r.Seek(-600, io.SeekEnd)
+	require.NoError(err)
+	all, err = ioutil.ReadAll(r)
+	require.NoError(err)
+	assert.Equal(data[len(data)-600:], all)
+}
+
+func TestChunkedWriteVisibleOnClose(t *testing.T) {
+	for _, cs := range chunkedStores {
+		t.Run(cs.name, func(t *testing.T) {
+			testChunkedWriteVisibleOnClose(t, cs.open)
+		})
+	}
+}
+
+func testChunkedWriteVisibleOnClose(t *testing.T, open func(*testing.T, int) (straw.StreamStore, error)) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	ss, err := open(t, 4)
+	require.NoError(err)
+	defer ss.Close()
+
+	w, err := ss.CreateWriteCloser("/file")
+	require.NoError(err)
+	require.NoError(writeAll(w, []byte("first version")))
+
+	_, err = ss.Stat("/file")
+	assert.True(os.IsNotExist(err), "new file must not appear before Close")
+	require.NoError(w.Close())
+
+	w, err = ss.CreateWriteCloser("/file")
+	require.NoError(err)
+	require.NoError(writeAll(w, []byte("second")))
+
+	r, err := ss.OpenReadCloser("/file")
+	require.NoError(err)
+	all, err := ioutil.ReadAll(r)
+	require.NoError(err)
+	assert.Equal("first version", string(all), "old content must remain until Close")
+	require.NoError(r.Close())
+
+	require.NoError(w.Close())
+
+	r, err = ss.OpenReadCloser("/file")
+	require.NoError(err)
+	all, err = ioutil.ReadAll(r)
+	require.NoError(err)
+	assert.Equal("second", string(all))
+	require.NoError(r.Close())
+}
+
+// handleStores build the same backends over a database or client that the
+// caller owns.  hasDir uses that handle to look for the directory /dir.
+var handleStores = []struct {
+	name string
+	open func(t *testing.T) (ss straw.StreamStore, hasDir func() (bool, error))
+}{
+	{"sql", func(t *testing.T) (straw.StreamStore, func() (bool, error)) {
+		db, err := sql.Open("sqlite", ":memory:")
+		require.NoError(t, err)
+		t.Cleanup(func() { db.Close() })
+		// Each connection to :memory: is a database of its own.
+		db.SetMaxOpenConns(1)
+		ss, err := strawsql.NewStreamStore(db, strawsql.Options{Dialect: strawsql.DialectSQLite})
+		require.NoError(t, err)
+		return ss, func() (bool, error) {
+			var n int
+			err := db.QueryRow(`SELECT COUNT(*) FROM straw_files WHERE name = 'dir' AND is_dir`).Scan(&n)
+			return n == 1, err
+		}
+	}},
+	{"bolt", func(t *testing.T) (straw.StreamStore, func() (bool, error)) {
+		db, err := bbolt.Open(boltTestPath(t), 0600, nil)
+		require.NoError(t, err)
+		t.Cleanup(func() { db.Close() })
+		ss, err := strawbolt.NewStreamStore(db, strawbolt.Options{Bucket: "files"})
+		require.NoError(t, err)
+		return ss, func() (found bool, err error) {
+			err = db.View(func(tx *bbolt.Tx) error {
+				if b := tx.Bucket([]byte("files")); b != nil {
+					if root := b.Bucket([]byte("root")); root != nil {
+						found = root.Bucket([]byte("dir")) != nil
+					}
+				}
+				return nil
+			})
+			return found, err
+		}
+	}},
+	{"redis", func(t *testing.T) (straw.StreamStore, func() (bool, error)) {
+		client := redis.NewClient(&redis.Options{Addr: miniredis.RunT(t).Addr()})
+		t.Cleanup(func() { client.Close() })
+		ss, err := strawredis.NewStreamStore(client, strawredis.Options{Prefix: "{straw}:"})
+		require.NoError(t, err)
+		return ss, func() (bool, error) {
+			n, err := client.Exists(context.Background(), "{straw}:meta:/dir").Result()
+			return n == 1, err
+		}
+	}},
+}
+
+func TestChunkedNewStreamStore(t *testing.T) {
+	for _, hs := range handleStores {
+		t.Run(hs.name, func(t *testing.T) {
+			require := require.New(t)
+
+			ss, hasDir := hs.open(t)
+			require.NoError(ss.Mkdir("/dir", 0755))
+			require.NoError(ss.Close())
+
+			// Closing the StreamStore leaves the handle open.
+			found, err := hasDir()
+			require.NoError(err)
+			require.True(found)
+		})
+	}
+}
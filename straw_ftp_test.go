@@ -0,0 +1,217 @@
+package straw_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/uw-labs/straw"
+	ftpserver "goftp.io/server/v2"
+	"goftp.io/server/v2/driver/file"
+)
+
+type ftpTestServer struct {
+	addr string
+	// caFile holds the server's self signed certificate, when it uses TLS.
+	caFile string
+}
+
+// startFTPServer runs an ftp server for user test/tiger, serving a fresh temp
+// dir.  With explicitTLS it also accepts `AUTH TLS`.
+func startFTPServer(t *testing.T, explicitTLS bool) *ftpTestServer {
+	t.Helper()
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "straw_ftp_test")
+	require.NoError(err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	driver, err := file.NewDriver(dir)
+	require.NoError(err)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(err)
+	port := l.Addr().(*net.TCPAddr).Port
+
+	opts := &ftpserver.Options{
+		Driver:   driver,
+		Auth:     &ftpserver.SimpleAuth{Name: "test", Password: "tiger"},
+		Perm:     ftpserver.NewSimplePerm("test", "test"),
+		Hostname: "127.0.0.1",
+		PublicIP: "127.0.0.1",
+		Port:     port,
+		Logger:   &ftpserver.DiscardLogger{},
+	}
+
+	srv := &ftpTestServer{addr: l.Addr().String()}
+	if explicitTLS {
+		srv.caFile, opts.CertFile, opts.KeyFile = writeSelfSignedCert(t)
+		opts.TLS = true
+		opts.ExplicitFTPS = true
+	}
+
+	s, err := ftpserver.NewServer(opts)
+	require.NoError(err)
+
+	if explicitTLS {
+		// The server only sets up TLS when it creates its own listener.
+		l.Close()
+		go func() { _ = s.ListenAndServe() }()
+		require.Eventually(func() bool {
+			c, err := net.Dial("tcp", srv.addr)
+			if err != nil {
+				return false
+			}
+			c.Close()
+			return true
+		}, 5*time.Second, 10*time.Millisecond)
+	} else {
+		go func() { _ = s.Serve(l) }()
+	}
+	t.Cleanup(func() { _ = s.Shutdown() })
+	return srv
+}
+
+// writeSelfSignedCert writes a certificate for 127.0.0.1 and its key, and
+// returns the paths of the certificate, which doubles as its own CA, and the
+// key.
+func writeSelfSignedCert(t *testing.T) (caFile, certFile, keyFile string) {
+	require := require.New(t)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(err)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "straw test"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(err)
+
+	certFile = writeTempFile(t, "cert.pem", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	keyFile = writeTempFile(t, "key.pem", pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}))
+	return certFile, certFile, keyFile
+}
+
+func TestFTPSExplicitFS(t *testing.T) {
+	srv := startFTPServer(t, true)
+
+	ftpsfs, err := straw.Open(fmt.Sprintf("ftps://test:tiger@%s/?ca_file=%s", srv.addr, url.QueryEscape(srv.caFile)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ftpsfs.Close()
+	testFS(t, "ftpsfs", func() straw.StreamStore { return &TestLogStreamStore{t, ftpsfs} }, "/")
+}
+
+func TestFTPSUntrustedCertificate(t *testing.T) {
+	srv := startFTPServer(t, true)
+
+	_, err := straw.Open(fmt.Sprintf("ftps://test:tiger@%s/", srv.addr))
+	assert.Error(t, err)
+
+	ss, err := straw.Open(fmt.Sprintf("ftps://test:tiger@%s/?insecure_skip_verify=true", srv.addr))
+	require.NoError(t, err)
+	ss.Close()
+}
+
+func TestFTPLogin(t *testing.T) {
+	srv := startFTPServer(t, false)
+
+	_, err := straw.Open(fmt.Sprintf("ftp://test:wrong@%s/", srv.addr))
+	assert.Error(t, err)
+
+	_, err = straw.Open(fmt.Sprintf("ftp://%s/?tls=explicit", srv.addr))
+	assert.Error(t, err, "tls needs the ftps scheme")
+}
+
+func TestFTPDisableEPSV(t *testing.T) {
+	require := require.New(t)
+
+	srv := startFTPServer(t, false)
+
+	ss, err := straw.Open(fmt.Sprintf("ftp://test:tiger@%s/?disable_epsv=true", srv.addr))
+	require.NoError(err)
+	defer ss.Close()
+
+	w, err := ss.CreateWriteCloser("/file")
+	require.NoError(err)
+	require.NoError(writeAll(w, []byte("hello")))
+	require.NoError(w.Close())
+
+	r, err := ss.OpenReadCloser("/file")
+	require.NoError(err)
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	require.NoError(err)
+	assert.Equal(t, "hello", string(data))
+}
+
+func TestFTPInterleavedReaders(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	srv := startFTPServer(t, false)
+
+	ss, err := straw.Open(fmt.Sprintf("ftp://test:tiger@%s/", srv.addr))
+	require.NoError(err)
+	defer ss.Close()
+
+	data := make([]byte, 256*1024)
+	_, err = rand.Read(data)
+	require.NoError(err)
+	w, err := ss.CreateWriteCloser("/file")
+	require.NoError(err)
+	require.NoError(writeAll(w, data))
+	require.NoError(w.Close())
+
+	// Each reader has a transfer of its own in flight, while other
+	// operations carry on alongside them.
+	r1, err := ss.OpenReadCloser("/file")
+	require.NoError(err)
+	r2, err := ss.OpenReadCloser("/file")
+	require.NoError(err)
+
+	buf1 := make([]byte, 1000)
+	_, err = r1.Read(buf1)
+	require.NoError(err)
+
+	fis, err := ss.Readdir("/")
+	require.NoError(err)
+	assert.Equal(1, len(fis))
+
+	all2, err := ioutil.ReadAll(r2)
+	require.NoError(err)
+	assert.Equal(data, all2)
+
+	// Abandoning r1 part way through must not upset later operations.
+	require.NoError(r1.Close())
+	require.NoError(r2.Close())
+
+	for i := 0; i < 5; i++ {
+		fi, err := ss.Stat("/file")
+		require.NoError(err)
+		assert.Equal(int64(len(data)), fi.Size())
+	}
+}
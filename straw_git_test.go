@@ -0,0 +1,254 @@
+package straw_test
+
+import (
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/uw-labs/straw"
+	strawgit "github.com/uw-labs/straw/git"
+)
+
+var gitTestTime = time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+// buildTestGitRepo commits a tree with nested directories, an executable,
+// a symlink to a file and one to a directory, which holds a relative
+// symlink of its own, then a second commit changing a file, tagged `v2`.  It
+// returns the path of the repository, the hash of the first commit and the
+// content of a larger file.
+func buildTestGitRepo(t *testing.T) (string, string, []byte) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "straw_git_test")
+	require.NoError(err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	repo, err := git.PlainInit(dir, false)
+	require.NoError(err)
+	wt, err := repo.Worktree()
+	require.NoError(err)
+
+	data := make([]byte, 200*1024)
+	_, err = rand.Read(data)
+	require.NoError(err)
+
+	require.NoError(os.MkdirAll(filepath.Join(dir, "conf", "sub"), 0755))
+	require.NoError(ioutil.WriteFile(filepath.Join(dir, "conf", "app.yaml"), []byte("version: 1\n"), 0644))
+	require.NoError(ioutil.WriteFile(filepath.Join(dir, "conf", "sub", "data.bin"), data, 0644))
+	require.NoError(ioutil.WriteFile(filepath.Join(dir, "run.sh"), []byte("#!/bin/sh\n"), 0755))
+	require.NoError(os.Symlink("conf/app.yaml", filepath.Join(dir, "current.yaml")))
+	require.NoError(os.Symlink("conf/sub", filepath.Join(dir, "data")))
+	require.NoError(os.Symlink("../app.yaml", filepath.Join(dir, "conf", "sub", "app.yaml")))
+
+	commit := func(msg string, when time.Time) string {
+		require.NoError(wt.AddWithOptions(&git.AddOptions{All: true}))
+		hash, err := wt.Commit(msg, &git.CommitOptions{
+			Author: &object.Signature{Name: "test", Email: "test@example.com", When: when},
+		})
+		require.NoError(err)
+		return hash.String()
+	}
+	first := commit("first", gitTestTime)
+
+	require.NoError(ioutil.WriteFile(filepath.Join(dir, "conf", "app.yaml"), []byte("version: 2\n"), 0644))
+	second := commit("second", gitTestTime.Add(time.Hour))
+
+	head, err := repo.Head()
+	require.NoError(err)
+	require.Equal(second, head.Hash().String())
+	_, err = repo.CreateTag("v2", head.Hash(), &git.CreateTagOptions{
+		Tagger:  &object.Signature{Name: "test", Email: "test@example.com", When: gitTestTime},
+		Message: "v2",
+	})
+	require.NoError(err)
+
+	return dir, first, data
+}
+
+func TestGit(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	dir, _, data := buildTestGitRepo(t)
+	ss, err := straw.Open("git://" + dir + "?ref=master")
+	require.NoError(err)
+	defer ss.Close()
+
+	fi, err := ss.Stat("/conf/sub/data.bin")
+	require.NoError(err)
+	assert.Equal("data.bin", fi.Name())
+	assert.Equal(int64(len(data)), fi.Size())
+	assert.Equal(os.FileMode(0644), fi.Mode())
+	assert.True(fi.ModTime().Equal(gitTestTime.Add(time.Hour)))
+
+	fi, err = ss.Stat("/run.sh")
+	require.NoError(err)
+	assert.Equal(os.FileMode(0755), fi.Mode())
+
+	for _, d := range []string{"/", "/conf", "/conf/sub/"} {
+		fi, err = ss.Stat(d)
+		require.NoError(err)
+		assert.True(fi.IsDir(), d)
+	}
+
+	fi, err = ss.Lstat("/current.yaml")
+	require.NoError(err)
+	assert.Equal(os.ModeSymlink, fi.Mode()&os.ModeSymlink)
+	assert.Equal(int64(len("conf/app.yaml")), fi.Size())
+	fi, err = ss.Stat("/current.yaml")
+	require.NoError(err)
+	assert.Equal("current.yaml", fi.Name())
+	assert.Equal(int64(len("version: 2\n")), fi.Size())
+
+	r, err := ss.OpenReadCloser("/current.yaml")
+	require.NoError(err)
+	all, err := ioutil.ReadAll(r)
+	require.NoError(err)
+	assert.Equal("version: 2\n", string(all))
+	require.NoError(r.Close())
+
+	// Symlinks part way along a path are followed, and relative ones are
+	// resolved from where their directory really is.
+	fi, err = ss.Stat("/data")
+	require.NoError(err)
+	assert.True(fi.IsDir())
+	fi, err = ss.Stat("/data/data.bin")
+	require.NoError(err)
+	assert.Equal(int64(len(data)), fi.Size())
+	fis, err := ss.Readdir("/data")
+	require.NoError(err)
+	require.Equal(2, len(fis))
+	assert.Equal("app.yaml", fis[0].Name())
+	assert.Equal(os.ModeSymlink, fis[0].Mode()&os.ModeSymlink)
+	r, err = ss.OpenReadCloser("/data/app.yaml")
+	require.NoError(err)
+	all, err = ioutil.ReadAll(r)
+	require.NoError(err)
+	assert.Equal("version: 2\n", string(all))
+	require.NoError(r.Close())
+
+	_, err = ss.Stat("/missing")
+	assert.True(os.IsNotExist(err))
+	_, err = ss.Stat("/conf/missing/file")
+	assert.True(os.IsNotExist(err))
+	_, err = ss.Stat("/data/missing")
+	assert.True(os.IsNotExist(err))
+	_, err = ss.Stat("/run.sh/file")
+	assert.True(os.IsNotExist(err))
+	_, err = ss.OpenReadCloser("/conf")
+	assert.EqualError(err, "/conf is a directory")
+	_, err = ss.Readdir("/run.sh")
+	assert.Error(err)
+
+	_, err = ss.CreateWriteCloser("/new")
+	assert.True(os.IsPermission(err))
+	assert.True(os.IsPermission(ss.Mkdir("/newdir", 0755)))
+	assert.True(os.IsPermission(ss.Remove("/run.sh")))
+
+	r, err = ss.OpenReadCloser("/conf/sub/data.bin")
+	require.NoError(err)
+	defer r.Close()
+
+	buf := make([]byte, 1000)
+	n, err := r.ReadAt(buf, 150*1024)
+	require.NoError(err)
+	assert.Equal(1000, n)
+	assert.Equal(data[150*1024:150*1024+1000], buf)
+
+	n, err = r.ReadAt(buf, int64(len(data)-10))
+	assert.Equal(io.EOF, err)
+	assert.Equal(10, n)
+
+	_, err = r.Seek(50*1024, io.SeekStart)
+	require.NoError(err)
+	all, err = ioutil.ReadAll(r)
+	require.NoError(err)
+	assert.Equal(data[50*1024:], all)
+
+	// Backwards, after reaching the end.
+	_, err = r.Seek(100, io.SeekStart)
+	require.NoError(err)
+	n, err = io.ReadFull(r, buf)
+	require.NoError(err)
+	assert.Equal(data[100:1100], buf[:n])
+}
+
+func TestGitWalk(t *testing.T) {
+	dir, _, _ := buildTestGitRepo(t)
+	ss, err := straw.Open("git://" + dir)
+	require.NoError(t, err)
+	defer ss.Close()
+
+	var walked []string
+	require.NoError(t, straw.Walk(ss, "/", func(p string, fi os.FileInfo, err error) error {
+		require.NoError(t, err)
+		walked = append(walked, p)
+		return nil
+	}))
+	assert.Equal(t, []string{
+		"/",
+		"/conf",
+		"/conf/app.yaml",
+		"/conf/sub",
+		"/conf/sub/app.yaml",
+		"/conf/sub/data.bin",
+		"/current.yaml",
+		"/data",
+		"/run.sh",
+	}, walked)
+}
+
+func TestGitRefs(t *testing.T) {
+	dir, first, _ := buildTestGitRepo(t)
+
+	for ref, want := range map[string]string{
+		"":         "version: 2\n",
+		"HEAD~1":   "version: 1\n",
+		first:      "version: 1\n",
+		first[:10]: "version: 1\n",
+		"v2":       "version: 2\n",
+	} {
+		t.Run(ref, func(t *testing.T) {
+			require := require.New(t)
+
+			ss, err := straw.Open("git://" + dir + "?ref=" + url.QueryEscape(ref))
+			require.NoError(err)
+			defer ss.Close()
+
+			r, err := ss.OpenReadCloser("/conf/app.yaml")
+			require.NoError(err)
+			defer r.Close()
+			all, err := ioutil.ReadAll(r)
+			require.NoError(err)
+			require.Equal(want, string(all))
+		})
+	}
+
+	_, err := straw.Open("git://" + dir + "?ref=missing")
+	assert.Error(t, err)
+}
+
+func TestGitNewStreamStore(t *testing.T) {
+	require := require.New(t)
+
+	dir, _, _ := buildTestGitRepo(t)
+	repo, err := git.PlainOpen(dir)
+	require.NoError(err)
+
+	ss, err := strawgit.NewStreamStore(repo, strawgit.Options{Ref: "HEAD^"})
+	require.NoError(err)
+	defer ss.Close()
+
+	fi, err := ss.Stat("/conf/app.yaml")
+	require.NoError(err)
+	require.True(fi.ModTime().Equal(gitTestTime))
+}
@@ -0,0 +1,249 @@
+package straw_test
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/uw-labs/straw"
+)
+
+// startHTTPServer serves a small tree from a temp dir, with handler wrapped
+// around an http.FileServer for it.
+func startHTTPServer(t *testing.T, wrap func(dir string, h http.Handler) http.Handler) (string, []byte) {
+	t.Helper()
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "straw_http_test")
+	require.NoError(err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	data := make([]byte, 64*1024)
+	_, err = rand.Read(data)
+	require.NoError(err)
+
+	require.NoError(ioutil.WriteFile(filepath.Join(dir, "a.bin"), data, 0644))
+	require.NoError(os.MkdirAll(filepath.Join(dir, "dir", "sub"), 0755))
+	require.NoError(ioutil.WriteFile(filepath.Join(dir, "dir", "b.txt"), []byte("hello"), 0644))
+	require.NoError(ioutil.WriteFile(filepath.Join(dir, "dir", "with space.txt"), []byte("x"), 0644))
+
+	var h http.Handler = http.FileServer(http.Dir(dir))
+	if wrap != nil {
+		h = wrap(dir, h)
+	}
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+	return srv.URL, data
+}
+
+func TestHTTPStat(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	u, data := startHTTPServer(t, nil)
+	ss, err := straw.Open(u + "/")
+	require.NoError(err)
+	defer ss.Close()
+
+	fi, err := ss.Stat("/a.bin")
+	require.NoError(err)
+	assert.Equal("a.bin", fi.Name())
+	assert.False(fi.IsDir())
+	assert.Equal(int64(len(data)), fi.Size())
+	assert.False(fi.ModTime().IsZero())
+
+	fi, err = ss.Stat("/dir")
+	require.NoError(err)
+	assert.Equal("dir", fi.Name())
+	assert.True(fi.IsDir())
+
+	fi, err = ss.Stat("/")
+	require.NoError(err)
+	assert.True(fi.IsDir())
+
+	_, err = ss.Stat("/missing")
+	assert.True(os.IsNotExist(err))
+
+	_, err = ss.OpenReadCloser("/missing")
+	assert.True(os.IsNotExist(err))
+
+	_, err = ss.OpenReadCloser("/dir")
+	assert.EqualError(err, "/dir is a directory")
+}
+
+func TestHTTPRead(t *testing.T) {
+	u, data := startHTTPServer(t, nil)
+	testHTTPRead(t, u, data)
+}
+
+func TestHTTPReadWithoutRangeSupport(t *testing.T) {
+	u, data := startHTTPServer(t, func(_ string, h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r.Header.Del("Range")
+			h.ServeHTTP(w, r)
+		})
+	})
+	testHTTPRead(t, u, data)
+}
+
+func testHTTPRead(t *testing.T, u string, data []byte) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	ss, err := straw.Open(u + "/")
+	require.NoError(err)
+	defer ss.Close()
+
+	r, err := ss.OpenReadCloser("/a.bin")
+	require.NoError(err)
+	defer r.Close()
+
+	all, err := ioutil.ReadAll(r)
+	require.NoError(err)
+	assert.Equal(data, all)
+
+	buf := make([]byte, 100)
+	n, err := r.ReadAt(buf, 1000)
+	require.NoError(err)
+	assert.Equal(100, n)
+	assert.Equal(data[1000:1100], buf)
+
+	n, err = r.ReadAt(buf, int64(len(data)-10))
+	assert.Equal(io.EOF, err)
+	assert.Equal(10, n)
+	assert.Equal(data[len(data)-10:], buf[:n])
+
+	_, err = r.ReadAt(buf, int64(len(data)+10))
+	assert.Equal(io.EOF, err)
+
+	_, err = r.Seek(5000, io.SeekStart)
+	require.NoError(err)
+	all, err = ioutil.ReadAll(r)
+	require.NoError(err)
+	assert.Equal(data[5000:], all)
+}
+
+func TestHTTPReaddirHTML(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	u, _ := startHTTPServer(t, nil)
+	ss, err := straw.Open(u + "/")
+	require.NoError(err)
+	defer ss.Close()
+
+	fis, err := ss.Readdir("/dir")
+	require.NoError(err)
+	require.Equal(3, len(fis))
+
+	assert.Equal("b.txt", fis[0].Name())
+	assert.False(fis[0].IsDir())
+	assert.Equal(int64(5), fis[0].Size())
+
+	assert.Equal("sub", fis[1].Name())
+	assert.True(fis[1].IsDir())
+
+	assert.Equal("with space.txt", fis[2].Name())
+	assert.Equal(int64(1), fis[2].Size())
+
+	_, err = ss.Readdir("/a.bin")
+	assert.Error(err)
+}
+
+func TestHTTPReaddirJSON(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	u, _ := startHTTPServer(t, func(dir string, h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Accept") != "application/json" || !strings.HasSuffix(r.URL.Path, "/") {
+				h.ServeHTTP(w, r)
+				return
+			}
+			fis, err := ioutil.ReadDir(filepath.Join(dir, filepath.FromSlash(r.URL.Path)))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			var entries []map[string]interface{}
+			for _, fi := range fis {
+				entries = append(entries, map[string]interface{}{
+					"name":     fi.Name(),
+					"size":     fi.Size(),
+					"mod_time": fi.ModTime(),
+					"is_dir":   fi.IsDir(),
+				})
+			}
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(entries)
+		})
+	})
+
+	ss, err := straw.Open(u + "/?index=json")
+	require.NoError(err)
+	defer ss.Close()
+
+	fis, err := ss.Readdir("/dir")
+	require.NoError(err)
+	require.Equal(3, len(fis))
+	assert.Equal("b.txt", fis[0].Name())
+	assert.Equal(int64(5), fis[0].Size())
+	assert.False(fis[0].ModTime().IsZero())
+	assert.Equal("sub", fis[1].Name())
+	assert.True(fis[1].IsDir())
+	assert.Equal("with space.txt", fis[2].Name())
+}
+
+func TestHTTPReadOnly(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	u, _ := startHTTPServer(t, nil)
+	ss, err := straw.Open(u + "/")
+	require.NoError(err)
+	defer ss.Close()
+
+	_, err = ss.CreateWriteCloser("/new")
+	assert.True(os.IsPermission(err))
+	assert.True(os.IsPermission(ss.Mkdir("/newdir", 0755)))
+	assert.True(os.IsPermission(ss.Remove("/a.bin")))
+}
+
+func TestHTTPBasicAuth(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	u, _ := startHTTPServer(t, func(_ string, h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if user, pass, ok := r.BasicAuth(); !ok || user != "test" || pass != "tiger" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			h.ServeHTTP(w, r)
+		})
+	})
+
+	ss, err := straw.Open(u + "/")
+	require.NoError(err)
+	_, err = ss.Stat("/a.bin")
+	assert.True(os.IsPermission(err))
+
+	ss, err = straw.Open(strings.Replace(u, "http://", "http://test:tiger@", 1) + "/dir/")
+	require.NoError(err)
+	fi, err := ss.Stat("/b.txt")
+	require.NoError(err)
+	assert.Equal(int64(5), fi.Size())
+
+	fis, err := ss.Readdir("/")
+	require.NoError(err)
+	assert.Equal(3, len(fis))
+}
@@ -0,0 +1,235 @@
+package straw_test
+
+import (
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/uw-labs/straw"
+	strawcache "github.com/uw-labs/straw/cache"
+)
+
+// lookupCountingStreamStore counts the Stat, Lstat and Readdir calls made
+// for each path.
+type lookupCountingStreamStore struct {
+	straw.StreamStore
+	lk    sync.Mutex
+	calls map[string]int
+}
+
+func newLookupCountingStreamStore(ss straw.StreamStore) *lookupCountingStreamStore {
+	return &lookupCountingStreamStore{StreamStore: ss, calls: make(map[string]int)}
+}
+
+func (fs *lookupCountingStreamStore) count(op, name string) int {
+	fs.lk.Lock()
+	defer fs.lk.Unlock()
+	return fs.calls[op+" "+name]
+}
+
+func (fs *lookupCountingStreamStore) called(op, name string) {
+	fs.lk.Lock()
+	defer fs.lk.Unlock()
+	fs.calls[op+" "+name]++
+}
+
+func (fs *lookupCountingStreamStore) Stat(name string) (os.FileInfo, error) {
+	fs.called("stat", name)
+	return fs.StreamStore.Stat(name)
+}
+
+func (fs *lookupCountingStreamStore) Lstat(name string) (os.FileInfo, error) {
+	fs.called("lstat", name)
+	return fs.StreamStore.Lstat(name)
+}
+
+func (fs *lookupCountingStreamStore) Readdir(name string) ([]os.FileInfo, error) {
+	fs.called("readdir", name)
+	return fs.StreamStore.Readdir(name)
+}
+
+func TestMetadataFS(t *testing.T) {
+	mem, _ := straw.Open("mem://")
+	ss := strawcache.NewMetadataStreamStore(mem, strawcache.MetadataOptions{
+		TTL:         time.Minute,
+		NegativeTTL: time.Minute,
+	})
+	testFS(t, "metadatafs", func() straw.StreamStore { return &TestLogStreamStore{t, ss} }, "/")
+}
+
+func TestMetadataCaching(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	mem, _ := straw.Open("mem://")
+	origin := newLookupCountingStreamStore(mem)
+	ss := strawcache.NewMetadataStreamStore(origin, strawcache.MetadataOptions{TTL: time.Minute})
+
+	require.NoError(ss.Mkdir("/dir", 0755))
+	writeStoreFile(t, ss, "/dir/a", []byte("a"))
+
+	for i := 0; i < 3; i++ {
+		fi, err := ss.Stat("/dir/a")
+		require.NoError(err)
+		assert.Equal(int64(1), fi.Size())
+		fis, err := ss.Readdir("/dir/")
+		require.NoError(err)
+		assert.Equal(1, len(fis))
+		_, err = ss.Lstat("dir")
+		require.NoError(err)
+	}
+	assert.Equal(1, origin.count("stat", "/dir/a"))
+	assert.Equal(1, origin.count("readdir", "/dir/"))
+	assert.Equal(1, origin.count("lstat", "dir"))
+
+	// Changes made behind its back go unseen.
+	writeStoreFile(t, mem, "/dir/a", []byte("changed"))
+	writeStoreFile(t, mem, "/dir/b", []byte("b"))
+	_, err := ss.Stat("/dir/a")
+	require.NoError(err)
+	assert.Equal(1, origin.count("stat", "/dir/a"))
+	fis, err := ss.Readdir("/dir")
+	require.NoError(err)
+	assert.Equal(1, len(fis))
+
+	// A write drops the file and the listing of its directory, but not the
+	// directory itself.
+	writeStoreFile(t, ss, "/dir/c", []byte("c"))
+	fis, err = ss.Readdir("/dir")
+	require.NoError(err)
+	assert.Equal(3, len(fis))
+	_, err = ss.Lstat("/dir")
+	require.NoError(err)
+	assert.Equal(1, origin.count("lstat", "dir")+origin.count("lstat", "/dir"))
+
+	// Misses aren't cached without a NegativeTTL.
+	for i := 0; i < 2; i++ {
+		_, err = ss.Stat("/missing")
+		assert.True(os.IsNotExist(err))
+	}
+	assert.Equal(2, origin.count("stat", "/missing"))
+
+	// Results can't be changed by the caller.
+	fis, err = ss.Readdir("/dir")
+	require.NoError(err)
+	fis[0] = nil
+	fis, err = ss.Readdir("/dir")
+	require.NoError(err)
+	assert.NotNil(fis[0])
+}
+
+func TestMetadataNegative(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	mem, _ := straw.Open("mem://")
+	origin := newLookupCountingStreamStore(mem)
+	ss := strawcache.NewMetadataStreamStore(origin, strawcache.MetadataOptions{NegativeTTL: time.Minute})
+
+	for i := 0; i < 3; i++ {
+		_, err := ss.Stat("/dir/file")
+		assert.True(os.IsNotExist(err))
+		_, err = ss.Readdir("/dir")
+		assert.True(os.IsNotExist(err))
+	}
+	assert.Equal(1, origin.count("stat", "/dir/file"))
+	assert.Equal(1, origin.count("readdir", "/dir"))
+
+	// Only negative results are cached.
+	for i := 0; i < 2; i++ {
+		_, err := ss.Stat("/")
+		require.NoError(err)
+	}
+	assert.Equal(2, origin.count("stat", "/"))
+
+	require.NoError(ss.Mkdir("/dir", 0755))
+	fis, err := ss.Readdir("/dir")
+	require.NoError(err)
+	assert.Equal(0, len(fis))
+	writeStoreFile(t, ss, "/dir/file", nil)
+	_, err = ss.Stat("/dir/file")
+	assert.NoError(err)
+}
+
+func TestMetadataRemove(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	mem, _ := straw.Open("mem://")
+	ss := strawcache.NewMetadataStreamStore(mem, strawcache.MetadataOptions{
+		TTL:         time.Minute,
+		NegativeTTL: time.Minute,
+	})
+
+	require.NoError(straw.MkdirAll(ss, "/a/b", 0755))
+	writeStoreFile(t, ss, "/a/b/file", []byte("x"))
+	_, err := ss.Stat("/a/b/file")
+	require.NoError(err)
+	fis, err := ss.Readdir("/a/b")
+	require.NoError(err)
+	assert.Equal(1, len(fis))
+
+	require.NoError(ss.Remove("/a/b/file"))
+	_, err = ss.Stat("/a/b/file")
+	assert.True(os.IsNotExist(err))
+	fis, err = ss.Readdir("/a/b")
+	require.NoError(err)
+	assert.Equal(0, len(fis))
+
+	require.NoError(ss.Remove("/a/b"))
+	_, err = ss.Stat("/a/b")
+	assert.True(os.IsNotExist(err))
+	fis, err = ss.Readdir("/a")
+	require.NoError(err)
+	assert.Equal(0, len(fis))
+}
+
+func TestMetadataExpiry(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	mem, _ := straw.Open("mem://")
+	origin := newLookupCountingStreamStore(mem)
+	ss := strawcache.NewMetadataStreamStore(origin, strawcache.MetadataOptions{
+		TTL:         50 * time.Millisecond,
+		NegativeTTL: time.Minute,
+		MaxEntries:  2,
+	})
+
+	writeStoreFile(t, mem, "/a", []byte("a"))
+	_, err := ss.Stat("/a")
+	require.NoError(err)
+	_, err = ss.Stat("/missing")
+	assert.True(os.IsNotExist(err))
+
+	writeStoreFile(t, mem, "/a", []byte("changed"))
+	time.Sleep(100 * time.Millisecond)
+	fi, err := ss.Stat("/a")
+	require.NoError(err)
+	assert.Equal(int64(7), fi.Size())
+	assert.Equal(2, origin.count("stat", "/a"))
+
+	// Negative results have their own TTL, and their own limit.
+	_, err = ss.Stat("/missing")
+	assert.True(os.IsNotExist(err))
+	assert.Equal(1, origin.count("stat", "/missing"))
+
+	for _, name := range []string{"/b", "/c"} {
+		writeStoreFile(t, mem, name, nil)
+		_, err = ss.Stat(name)
+		require.NoError(err)
+	}
+	// a was the least recently used of three.
+	_, err = ss.Stat("/a")
+	require.NoError(err)
+	assert.Equal(3, origin.count("stat", "/a"))
+	_, err = ss.Stat("/c")
+	require.NoError(err)
+	assert.Equal(1, origin.count("stat", "/c"))
+	_, err = ss.Stat("/missing")
+	assert.True(os.IsNotExist(err))
+	assert.Equal(1, origin.count("stat", "/missing"))
+}
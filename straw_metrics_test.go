@@ -0,0 +1,205 @@
+package straw_test
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/uw-labs/straw"
+	"github.com/uw-labs/straw/metrics"
+)
+
+func TestMetricsFS(t *testing.T) {
+	mem, _ := straw.Open("mem://")
+	ss, err := metrics.NewStreamStore(mem, metrics.Options{Registerer: prometheus.NewRegistry(), Scheme: "mem"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testFS(t, "metricsfs", func() straw.StreamStore { return &TestLogStreamStore{t, ss} }, "/")
+}
+
+func TestMetricsReaderStat(t *testing.T) {
+	testReaderStat(t, func(ss straw.StreamStore) straw.StreamStore {
+		ms, err := metrics.NewStreamStore(ss, metrics.Options{Registerer: prometheus.NewRegistry()})
+		require.NoError(t, err)
+		return ms
+	})
+}
+
+func TestMetrics(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	reg := prometheus.NewRegistry()
+	mem, _ := straw.Open("mem://")
+	ss, err := metrics.NewStreamStore(mem, metrics.Options{Registerer: reg, Scheme: "mem"})
+	require.NoError(err)
+
+	require.NoError(ss.Mkdir("/dir", 0755))
+	w, err := ss.CreateWriteCloser("/dir/file")
+	require.NoError(err)
+	require.NoError(writeAll(w, []byte("hello")))
+
+	r, err := ss.OpenReadCloser("/dir/file")
+	require.NoError(err)
+	_, err = ioutil.ReadAll(r)
+	require.NoError(err)
+	buf := make([]byte, 2)
+	_, err = r.ReadAt(buf, 1)
+	require.NoError(err)
+
+	expected := `
+# HELP straw_open_readers Readers opened but not yet closed, by scheme.
+# TYPE straw_open_readers gauge
+straw_open_readers{scheme="mem"} 1
+# HELP straw_open_writers Writers opened but not yet closed, by scheme.
+# TYPE straw_open_writers gauge
+straw_open_writers{scheme="mem"} 1
+`
+	require.NoError(testutil.GatherAndCompare(reg, strings.NewReader(expected), "straw_open_readers", "straw_open_writers"))
+
+	require.NoError(w.Close())
+	require.NoError(r.Close())
+	require.NoError(r.Close())
+
+	_, err = ss.Stat("/dir/file")
+	require.NoError(err)
+	_, err = ss.Stat("/missing")
+	assert.True(os.IsNotExist(err))
+	_, err = ss.Readdir("/dir")
+	require.NoError(err)
+	assert.Error(ss.Remove("/dir"))
+	assert.Error(ss.Mkdir("/dir", 0755))
+
+	expected = `
+# HELP straw_errors_total Operations that failed, by scheme, operation and class of error.
+# TYPE straw_errors_total counter
+straw_errors_total{class="not_exist",op="Stat",scheme="mem"} 1
+straw_errors_total{class="other",op="Mkdir",scheme="mem"} 1
+straw_errors_total{class="other",op="Remove",scheme="mem"} 1
+# HELP straw_open_readers Readers opened but not yet closed, by scheme.
+# TYPE straw_open_readers gauge
+straw_open_readers{scheme="mem"} 0
+# HELP straw_open_writers Writers opened but not yet closed, by scheme.
+# TYPE straw_open_writers gauge
+straw_open_writers{scheme="mem"} 0
+# HELP straw_operations_total Operations started, by scheme and operation.
+# TYPE straw_operations_total counter
+straw_operations_total{op="CloseWriter",scheme="mem"} 1
+straw_operations_total{op="CreateWriteCloser",scheme="mem"} 1
+straw_operations_total{op="Mkdir",scheme="mem"} 2
+straw_operations_total{op="OpenReadCloser",scheme="mem"} 1
+straw_operations_total{op="Readdir",scheme="mem"} 1
+straw_operations_total{op="Remove",scheme="mem"} 1
+straw_operations_total{op="Stat",scheme="mem"} 2
+# HELP straw_read_bytes_total Bytes read through readers, by scheme.
+# TYPE straw_read_bytes_total counter
+straw_read_bytes_total{scheme="mem"} 7
+# HELP straw_written_bytes_total Bytes written through writers, by scheme.
+# TYPE straw_written_bytes_total counter
+straw_written_bytes_total{scheme="mem"} 5
+`
+	require.NoError(testutil.GatherAndCompare(reg, strings.NewReader(expected),
+		"straw_errors_total",
+		"straw_open_readers",
+		"straw_open_writers",
+		"straw_operations_total",
+		"straw_read_bytes_total",
+		"straw_written_bytes_total",
+	))
+
+	assert.Equal(7, testutil.CollectAndCount(reg, "straw_operation_duration_seconds"))
+}
+
+func TestMetricsReaderWriterErrors(t *testing.T) {
+	require := require.New(t)
+
+	dir := tempDir()
+	defer os.RemoveAll(dir)
+	osfs, err := straw.Open("file://" + dir)
+	require.NoError(err)
+	reg := prometheus.NewRegistry()
+	ss, err := metrics.NewStreamStore(osfs, metrics.Options{Registerer: reg, Scheme: "file"})
+	require.NoError(err)
+
+	w, err := ss.CreateWriteCloser("/file")
+	require.NoError(err)
+	require.NoError(writeAll(w, []byte("hello")))
+	require.NoError(w.Close())
+	_, err = w.Write([]byte("more"))
+	require.Error(err)
+
+	r, err := ss.OpenReadCloser("/file")
+	require.NoError(err)
+	// Reaching the end is not an error.
+	_, err = ioutil.ReadAll(r)
+	require.NoError(err)
+	_, err = r.ReadAt(make([]byte, 10), 0)
+	require.Equal(io.EOF, err)
+	_, err = r.ReadAt(make([]byte, 1), -1)
+	require.Error(err)
+	require.NoError(r.Close())
+	_, err = r.Read(make([]byte, 1))
+	require.Error(err)
+
+	expected := `
+# HELP straw_errors_total Operations that failed, by scheme, operation and class of error.
+# TYPE straw_errors_total counter
+straw_errors_total{class="other",op="Read",scheme="file"} 2
+straw_errors_total{class="other",op="Write",scheme="file"} 1
+`
+	require.NoError(testutil.GatherAndCompare(reg, strings.NewReader(expected), "straw_errors_total"))
+}
+
+func TestMetricsSharedRegisterer(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	reg := prometheus.NewRegistry()
+	for _, scheme := range []string{"a", "b"} {
+		mem, _ := straw.Open("mem://")
+		ss, err := metrics.NewStreamStore(mem, metrics.Options{Registerer: reg, Scheme: scheme})
+		require.NoError(err)
+		_, err = ss.Stat("/")
+		require.NoError(err)
+	}
+
+	expected := `
+# HELP straw_operations_total Operations started, by scheme and operation.
+# TYPE straw_operations_total counter
+straw_operations_total{op="Stat",scheme="a"} 1
+straw_operations_total{op="Stat",scheme="b"} 1
+`
+	require.NoError(testutil.GatherAndCompare(reg, strings.NewReader(expected), "straw_operations_total"))
+
+	// A clashing metric that isn't ours.
+	reg = prometheus.NewRegistry()
+	reg.MustRegister(prometheus.NewGauge(prometheus.GaugeOpts{Namespace: "straw", Name: "operations_total", Help: "Operations started, by scheme and operation."}))
+	mem, _ := straw.Open("mem://")
+	_, err := metrics.NewStreamStore(mem, metrics.Options{Registerer: reg})
+	assert.Error(err)
+
+	_, err = metrics.NewStreamStore(mem, metrics.Options{})
+	assert.Error(err)
+}
+
+func TestMetricsErrorClass(t *testing.T) {
+	for err, class := range map[error]string{
+		os.ErrNotExist: metrics.ClassNotExist,
+		&os.PathError{Op: "stat", Path: "/x", Err: os.ErrNotExist}:   metrics.ClassNotExist,
+		fmt.Errorf("wrapped: %w", os.ErrExist):                       metrics.ClassExist,
+		&os.PathError{Op: "open", Path: "/x", Err: os.ErrPermission}: metrics.ClassPermission,
+		os.ErrDeadlineExceeded:                                       metrics.ClassTimeout,
+		errors.New("/x : directory not empty"):                       metrics.ClassOther,
+	} {
+		assert.Equal(t, class, metrics.ErrorClass(err), err.Error())
+	}
+}
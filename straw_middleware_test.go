@@ -0,0 +1,208 @@
+package straw_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/uw-labs/straw"
+	"github.com/uw-labs/straw/middleware"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func newTracedStreamStore(ss straw.StreamStore, level slog.Level) (straw.StreamStore, *tracetest.SpanRecorder, *bytes.Buffer) {
+	sr := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr))
+	var logs bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	return middleware.NewStreamStore(ss, middleware.Options{
+		Logger:         logger,
+		Level:          level,
+		TracerProvider: tp,
+	}), sr, &logs
+}
+
+func spanAttrs(span sdktrace.ReadOnlySpan) map[attribute.Key]attribute.Value {
+	attrs := make(map[attribute.Key]attribute.Value)
+	for _, kv := range span.Attributes() {
+		attrs[kv.Key] = kv.Value
+	}
+	return attrs
+}
+
+func logRecords(t *testing.T, logs *bytes.Buffer) []map[string]interface{} {
+	var records []map[string]interface{}
+	scanner := bufio.NewScanner(logs)
+	for scanner.Scan() {
+		var rec map[string]interface{}
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &rec))
+		records = append(records, rec)
+	}
+	return records
+}
+
+func TestMiddlewareFS(t *testing.T) {
+	mem, _ := straw.Open("mem://")
+	ss := middleware.NewStreamStore(mem, middleware.Options{})
+	testFS(t, "middlewarefs", func() straw.StreamStore { return &TestLogStreamStore{t, ss} }, "/")
+}
+
+func TestMiddlewareReaderStat(t *testing.T) {
+	testReaderStat(t, func(ss straw.StreamStore) straw.StreamStore {
+		return middleware.NewStreamStore(ss, middleware.Options{})
+	})
+}
+
+func TestMiddlewareSpans(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	mem, _ := straw.Open("mem://")
+	ss, sr, _ := newTracedStreamStore(mem, slog.LevelDebug)
+
+	require.NoError(ss.Mkdir("/dir", 0755))
+	w, err := ss.CreateWriteCloser("/dir/file")
+	require.NoError(err)
+	require.NoError(writeAll(w, []byte("hello ")))
+	require.NoError(writeAll(w, []byte("world")))
+
+	// Writer spans last until Close.
+	assert.Equal(1, len(sr.Ended()))
+	require.NoError(w.Close())
+
+	r, err := ss.OpenReadCloser("/dir/file")
+	require.NoError(err)
+	all, err := ioutil.ReadAll(r)
+	require.NoError(err)
+	assert.Equal("hello world", string(all))
+	buf := make([]byte, 5)
+	_, err = r.ReadAt(buf, 6)
+	require.NoError(err)
+	_, err = r.Seek(0, io.SeekStart)
+	require.NoError(err)
+	assert.Equal(2, len(sr.Ended()))
+	require.NoError(r.Close())
+	// Closing twice doesn't end the span again.
+	r.Close()
+
+	fis, err := ss.Readdir("/dir")
+	require.NoError(err)
+	assert.Equal(1, len(fis))
+	_, err = ss.Stat("/missing")
+	assert.True(os.IsNotExist(err))
+	require.NoError(ss.Remove("/dir/file"))
+
+	spans := sr.Ended()
+	require.Equal(6, len(spans))
+	var names []string
+	for _, s := range spans {
+		names = append(names, s.Name())
+	}
+	assert.Equal([]string{
+		"straw.Mkdir",
+		"straw.CreateWriteCloser",
+		"straw.OpenReadCloser",
+		"straw.Readdir",
+		"straw.Stat",
+		"straw.Remove",
+	}, names)
+
+	for _, s := range spans {
+		assert.Equal(middleware.InstrumentationName, s.InstrumentationScope().Name)
+		assert.False(s.EndTime().Before(s.StartTime()), s.Name())
+	}
+
+	attrs := spanAttrs(spans[1])
+	assert.Equal("/dir/file", attrs[middleware.PathKey].AsString())
+	assert.Equal(int64(11), attrs[middleware.BytesWrittenKey].AsInt64())
+	assert.Equal(codes.Unset, spans[1].Status().Code)
+
+	attrs = spanAttrs(spans[2])
+	assert.Equal(int64(16), attrs[middleware.BytesReadKey].AsInt64())
+
+	attrs = spanAttrs(spans[3])
+	assert.Equal(int64(1), attrs[middleware.EntriesKey].AsInt64())
+
+	assert.Equal(codes.Error, spans[4].Status().Code)
+	require.Equal(1, len(spans[4].Events()))
+	assert.Equal("exception", spans[4].Events()[0].Name)
+}
+
+func TestMiddlewareReaderErrors(t *testing.T) {
+	require := require.New(t)
+
+	mem, _ := straw.Open("mem://")
+	ss, sr, _ := newTracedStreamStore(mem, slog.LevelDebug)
+
+	writeStoreFile(t, ss, "/file", []byte("hello"))
+	r, err := ss.OpenReadCloser("/file")
+	require.NoError(err)
+	_, err = r.Seek(-1, io.SeekStart)
+	require.Error(err)
+	require.NoError(r.Close())
+
+	spans := sr.Ended()
+	require.Equal("straw.OpenReadCloser", spans[len(spans)-1].Name())
+	require.Equal(codes.Error, spans[len(spans)-1].Status().Code)
+
+	_, err = ss.OpenReadCloser("/missing")
+	require.Error(err)
+	spans = sr.Ended()
+	require.Equal(codes.Error, spans[len(spans)-1].Status().Code)
+}
+
+func TestMiddlewareLogs(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	mem, _ := straw.Open("mem://")
+	ss, _, logs := newTracedStreamStore(mem, slog.LevelDebug)
+
+	writeStoreFile(t, ss, "/file", []byte("hello"))
+	assert.Equal("hello", string(readStoreFile(t, ss, "/file")))
+	_, err := ss.Stat("/missing")
+	require.Error(err)
+
+	records := logRecords(t, logs)
+	require.Equal(3, len(records))
+
+	assert.Equal("straw CreateWriteCloser", records[0]["msg"])
+	assert.Equal("DEBUG", records[0]["level"])
+	assert.Equal("CreateWriteCloser", records[0]["op"])
+	assert.Equal("/file", records[0]["path"])
+	assert.Equal(float64(5), records[0]["bytes_written"])
+	assert.Contains(records[0], "duration")
+
+	assert.Equal("straw OpenReadCloser", records[1]["msg"])
+	assert.Equal(float64(5), records[1]["bytes_read"])
+
+	assert.Equal("straw Stat", records[2]["msg"])
+	assert.Equal("WARN", records[2]["level"])
+	assert.Equal("/missing", records[2]["path"])
+	assert.Equal(os.ErrNotExist.Error(), records[2]["error"])
+
+	// Records below the handler's level aren't built at all, but failures
+	// are still raised to Warn.
+	var quiet bytes.Buffer
+	ss = middleware.NewStreamStore(mem, middleware.Options{
+		Logger: slog.New(slog.NewJSONHandler(&quiet, nil)),
+		Level:  slog.LevelDebug,
+	})
+	_, err = ss.Stat("/file")
+	require.NoError(err)
+	_, err = ss.Stat("/missing")
+	require.Error(err)
+	records = logRecords(t, &quiet)
+	require.Equal(1, len(records))
+	assert.Equal("/missing", records[0]["path"])
+}
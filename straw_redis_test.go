@@ -0,0 +1,69 @@
+package straw_test
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/uw-labs/straw"
+)
+
+func TestRedisTTL(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	mr := miniredis.RunT(t)
+	ss, err := straw.Open("redis://" + mr.Addr() + "/?ttl=1m&prefix=scratch:")
+	require.NoError(err)
+	defer ss.Close()
+
+	require.NoError(ss.Mkdir("/dir", 0755))
+	w, err := ss.CreateWriteCloser("/dir/old")
+	require.NoError(err)
+	require.NoError(writeAll(w, []byte("old")))
+	require.NoError(w.Close())
+
+	for _, k := range mr.Keys() {
+		if k != "scratch:next_id" {
+			assert.Equal(time.Minute, mr.TTL(k), k)
+		}
+	}
+
+	mr.FastForward(40 * time.Second)
+
+	// Writing a new file keeps the directories above it alive.
+	w, err = ss.CreateWriteCloser("/dir/new")
+	require.NoError(err)
+	require.NoError(writeAll(w, []byte("new")))
+	require.NoError(w.Close())
+
+	mr.FastForward(40 * time.Second)
+
+	_, err = ss.Stat("/dir/old")
+	assert.True(os.IsNotExist(err))
+	fis, err := ss.Readdir("/dir")
+	require.NoError(err)
+	require.Equal(1, len(fis))
+	assert.Equal("new", fis[0].Name())
+}
+
+func TestRedisAbandonedWriterExpires(t *testing.T) {
+	require := require.New(t)
+
+	mr := miniredis.RunT(t)
+	ss, err := straw.Open("redis://" + mr.Addr() + "/?chunk_size=1048576")
+	require.NoError(err)
+	defer ss.Close()
+
+	// Writers hold 4MiB before storing it.
+	w, err := ss.CreateWriteCloser("/file")
+	require.NoError(err)
+	require.NoError(writeAll(w, make([]byte, 4<<20)))
+	require.Equal(5, len(mr.Keys()), "id key and four chunks")
+
+	mr.FastForward(25 * time.Hour)
+	require.Equal([]string{"straw:next_id"}, mr.Keys())
+}
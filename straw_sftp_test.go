@@ -0,0 +1,316 @@
+package straw_test
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/uw-labs/straw"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func TestSFTPPrivateKeyAuth(t *testing.T) {
+	require := require.New(t)
+
+	srv := startSFTPServer(t)
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(err)
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	require.NoError(err)
+	keyFile := writeTempFile(t, "id_ed25519", pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+
+	sshPub, err := ssh.NewPublicKey(pub)
+	require.NoError(err)
+	srv.authorize(sshPub)
+
+	assertSFTPLogin(t, fmt.Sprintf("sftp://keyuser@%s/?host_key=%s&key_file=%s", srv.addr, srv.encodedHostKey(), url.QueryEscape(keyFile)))
+}
+
+func TestSFTPEncryptedPrivateKeyAuth(t *testing.T) {
+	require := require.New(t)
+
+	srv := startSFTPServer(t)
+
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(err)
+	// Legacy PEM encryption, as still produced by `ssh-keygen -m PEM`.
+	block, err := x509.EncryptPEMBlock(rand.Reader, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(priv), []byte("secret"), x509.PEMCipherAES256)
+	require.NoError(err)
+	keyFile := writeTempFile(t, "id_rsa", pem.EncodeToMemory(block))
+
+	sshPub, err := ssh.NewPublicKey(&priv.PublicKey)
+	require.NoError(err)
+	srv.authorize(sshPub)
+
+	base := fmt.Sprintf("sftp://keyuser@%s/?host_key=%s&key_file=%s", srv.addr, srv.encodedHostKey(), url.QueryEscape(keyFile))
+
+	_, err = straw.Open(base)
+	assert.Error(t, err, "encrypted key should not load without a passphrase")
+
+	_, err = straw.Open(base + "&passphrase=wrong")
+	assert.Error(t, err)
+
+	assertSFTPLogin(t, base+"&passphrase=secret")
+}
+
+func TestSFTPAgentAuth(t *testing.T) {
+	require := require.New(t)
+
+	srv := startSFTPServer(t)
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(err)
+	sshPub, err := ssh.NewPublicKey(pub)
+	require.NoError(err)
+	srv.authorize(sshPub)
+
+	keyring := agent.NewKeyring()
+	require.NoError(keyring.Add(agent.AddedKey{PrivateKey: priv}))
+
+	dir, err := ioutil.TempDir("", "straw_sftp_agent")
+	require.NoError(err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	sock := filepath.Join(dir, "agent.sock")
+	l, err := net.Listen("unix", sock)
+	require.NoError(err)
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				_ = agent.ServeAgent(keyring, c)
+			}()
+		}
+	}()
+
+	t.Setenv("SSH_AUTH_SOCK", sock)
+
+	assertSFTPLogin(t, fmt.Sprintf("sftp://keyuser@%s/?host_key=%s&agent=true", srv.addr, srv.encodedHostKey()))
+}
+
+func TestSFTPKeyboardInteractiveAuth(t *testing.T) {
+	srv := startSFTPServer(t)
+
+	u := fmt.Sprintf("sftp://kbd:tiger@%s/?host_key=%s", srv.addr, srv.encodedHostKey())
+
+	_, err := straw.Open(u)
+	assert.Error(t, err, "kbd user should only be allowed in with keyboard-interactive")
+
+	assertSFTPLogin(t, u+"&keyboard_interactive=true")
+}
+
+func TestSFTPKnownHosts(t *testing.T) {
+	require := require.New(t)
+
+	srv := startSFTPServer(t)
+
+	line := knownhosts.Line([]string{knownhosts.Normalize(srv.addr)}, srv.hostKey)
+	knownHosts := writeTempFile(t, "known_hosts", []byte(line+"\n"))
+
+	assertSFTPLogin(t, fmt.Sprintf("sftp://test:tiger@%s/?known_hosts=%s", srv.addr, url.QueryEscape(knownHosts)))
+
+	// A known_hosts file with a different key for this host must be refused.
+	otherPub, _, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(err)
+	otherKey, err := ssh.NewPublicKey(otherPub)
+	require.NoError(err)
+	line = knownhosts.Line([]string{knownhosts.Normalize(srv.addr)}, otherKey)
+	wrongHosts := writeTempFile(t, "known_hosts_wrong", []byte(line+"\n"))
+
+	_, err = straw.Open(fmt.Sprintf("sftp://test:tiger@%s/?known_hosts=%s", srv.addr, url.QueryEscape(wrongHosts)))
+	assert.Error(t, err)
+}
+
+func assertSFTPLogin(t *testing.T, u string) {
+	t.Helper()
+	require := require.New(t)
+
+	ss, err := straw.Open(u)
+	require.NoError(err)
+	defer ss.Close()
+
+	fi, err := ss.Stat(os.TempDir())
+	require.NoError(err)
+	assert.True(t, fi.IsDir())
+}
+
+func writeTempFile(t *testing.T, name string, data []byte) string {
+	dir, err := ioutil.TempDir("", "straw_sftp_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestSFTPReconnect(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	srv := startSFTPServer(t)
+
+	ss, err := straw.Open(fmt.Sprintf("sftp://test:tiger@%s/?host_key=%s&reconnect_backoff=10ms", srv.addr, srv.encodedHostKey()))
+	require.NoError(err)
+	defer ss.Close()
+
+	dir, err := ioutil.TempDir("", "straw_sftp_reconnect")
+	require.NoError(err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	name := filepath.Join(dir, "file")
+	require.NoError(ioutil.WriteFile(name, []byte{1, 2, 3}, 0644))
+
+	// Each operation is run straight after the server drops the connection.
+	srv.dropConnections()
+	fi, err := ss.Stat(name)
+	require.NoError(err)
+	assert.Equal(int64(3), fi.Size())
+
+	srv.dropConnections()
+	fis, err := ss.Readdir(dir)
+	require.NoError(err)
+	assert.Equal(1, len(fis))
+
+	srv.dropConnections()
+	require.NoError(ss.Mkdir(filepath.Join(dir, "subdir"), 0755))
+
+	// The directory is made, but the connection is lost before the reply,
+	// so the retry finds it already there.
+	srv.dropNextReply()
+	require.NoError(ss.Mkdir(filepath.Join(dir, "subdir2"), 0755))
+	fi, err = ss.Stat(filepath.Join(dir, "subdir2"))
+	require.NoError(err)
+	assert.True(fi.IsDir())
+	assert.Error(ss.Mkdir(filepath.Join(dir, "subdir2"), 0755))
+
+	srv.dropConnections()
+	r, err := ss.OpenReadCloser(name)
+	require.NoError(err)
+	data, err := ioutil.ReadAll(r)
+	require.NoError(err)
+	assert.Equal([]byte{1, 2, 3}, data)
+	require.NoError(r.Close())
+
+	// Non-idempotent operations are not retried, but still get a fresh
+	// connection once the dead one has been noticed.
+	srv.dropConnections()
+	_, _ = ss.Stat(dir)
+	require.NoError(ss.Remove(name))
+}
+
+func TestSFTPReconnectLimit(t *testing.T) {
+	require := require.New(t)
+
+	srv := startSFTPServer(t)
+
+	ss, err := straw.Open(fmt.Sprintf("sftp://test:tiger@%s/?host_key=%s&max_retries=1&reconnect_backoff=10ms", srv.addr, srv.encodedHostKey()))
+	require.NoError(err)
+	defer ss.Close()
+
+	// Once the server has gone away for good, operations fail after the
+	// configured number of retries rather than hanging.
+	srv.shutdown()
+	_, err = ss.Stat(os.TempDir())
+	require.Error(err)
+}
+
+func TestSFTPKeepalive(t *testing.T) {
+	require := require.New(t)
+
+	srv := startSFTPServer(t)
+
+	ss, err := straw.Open(fmt.Sprintf("sftp://test:tiger@%s/?host_key=%s&keepalive=10ms", srv.addr, srv.encodedHostKey()))
+	require.NoError(err)
+	defer ss.Close()
+
+	require.Eventually(func() bool { return srv.keepaliveCount() >= 3 }, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestSFTPPool(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	srv := startSFTPServer(t)
+
+	ss, err := straw.Open(fmt.Sprintf("sftp://test:tiger@%s/?host_key=%s&pool_size=4", srv.addr, srv.encodedHostKey()))
+	require.NoError(err)
+	defer ss.Close()
+
+	dir, err := ioutil.TempDir("", "straw_sftp_pool")
+	require.NoError(err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	data := make([]byte, 256*1024)
+	_, err = rand.Read(data)
+	require.NoError(err)
+
+	// Independent uploads and downloads run at the same time, spread over
+	// the pool.
+	var wg sync.WaitGroup
+	errs := make(chan error, 16)
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			name := filepath.Join(dir, fmt.Sprintf("file%d", i))
+			w, err := ss.CreateWriteCloser(name)
+			if err != nil {
+				errs <- err
+				return
+			}
+			if err := writeAll(w, data); err != nil {
+				errs <- err
+				return
+			}
+			if err := w.Close(); err != nil {
+				errs <- err
+				return
+			}
+			r, err := ss.OpenReadCloser(name)
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer r.Close()
+			got, err := ioutil.ReadAll(r)
+			if err != nil {
+				errs <- err
+				return
+			}
+			if !bytes.Equal(data, got) {
+				errs <- fmt.Errorf("%s: content mismatch", name)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		assert.NoError(err)
+	}
+
+	assert.Equal(4, srv.connCount())
+}
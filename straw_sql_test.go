@@ -0,0 +1,89 @@
+package straw_test
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/uw-labs/straw"
+	strawsql "github.com/uw-labs/straw/sql"
+)
+
+func sqliteTestURL(t *testing.T, query string) string {
+	dir, err := ioutil.TempDir("", "straw_sqlite_test")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return "sqlite://" + filepath.Join(dir, "straw.db") + query
+}
+
+func TestSQLWriteParentRemoved(t *testing.T) {
+	require := require.New(t)
+
+	ss, err := straw.Open(sqliteTestURL(t, ""))
+	require.NoError(err)
+	defer ss.Close()
+
+	require.NoError(ss.Mkdir("/dir", 0755))
+	w, err := ss.CreateWriteCloser("/dir/file")
+	require.NoError(err)
+	require.NoError(writeAll(w, []byte("hello")))
+	require.NoError(ss.Remove("/dir"))
+
+	require.Error(w.Close())
+	_, err = ss.Stat("/dir/file")
+	require.True(os.IsNotExist(err))
+}
+
+func TestSQLPersistence(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	u := sqliteTestURL(t, "?table=custom")
+
+	ss, err := straw.Open(u)
+	require.NoError(err)
+	require.NoError(ss.Mkdir("/dir", 0700))
+	w, err := ss.CreateWriteCloser("/dir/file")
+	require.NoError(err)
+	require.NoError(writeAll(w, []byte("hello")))
+	require.NoError(w.Close())
+	require.NoError(ss.Close())
+
+	ss, err = straw.Open(u)
+	require.NoError(err)
+	defer ss.Close()
+
+	fi, err := ss.Stat("/dir")
+	require.NoError(err)
+	assert.True(fi.IsDir())
+	assert.Equal(os.ModeDir|0700, fi.Mode())
+
+	fis, err := ss.Readdir("/dir")
+	require.NoError(err)
+	require.Equal(1, len(fis))
+	assert.Equal("file", fis[0].Name())
+	assert.Equal(int64(5), fis[0].Size())
+	assert.Equal(os.FileMode(0644), fis[0].Mode())
+}
+
+func TestSQLURL(t *testing.T) {
+	// A host would be silently ignored, and an empty path is a temporary
+	// database.
+	for _, u := range []string{"sqlite://straw.db", "sqlite://"} {
+		_, err := straw.Open(u)
+		assert.Error(t, err, u)
+	}
+}
+
+func TestSQLDialectRequired(t *testing.T) {
+	db, err := sql.Open("sqlite", ":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+
+	_, err = strawsql.NewStreamStore(db, strawsql.Options{})
+	assert.Error(t, err)
+}
@@ -0,0 +1,310 @@
+package straw_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/uw-labs/straw"
+	strawtar "github.com/uw-labs/straw/tar"
+)
+
+// buildTestTar returns an archive with files in an explicit and an implicit
+// directory, a hard link and a symlink, compressed as asked.
+func buildTestTar(t *testing.T, compression string) ([]byte, []byte) {
+	require := require.New(t)
+
+	data := make([]byte, 200*1024)
+	_, err := rand.Read(data)
+	require.NoError(err)
+
+	mod := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	var raw bytes.Buffer
+	tw := tar.NewWriter(&raw)
+	for _, hdr := range []*tar.Header{
+		{Name: "explicit/", Typeflag: tar.TypeDir, Mode: 0755, ModTime: mod},
+		{Name: "explicit/a.bin", Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(data)), ModTime: mod},
+		{Name: "implicit/sub/b.txt", Typeflag: tar.TypeReg, Mode: 0644, Size: 5, ModTime: mod},
+		{Name: "implicit/hard.bin", Typeflag: tar.TypeLink, Linkname: "explicit/a.bin", ModTime: mod},
+		{Name: "implicit/sub/link.txt", Typeflag: tar.TypeSymlink, Linkname: "b.txt", ModTime: mod},
+	} {
+		require.NoError(tw.WriteHeader(hdr))
+		switch hdr.Name {
+		case "explicit/a.bin":
+			_, err = tw.Write(data)
+		case "implicit/sub/b.txt":
+			_, err = tw.Write([]byte("hello"))
+		}
+		require.NoError(err)
+	}
+	require.NoError(tw.Close())
+
+	var out bytes.Buffer
+	switch compression {
+	case strawtar.CompressionGzip:
+		zw := gzip.NewWriter(&out)
+		_, err = zw.Write(raw.Bytes())
+		require.NoError(err)
+		require.NoError(zw.Close())
+	case strawtar.CompressionZstd:
+		zw, err := zstd.NewWriter(&out)
+		require.NoError(err)
+		_, err = zw.Write(raw.Bytes())
+		require.NoError(err)
+		require.NoError(zw.Close())
+	default:
+		out = raw
+	}
+	return out.Bytes(), data
+}
+
+func TestTar(t *testing.T) {
+	for _, compression := range []string{strawtar.CompressionNone, strawtar.CompressionGzip, strawtar.CompressionZstd} {
+		name := compression
+		if name == "" {
+			name = "none"
+		}
+		t.Run(name, func(t *testing.T) {
+			archive, data := buildTestTar(t, compression)
+			// A buffer smaller than a tar block is refilled mid header.
+			for _, bufferSize := range []int{0, 1000} {
+				ss, err := strawtar.NewStreamStore(bytes.NewReader(archive), int64(len(archive)), strawtar.Options{BufferSize: bufferSize})
+				require.NoError(t, err)
+
+				testTarStat(t, ss, data)
+				testTarRead(t, ss, "/explicit/a.bin", data)
+				testTarRead(t, ss, "/implicit/hard.bin", data)
+				require.NoError(t, ss.Close())
+			}
+		})
+	}
+}
+
+func testTarStat(t *testing.T, ss straw.StreamStore, data []byte) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	fi, err := ss.Stat("/explicit/a.bin")
+	require.NoError(err)
+	assert.Equal("a.bin", fi.Name())
+	assert.False(fi.IsDir())
+	assert.Equal(int64(len(data)), fi.Size())
+	assert.True(fi.ModTime().Equal(time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)))
+
+	for _, dir := range []string{"/", "/explicit", "/implicit", "/implicit/sub/"} {
+		fi, err = ss.Stat(dir)
+		require.NoError(err)
+		assert.True(fi.IsDir(), dir)
+	}
+
+	fi, err = ss.Lstat("/implicit/sub/link.txt")
+	require.NoError(err)
+	assert.Equal(os.ModeSymlink, fi.Mode()&os.ModeSymlink)
+	fi, err = ss.Stat("/implicit/sub/link.txt")
+	require.NoError(err)
+	assert.Equal("link.txt", fi.Name())
+	assert.Equal(int64(5), fi.Size())
+
+	r, err := ss.OpenReadCloser("/implicit/sub/link.txt")
+	require.NoError(err)
+	all, err := ioutil.ReadAll(r)
+	require.NoError(err)
+	assert.Equal("hello", string(all))
+	require.NoError(r.Close())
+
+	_, err = ss.Stat("/missing")
+	assert.True(os.IsNotExist(err))
+	_, err = ss.OpenReadCloser("/missing")
+	assert.True(os.IsNotExist(err))
+	_, err = ss.OpenReadCloser("/implicit")
+	assert.EqualError(err, "/implicit is a directory")
+
+	fis, err := ss.Readdir("/implicit")
+	require.NoError(err)
+	require.Equal(2, len(fis))
+	assert.Equal("hard.bin", fis[0].Name())
+	assert.Equal(int64(len(data)), fis[0].Size())
+	assert.Equal("sub", fis[1].Name())
+	assert.True(fis[1].IsDir())
+
+	_, err = ss.Readdir("/explicit/a.bin")
+	assert.Error(err)
+
+	_, err = ss.CreateWriteCloser("/new")
+	assert.True(os.IsPermission(err))
+	assert.True(os.IsPermission(ss.Mkdir("/newdir", 0755)))
+	assert.True(os.IsPermission(ss.Remove("/explicit/a.bin")))
+}
+
+func testTarRead(t *testing.T, ss straw.StreamStore, name string, data []byte) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	r, err := ss.OpenReadCloser(name)
+	require.NoError(err)
+	defer r.Close()
+
+	all, err := ioutil.ReadAll(r)
+	require.NoError(err)
+	assert.Equal(data, all)
+
+	buf := make([]byte, 1000)
+	n, err := r.ReadAt(buf, 150*1024)
+	require.NoError(err)
+	assert.Equal(1000, n)
+	assert.Equal(data[150*1024:150*1024+1000], buf)
+
+	n, err = r.ReadAt(buf, int64(len(data)-10))
+	assert.Equal(io.EOF, err)
+	assert.Equal(10, n)
+
+	// Backwards, then forwards.
+	_, err = r.Seek(100, io.SeekStart)
+	require.NoError(err)
+	n, err = io.ReadFull(r, buf)
+	require.NoError(err)
+	assert.Equal(data[100:1100], buf[:n])
+
+	_, err = r.Seek(50*1024, io.SeekStart)
+	require.NoError(err)
+	all, err = ioutil.ReadAll(r)
+	require.NoError(err)
+	assert.Equal(data[50*1024:], all)
+}
+
+func TestTarURL(t *testing.T) {
+	require := require.New(t)
+
+	archive, data := buildTestTar(t, strawtar.CompressionGzip)
+	name := writeTempFile(t, "shard.tar.gz", archive)
+
+	for _, u := range []string{
+		"tar://" + name,
+		"tar:///?archive=" + url.QueryEscape("file://"+name),
+		"tar://" + name + "?buffer_size=4096",
+	} {
+		ss, err := straw.Open(u)
+		require.NoError(err, u)
+
+		r, err := ss.OpenReadCloser("/explicit/a.bin")
+		require.NoError(err)
+		all, err := ioutil.ReadAll(r)
+		require.NoError(err)
+		assert.Equal(t, data, all)
+		require.NoError(r.Close())
+		require.NoError(ss.Close())
+	}
+}
+
+func TestTarFromStreamStore(t *testing.T) {
+	require := require.New(t)
+
+	archive, data := buildTestTar(t, strawtar.CompressionNone)
+
+	mem, _ := straw.Open("mem://")
+	require.NoError(straw.MkdirAll(mem, "/shards", 0755))
+	w, err := mem.CreateWriteCloser("/shards/0001.tar")
+	require.NoError(err)
+	require.NoError(writeAll(w, archive))
+	require.NoError(w.Close())
+
+	ss, err := strawtar.OpenStreamStore(mem, "/shards/0001.tar", strawtar.Options{})
+	require.NoError(err)
+	defer ss.Close()
+
+	testTarRead(t, ss, "/explicit/a.bin", data)
+}
+
+// readAtCounter counts the ReadAt calls made on an archive, each of which
+// would be a ranged GET were it on an object store.
+type readAtCounter struct {
+	r     io.ReaderAt
+	calls int64
+}
+
+func (c *readAtCounter) ReadAt(p []byte, off int64) (int, error) {
+	atomic.AddInt64(&c.calls, 1)
+	return c.r.ReadAt(p, off)
+}
+
+func TestTarReadAtCalls(t *testing.T) {
+	for _, compression := range []string{strawtar.CompressionNone, strawtar.CompressionGzip} {
+		name := compression
+		if name == "" {
+			name = "none"
+		}
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			// Many small files, so that each header would be a read of its
+			// own.
+			var raw bytes.Buffer
+			tw := tar.NewWriter(&raw)
+			for i := 0; i < 500; i++ {
+				require.NoError(tw.WriteHeader(&tar.Header{Name: fmt.Sprintf("f%03d", i), Typeflag: tar.TypeReg, Mode: 0644, Size: 100}))
+				_, err := tw.Write(bytes.Repeat([]byte{byte(i)}, 100))
+				require.NoError(err)
+			}
+			require.NoError(tw.Close())
+			archive := raw.Bytes()
+			if compression == strawtar.CompressionGzip {
+				var out bytes.Buffer
+				zw := gzip.NewWriter(&out)
+				_, err := zw.Write(archive)
+				require.NoError(err)
+				require.NoError(zw.Close())
+				archive = out.Bytes()
+			}
+
+			counter := &readAtCounter{r: bytes.NewReader(archive)}
+			ss, err := strawtar.NewStreamStore(counter, int64(len(archive)), strawtar.Options{})
+			require.NoError(err)
+			defer ss.Close()
+			// One read for the magic number, and one for the whole
+			// archive, which is smaller than the buffer.
+			assert.Equal(int64(2), atomic.LoadInt64(&counter.calls))
+
+			fis, err := ss.Readdir("/")
+			require.NoError(err)
+			assert.Equal(500, len(fis))
+
+			r, err := ss.OpenReadCloser("/f499")
+			require.NoError(err)
+			defer r.Close()
+			buf := make([]byte, 10)
+			// Reading forwards with ReadAt carries on from where the last
+			// one stopped.
+			for off := int64(0); off < 100; off += 10 {
+				_, err = r.ReadAt(buf, off)
+				require.NoError(err)
+				assert.Equal(bytes.Repeat([]byte{byte(499 % 256)}, 10), buf)
+			}
+			all, err := ioutil.ReadAll(r)
+			require.NoError(err)
+			assert.Equal(100, len(all))
+
+			calls := atomic.LoadInt64(&counter.calls) - 2
+			if compression == strawtar.CompressionNone {
+				// Entries in uncompressed archives are read in place.
+				assert.Equal(int64(11), calls)
+			} else {
+				// One stream for ReadAt, and one for Read.
+				assert.Equal(int64(2), calls)
+			}
+		})
+	}
+}
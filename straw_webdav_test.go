@@ -0,0 +1,90 @@
+package straw_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/uw-labs/straw"
+	"golang.org/x/net/webdav"
+)
+
+// startWebDAVServer serves an in memory WebDAV tree that only lets in
+// requests accepted by authorized.
+func startWebDAVServer(t *testing.T, authorized func(r *http.Request) bool) string {
+	h := &webdav.Handler{
+		FileSystem: webdav.NewMemFS(),
+		LockSystem: webdav.NewMemLS(),
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(r) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	return strings.Replace(srv.URL, "http://", "", 1)
+}
+
+func assertWebDAVAccess(t *testing.T, u string) {
+	t.Helper()
+	require := require.New(t)
+
+	ss, err := straw.Open(u)
+	require.NoError(err)
+	defer ss.Close()
+
+	require.NoError(ss.Mkdir("/dir", 0755))
+	w, err := ss.CreateWriteCloser("/dir/file")
+	require.NoError(err)
+	require.NoError(writeAll(w, []byte("hello")))
+	require.NoError(w.Close())
+	fis, err := ss.Readdir("/dir")
+	require.NoError(err)
+	require.Equal(1, len(fis))
+	assert.Equal(t, int64(5), fis[0].Size())
+}
+
+func TestWebDAVBasicAuth(t *testing.T) {
+	host := startWebDAVServer(t, func(r *http.Request) bool {
+		user, pass, ok := r.BasicAuth()
+		return ok && user == "test" && pass == "tiger"
+	})
+
+	ss, err := straw.Open("webdav://" + host + "/")
+	require.NoError(t, err)
+	_, err = ss.Stat("/")
+	assert.True(t, os.IsPermission(err))
+
+	ss, err = straw.Open("webdav://test:wrong@" + host + "/")
+	require.NoError(t, err)
+	_, err = ss.Readdir("/")
+	assert.True(t, os.IsPermission(err))
+
+	assertWebDAVAccess(t, "webdav://test:tiger@"+host+"/")
+}
+
+func TestWebDAVBearerAuth(t *testing.T) {
+	host := startWebDAVServer(t, func(r *http.Request) bool {
+		return r.Header.Get("Authorization") == "Bearer s3cret"
+	})
+
+	_, err := straw.Open("webdav://" + host + "/?token_env=STRAW_TEST_WEBDAV_UNSET_TOKEN")
+	assert.Error(t, err)
+
+	t.Setenv("STRAW_TEST_WEBDAV_TOKEN", "s3cret")
+	assertWebDAVAccess(t, "webdav://"+host+"/?token_env=STRAW_TEST_WEBDAV_TOKEN")
+
+	tokenFile := writeTempFile(t, "token", []byte("s3cret\n"))
+	ss, err := straw.Open("webdav://" + host + "/?token_file=" + url.QueryEscape(tokenFile))
+	require.NoError(t, err)
+	fi, err := ss.Stat("/dir/file")
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), fi.Size())
+}
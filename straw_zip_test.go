@@ -0,0 +1,198 @@
+package straw_test
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/uw-labs/straw"
+	strawzip "github.com/uw-labs/straw/zip"
+)
+
+// buildTestZip returns an archive holding the same random data both stored
+// and deflated, next to an explicit and an implicit directory.
+func buildTestZip(t *testing.T) ([]byte, []byte) {
+	require := require.New(t)
+
+	data := make([]byte, 200*1024)
+	_, err := rand.Read(data[:len(data)/2])
+	require.NoError(err)
+
+	mod := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	_, err = zw.CreateHeader(&zip.FileHeader{Name: "explicit/", Modified: mod})
+	require.NoError(err)
+	for _, e := range []struct {
+		name   string
+		method uint16
+	}{
+		{"explicit/stored.bin", zip.Store},
+		{"implicit/sub/deflated.bin", zip.Deflate},
+	} {
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: e.name, Method: e.method, Modified: mod})
+		require.NoError(err)
+		_, err = w.Write(data)
+		require.NoError(err)
+	}
+	require.NoError(zw.Close())
+	return buf.Bytes(), data
+}
+
+func TestZipStat(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	archive, data := buildTestZip(t)
+	ss, err := strawzip.NewStreamStore(bytes.NewReader(archive), int64(len(archive)))
+	require.NoError(err)
+
+	fi, err := ss.Stat("/explicit/stored.bin")
+	require.NoError(err)
+	assert.Equal("stored.bin", fi.Name())
+	assert.False(fi.IsDir())
+	assert.Equal(int64(len(data)), fi.Size())
+	assert.True(fi.ModTime().Equal(time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)))
+
+	for _, dir := range []string{"/", "/explicit", "/implicit", "/implicit/sub/"} {
+		fi, err = ss.Stat(dir)
+		require.NoError(err)
+		assert.True(fi.IsDir(), dir)
+	}
+
+	_, err = ss.Stat("/missing")
+	assert.True(os.IsNotExist(err))
+	_, err = ss.OpenReadCloser("/missing")
+	assert.True(os.IsNotExist(err))
+	_, err = ss.OpenReadCloser("/implicit")
+	assert.EqualError(err, "/implicit is a directory")
+
+	fis, err := ss.Readdir("/")
+	require.NoError(err)
+	require.Equal(2, len(fis))
+	assert.Equal("explicit", fis[0].Name())
+	assert.Equal("implicit", fis[1].Name())
+
+	fis, err = ss.Readdir("/implicit/sub")
+	require.NoError(err)
+	require.Equal(1, len(fis))
+	assert.Equal("deflated.bin", fis[0].Name())
+	assert.Equal(int64(len(data)), fis[0].Size())
+
+	_, err = ss.Readdir("/explicit/stored.bin")
+	assert.Error(err)
+}
+
+func TestZipRead(t *testing.T) {
+	archive, data := buildTestZip(t)
+	ss, err := strawzip.NewStreamStore(bytes.NewReader(archive), int64(len(archive)))
+	require.NoError(t, err)
+
+	for _, name := range []string{"/explicit/stored.bin", "/implicit/sub/deflated.bin"} {
+		t.Run(filepath.Base(name), func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			r, err := ss.OpenReadCloser(name)
+			require.NoError(err)
+			defer r.Close()
+
+			all, err := ioutil.ReadAll(r)
+			require.NoError(err)
+			assert.Equal(data, all)
+
+			buf := make([]byte, 1000)
+			n, err := r.ReadAt(buf, 150*1024)
+			require.NoError(err)
+			assert.Equal(1000, n)
+			assert.Equal(data[150*1024:150*1024+1000], buf)
+
+			n, err = r.ReadAt(buf, int64(len(data)-10))
+			assert.Equal(io.EOF, err)
+			assert.Equal(10, n)
+
+			// Backwards, then forwards.
+			_, err = r.Seek(100, io.SeekStart)
+			require.NoError(err)
+			n, err = io.ReadFull(r, buf)
+			require.NoError(err)
+			assert.Equal(data[100:1100], buf[:n])
+
+			_, err = r.Seek(50*1024, io.SeekStart)
+			require.NoError(err)
+			all, err = ioutil.ReadAll(r)
+			require.NoError(err)
+			assert.Equal(data[50*1024:], all)
+		})
+	}
+}
+
+func TestZipReadOnly(t *testing.T) {
+	assert := assert.New(t)
+
+	archive, _ := buildTestZip(t)
+	ss, err := strawzip.NewStreamStore(bytes.NewReader(archive), int64(len(archive)))
+	require.NoError(t, err)
+
+	_, err = ss.CreateWriteCloser("/new")
+	assert.True(os.IsPermission(err))
+	assert.True(os.IsPermission(ss.Mkdir("/newdir", 0755)))
+	assert.True(os.IsPermission(ss.Remove("/explicit/stored.bin")))
+}
+
+func TestZipURL(t *testing.T) {
+	require := require.New(t)
+
+	archive, data := buildTestZip(t)
+	name := writeTempFile(t, "bundle.zip", archive)
+
+	ss, err := straw.Open("zip://" + name)
+	require.NoError(err)
+	defer ss.Close()
+
+	r, err := ss.OpenReadCloser("/implicit/sub/deflated.bin")
+	require.NoError(err)
+	defer r.Close()
+	all, err := ioutil.ReadAll(r)
+	require.NoError(err)
+	assert.Equal(t, data, all)
+}
+
+func TestZipFromStreamStore(t *testing.T) {
+	require := require.New(t)
+
+	archive, data := buildTestZip(t)
+
+	// The archive lives in another StreamStore, and is read in place.
+	mem, _ := straw.Open("mem://")
+	require.NoError(straw.MkdirAll(mem, "/bundles", 0755))
+	w, err := mem.CreateWriteCloser("/bundles/bundle.zip")
+	require.NoError(err)
+	require.NoError(writeAll(w, archive))
+	require.NoError(w.Close())
+
+	fi, err := mem.Stat("/bundles/bundle.zip")
+	require.NoError(err)
+	zr, err := mem.OpenReadCloser("/bundles/bundle.zip")
+	require.NoError(err)
+	defer zr.Close()
+
+	ss, err := strawzip.NewStreamStore(zr, fi.Size())
+	require.NoError(err)
+
+	r, err := ss.OpenReadCloser("/explicit/stored.bin")
+	require.NoError(err)
+	defer r.Close()
+	all, err := ioutil.ReadAll(r)
+	require.NoError(err)
+	assert.Equal(t, data, all)
+}
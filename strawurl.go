@@ -3,14 +3,28 @@ package straw
 import (
 	"fmt"
 	"net/url"
+	"strconv"
+	"strings"
 )
 
+// Open returns a StreamStore for the URL u, using the backend registered
+// for its scheme.  A `readonly=true` query parameter, which works with any
+// scheme, wraps the StreamStore with ReadOnly.
 func Open(u string) (StreamStore, error) {
 	parsed, err := url.Parse(u)
 	if err != nil {
 		return nil, err
 	}
 
+	readOnly := false
+	if q := parsed.Query(); q.Has("readonly") {
+		if readOnly, err = strconv.ParseBool(q.Get("readonly")); err != nil {
+			return nil, fmt.Errorf("invalid %q query parameter: %w", "readonly", err)
+		}
+		// Some backends pass unknown parameters on, or reject them.
+		parsed.RawQuery = removeParam(parsed.RawQuery, "readonly")
+	}
+
 	backendsLk.RLock()
 	defer backendsLk.RUnlock()
 
@@ -18,12 +32,36 @@ func Open(u string) (StreamStore, error) {
 	if f == nil {
 		return nil, fmt.Errorf("unknown scheme : %s", parsed.Scheme)
 	}
-	return f(parsed)
+	ss, err := f(parsed)
+	if err != nil || !readOnly {
+		return ss, err
+	}
+	return ReadOnly(ss), nil
+}
+
+// removeParam removes the parameter name from the query rawQuery, leaving
+// the others as they are, in their order and with their encoding, for
+// backends that pass them on.
+func removeParam(rawQuery, name string) string {
+	pairs := strings.Split(rawQuery, "&")
+	kept := pairs[:0]
+	for _, p := range pairs {
+		key := strings.SplitN(p, "=", 2)[0]
+		if k, err := url.QueryUnescape(key); err == nil && k == name {
+			continue
+		}
+		kept = append(kept, p)
+	}
+	return strings.Join(kept, "&")
 }
 
 func init() {
 	// the only "built in" backend is "file"
 	Register("file", func(u *url.URL) (StreamStore, error) {
-		return &osStreamStore{}, nil
+		var ss StreamStore = &osStreamStore{}
+		if u.Path != "" && u.Path != "/" {
+			ss = Sub(ss, u.Path)
+		}
+		return ss, nil
 	})
 }
@@ -0,0 +1,176 @@
+package straw
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+var _ StreamStore = &subStreamStore{}
+
+// Sub returns a StreamStore rooted at prefix within ss.  Every path is
+// resolved beneath prefix, and paths that would climb above it with `..`
+// are rejected with a permission error.  Paths in errors are reported as
+// seen through the returned StreamStore, so they don't reveal prefix.
+// Closing the returned StreamStore closes ss.
+//
+// Resolution is purely lexical.  Symlinks are left to ss to follow, so
+// where ss has them, as the local filesystem does, one beneath prefix that
+// points elsewhere leads out of it.  Sub is not a jail against whoever can
+// create symlinks in ss.
+func Sub(ss StreamStore, prefix string) StreamStore {
+	return &subStreamStore{ss: ss, prefix: path.Clean("/" + prefix)}
+}
+
+type subStreamStore struct {
+	ss     StreamStore
+	prefix string
+}
+
+// resolve returns the path in the wrapped store for name, or an error if
+// name escapes the root.
+func (fs *subStreamStore) resolve(op, name string) (string, error) {
+	depth := 0
+	for _, elem := range strings.Split(name, "/") {
+		switch elem {
+		case "", ".":
+		case "..":
+			depth--
+			if depth < 0 {
+				return "", &os.PathError{Op: op, Path: name, Err: os.ErrPermission}
+			}
+		default:
+			depth++
+		}
+	}
+	return path.Join(fs.prefix, "/"+name), nil
+}
+
+// strip removes the prefix from p, if p is beneath it.
+func (fs *subStreamStore) strip(p string) string {
+	switch {
+	case fs.prefix == "/":
+		return p
+	case p == fs.prefix:
+		return "/"
+	case strings.HasPrefix(p, fs.prefix+"/"):
+		return p[len(fs.prefix):]
+	default:
+		return p
+	}
+}
+
+// subError is an error from the wrapped store with the prefix removed from
+// its message.
+type subError struct {
+	msg string
+	err error
+}
+
+func (e *subError) Error() string {
+	return e.msg
+}
+
+func (e *subError) Unwrap() error {
+	return e.err
+}
+
+// fixErr removes the prefix from any paths in err.  PathErrors stay
+// PathErrors, so os.IsNotExist and friends still work.
+func (fs *subStreamStore) fixErr(err error) error {
+	if err == nil || fs.prefix == "/" {
+		return err
+	}
+	if pe, ok := err.(*os.PathError); ok {
+		return &os.PathError{Op: pe.Op, Path: fs.strip(pe.Path), Err: pe.Err}
+	}
+	msg := err.Error()
+	fixed := strings.ReplaceAll(msg, fs.prefix+"/", "/")
+	if fixed == msg {
+		return err
+	}
+	return &subError{msg: fixed, err: err}
+}
+
+func (fs *subStreamStore) Close() error {
+	return fs.ss.Close()
+}
+
+func (fs *subStreamStore) Lstat(name string) (os.FileInfo, error) {
+	p, err := fs.resolve("lstat", name)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := fs.ss.Lstat(p)
+	return fi, fs.fixErr(err)
+}
+
+func (fs *subStreamStore) Stat(name string) (os.FileInfo, error) {
+	p, err := fs.resolve("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := fs.ss.Stat(p)
+	return fi, fs.fixErr(err)
+}
+
+func (fs *subStreamStore) Readdir(name string) ([]os.FileInfo, error) {
+	p, err := fs.resolve("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	fis, err := fs.ss.Readdir(p)
+	return fis, fs.fixErr(err)
+}
+
+func (fs *subStreamStore) OpenReadCloser(name string) (StrawReader, error) {
+	p, err := fs.resolve("open", name)
+	if err != nil {
+		return nil, err
+	}
+	r, err := fs.ss.OpenReadCloser(p)
+	return r, fs.fixErr(err)
+}
+
+func (fs *subStreamStore) CreateWriteCloser(name string) (StrawWriter, error) {
+	p, err := fs.resolve("open", name)
+	if err != nil {
+		return nil, err
+	}
+	w, err := fs.ss.CreateWriteCloser(p)
+	if err != nil {
+		return nil, fs.fixErr(err)
+	}
+	return &subWriter{w, fs}, nil
+}
+
+// subWriter fixes up errors from Close, which is when many backends report
+// failures.
+type subWriter struct {
+	StrawWriter
+	fs *subStreamStore
+}
+
+func (w *subWriter) Close() error {
+	return w.fs.fixErr(w.StrawWriter.Close())
+}
+
+func (fs *subStreamStore) Mkdir(name string, mode os.FileMode) error {
+	p, err := fs.resolve("mkdir", name)
+	if err != nil {
+		return err
+	}
+	return fs.fixErr(fs.ss.Mkdir(p, mode))
+}
+
+func (fs *subStreamStore) Remove(name string) error {
+	p, err := fs.resolve("remove", name)
+	if err != nil {
+		return err
+	}
+	if p == fs.prefix {
+		return fmt.Errorf("%s : cannot remove the root of a sub store", name)
+	}
+	return fs.fixErr(fs.ss.Remove(p))
+}
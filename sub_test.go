@@ -0,0 +1,156 @@
+package straw_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/uw-labs/straw"
+)
+
+func TestSubFS(t *testing.T) {
+	mem, _ := straw.Open("mem://")
+	if err := straw.MkdirAll(mem, "/tenants/a", 0755); err != nil {
+		t.Fatal(err)
+	}
+	ss := straw.Sub(mem, "/tenants/a")
+	testFS(t, "subfs", func() straw.StreamStore { return &TestLogStreamStore{t, ss} }, "/")
+}
+
+func TestSubOSFSFromURL(t *testing.T) {
+	dir := tempDir()
+	defer os.RemoveAll(dir)
+
+	osfs, err := straw.Open("file://" + dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testFS(t, "subosfs", func() straw.StreamStore { return &TestLogStreamStore{t, osfs} }, "/")
+}
+
+func TestSubPaths(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	mem, _ := straw.Open("mem://")
+	require.NoError(straw.MkdirAll(mem, "/tenants/a/dir", 0755))
+	require.NoError(straw.MkdirAll(mem, "/tenants/b", 0755))
+	w, err := mem.CreateWriteCloser("/tenants/b/secret")
+	require.NoError(err)
+	require.NoError(w.Close())
+
+	ss := straw.Sub(mem, "tenants/a/")
+
+	w, err = ss.CreateWriteCloser("/dir/file")
+	require.NoError(err)
+	require.NoError(writeAll(w, []byte("hello")))
+	require.NoError(w.Close())
+
+	// It lands beneath the prefix.
+	fi, err := mem.Stat("/tenants/a/dir/file")
+	require.NoError(err)
+	assert.Equal(int64(5), fi.Size())
+
+	// Relative paths and `..` that stay within the root are fine.
+	for _, name := range []string{"dir/file", "/dir/./file", "/dir/../dir/file", "other/../dir/file"} {
+		_, err := ss.Stat(name)
+		assert.NoError(err, name)
+	}
+
+	for _, name := range []string{"..", "../b/secret", "/../b/secret", "/dir/../../b/secret", "dir/../../b"} {
+		_, err := ss.Stat(name)
+		assert.True(os.IsPermission(err), name)
+		_, err = ss.OpenReadCloser(name)
+		assert.True(os.IsPermission(err), name)
+		_, err = ss.CreateWriteCloser(name)
+		assert.True(os.IsPermission(err), name)
+		assert.True(os.IsPermission(ss.Remove(name)), name)
+		assert.True(os.IsPermission(ss.Mkdir(name, 0755)), name)
+	}
+
+	fis, err := ss.Readdir("/")
+	require.NoError(err)
+	require.Equal(1, len(fis))
+	assert.Equal("dir", fis[0].Name())
+
+	assert.Error(ss.Remove("/"))
+}
+
+func TestSubFollowsSymlinks(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	dir := tempDir()
+	defer os.RemoveAll(dir)
+	require.NoError(os.Mkdir(filepath.Join(dir, "root"), 0755))
+	require.NoError(os.Mkdir(filepath.Join(dir, "outside"), 0755))
+	require.NoError(ioutil.WriteFile(filepath.Join(dir, "outside", "secret"), []byte("secret"), 0644))
+	require.NoError(os.Symlink(filepath.Join(dir, "outside"), filepath.Join(dir, "root", "link")))
+
+	ss, err := straw.Open("file://" + filepath.Join(dir, "root"))
+	require.NoError(err)
+	defer ss.Close()
+
+	// Paths are only checked lexically, so `..` is refused...
+	_, err = ss.Stat("/../outside/secret")
+	assert.True(os.IsPermission(err))
+
+	// ...but a symlink beneath the root is followed wherever it points.
+	fi, err := ss.Lstat("/link")
+	require.NoError(err)
+	assert.Equal(os.ModeSymlink, fi.Mode()&os.ModeSymlink)
+	r, err := ss.OpenReadCloser("/link/secret")
+	require.NoError(err)
+	all, err := ioutil.ReadAll(r)
+	require.NoError(err)
+	assert.Equal("secret", string(all))
+	require.NoError(r.Close())
+}
+
+func TestSubErrorsHidePrefix(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	dir := tempDir()
+	defer os.RemoveAll(dir)
+	require.NoError(os.Mkdir(filepath.Join(dir, "sub"), 0755))
+
+	ss, err := straw.Open("file://" + dir)
+	require.NoError(err)
+
+	_, err = ss.Stat("/missing")
+	assert.True(os.IsNotExist(err))
+	assert.Equal("stat /missing: no such file or directory", err.Error())
+
+	_, err = ss.OpenReadCloser("/sub")
+	assert.EqualError(err, "/sub is a directory")
+
+	for _, e := range []error{
+		ss.Mkdir("/sub", 0755),
+		ss.Mkdir("/missing/dir", 0755),
+	} {
+		require.Error(e)
+		assert.False(strings.Contains(e.Error(), dir), e.Error())
+	}
+}
+
+func TestSubURL(t *testing.T) {
+	require := require.New(t)
+
+	dir := tempDir()
+	defer os.RemoveAll(dir)
+	require.NoError(ioutil.WriteFile(filepath.Join(dir, "file"), []byte("hello"), 0644))
+
+	for _, u := range []string{"file://" + dir, "file://" + dir + "/"} {
+		ss, err := straw.Open(u)
+		require.NoError(err)
+		fis, err := ss.Readdir("/")
+		require.NoError(err)
+		require.Equal(1, len(fis), u)
+		require.Equal("file", fis[0].Name())
+	}
+}
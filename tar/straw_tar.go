@@ -0,0 +1,722 @@
+package tar
+
+import (
+	stdtar "archive/tar"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/uw-labs/straw"
+)
+
+var _ straw.StreamStore = &tarStreamStore{}
+
+// Compression formats, detected from the first bytes of the archive.
+const (
+	CompressionNone  = ""
+	CompressionGzip  = "gzip"
+	CompressionZstd  = "zstd"
+	CompressionBzip2 = "bzip2"
+)
+
+// DefaultBufferSize is the BufferSize used when none is given.
+const DefaultBufferSize = 4 << 20
+
+// Options configures a tar backed StreamStore.
+type Options struct {
+	// BufferSize is how much of the archive is read at once while indexing
+	// it and while decompressing it.  Headers, and the chunks the
+	// decompressors ask for, are small, so reading them one at a time would
+	// cost a request each on object stores.  Defaults to
+	// DefaultBufferSize.
+	BufferSize int
+}
+
+func init() {
+	straw.Register("tar", func(u *url.URL) (straw.StreamStore, error) {
+		// `tar:///path/to/shard.tar` reads a local archive, while
+		// `tar:///?archive=s3://bucket/shard.tar` reads it from another
+		// StreamStore.
+		q := u.Query()
+		var opts Options
+		if v := q.Get("buffer_size"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n <= 0 {
+				return nil, fmt.Errorf("invalid %q query parameter: %q", "buffer_size", v)
+			}
+			opts.BufferSize = n
+		}
+		archive := q.Get("archive")
+		if archive == "" {
+			archive = (&url.URL{Scheme: "file", Path: u.Path}).String()
+		}
+		au, err := url.Parse(archive)
+		if err != nil {
+			return nil, err
+		}
+		name := au.Path
+		au.Path, au.RawPath = "", ""
+		ss, err := straw.Open(au.String())
+		if err != nil {
+			return nil, err
+		}
+		ts, err := openTarStreamStore(ss, name, opts)
+		if err != nil {
+			ss.Close()
+			return nil, err
+		}
+		ts.closers = append(ts.closers, ss)
+		return ts, nil
+	})
+}
+
+// NewStreamStore returns a read only StreamStore presenting the contents of
+// the tar archive in r, which is size bytes long and may be compressed with
+// gzip, zstd or bzip2.  Closing the returned StreamStore does not close r.
+func NewStreamStore(r io.ReaderAt, size int64, opts Options) (straw.StreamStore, error) {
+	return newTarStreamStore(r, size, opts)
+}
+
+// OpenStreamStore opens the archive name in ss, for example a tar shard on
+// s3, and returns a read only StreamStore presenting its contents.  Closing
+// the returned StreamStore closes the archive, but not ss.
+func OpenStreamStore(ss straw.StreamStore, name string, opts Options) (straw.StreamStore, error) {
+	return openTarStreamStore(ss, name, opts)
+}
+
+func openTarStreamStore(ss straw.StreamStore, name string, opts Options) (*tarStreamStore, error) {
+	fi, err := ss.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	if fi.IsDir() {
+		return nil, fmt.Errorf("%s is a directory", name)
+	}
+	r, err := ss.OpenReadCloser(name)
+	if err != nil {
+		return nil, err
+	}
+	ts, err := newTarStreamStore(r, fi.Size(), opts)
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	ts.closers = append(ts.closers, r)
+	return ts, nil
+}
+
+func newTarStreamStore(r io.ReaderAt, size int64, opts Options) (*tarStreamStore, error) {
+	if opts.BufferSize <= 0 {
+		opts.BufferSize = DefaultBufferSize
+	}
+	fs := &tarStreamStore{
+		r:          r,
+		size:       size,
+		bufferSize: opts.BufferSize,
+		entries:    map[string]*tarEntry{"/": {name: "/", isDir: true, children: map[string]*tarEntry{}}},
+	}
+
+	var magic [4]byte
+	n, err := r.ReadAt(magic[:], 0)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	fs.compression = detectCompression(magic[:n])
+
+	if err := fs.index(); err != nil {
+		return nil, err
+	}
+	return fs, nil
+}
+
+func detectCompression(magic []byte) string {
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		return CompressionGzip
+	case bytes.HasPrefix(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		return CompressionZstd
+	case bytes.HasPrefix(magic, []byte("BZh")):
+		return CompressionBzip2
+	default:
+		return CompressionNone
+	}
+}
+
+type tarStreamStore struct {
+	r           io.ReaderAt
+	size        int64
+	bufferSize  int
+	compression string
+	entries     map[string]*tarEntry
+
+	// closers are closed along with the StreamStore, when it opened the
+	// archive itself.
+	closers []io.Closer
+}
+
+// tarEntry is a file, directory or symlink in the archive.  Directories are
+// also created for any parents that have no entry of their own.
+type tarEntry struct {
+	name    string
+	isDir   bool
+	modTime time.Time
+	mode    os.FileMode
+
+	// offset is where the file's data starts in the uncompressed archive.
+	offset int64
+	size   int64
+	// sparse files can only be read through archive/tar, which is not
+	// supported.
+	sparse bool
+
+	// symlink is the clean absolute target of a symlink.
+	symlink string
+
+	children map[string]*tarEntry
+}
+
+// bufferedReader reads the archive sequentially through a buffer, so that
+// small reads turn into a few large ReadAt calls.  Seeking within what is
+// buffered does not read again, and seeking past it reads nothing until the
+// next Read.
+type bufferedReader struct {
+	r    io.ReaderAt
+	size int64
+
+	buf []byte
+	// buf[:n] holds the archive from start.
+	start int64
+	n     int
+	pos   int64
+}
+
+func (fs *tarStreamStore) newBufferedReader() *bufferedReader {
+	return &bufferedReader{r: fs.r, size: fs.size, buf: make([]byte, fs.bufferSize)}
+}
+
+func (b *bufferedReader) Read(p []byte) (int, error) {
+	if b.pos >= b.size {
+		return 0, io.EOF
+	}
+	if b.pos < b.start || b.pos >= b.start+int64(b.n) {
+		want := len(b.buf)
+		if rest := b.size - b.pos; rest < int64(want) {
+			want = int(rest)
+		}
+		n, err := b.r.ReadAt(b.buf[:want], b.pos)
+		b.start, b.n = b.pos, n
+		if n == 0 {
+			if err == nil {
+				err = io.ErrNoProgress
+			}
+			return 0, err
+		}
+	}
+	n := copy(p, b.buf[b.pos-b.start:b.n])
+	b.pos += int64(n)
+	return n, nil
+}
+
+func (b *bufferedReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += b.pos
+	case io.SeekEnd:
+		offset += b.size
+	default:
+		return 0, fmt.Errorf("invalid whence %d", whence)
+	}
+	if offset < 0 {
+		return 0, errors.New("invalid seek position")
+	}
+	b.pos = offset
+	return offset, nil
+}
+
+// stream returns the uncompressed archive from its start.
+func (fs *tarStreamStore) stream() (io.ReadCloser, error) {
+	sr := fs.newBufferedReader()
+	switch fs.compression {
+	case CompressionGzip:
+		return gzip.NewReader(sr)
+	case CompressionZstd:
+		d, err := zstd.NewReader(sr, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	case CompressionBzip2:
+		return ioutil.NopCloser(bzip2.NewReader(sr)), nil
+	default:
+		return ioutil.NopCloser(sr), nil
+	}
+}
+
+// countingReader tracks how far into the uncompressed archive archive/tar
+// has read, which after Next is where the entry's data starts.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(buf []byte) (int, error) {
+	n, err := c.r.Read(buf)
+	c.n += int64(n)
+	return n, err
+}
+
+// index reads every header in the archive.  For uncompressed archives the
+// data between headers is seeked over rather than read.
+func (fs *tarStreamStore) index() error {
+	var tr *stdtar.Reader
+	var offset func() int64
+
+	if fs.compression == CompressionNone {
+		sr := fs.newBufferedReader()
+		tr = stdtar.NewReader(sr)
+		offset = func() int64 {
+			n, _ := sr.Seek(0, io.SeekCurrent)
+			return n
+		}
+	} else {
+		rc, err := fs.stream()
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+		cr := &countingReader{r: rc}
+		tr = stdtar.NewReader(cr)
+		offset = func() int64 { return cr.n }
+	}
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		p := path.Clean("/" + hdr.Name)
+		if p == "/" {
+			continue
+		}
+
+		var e *tarEntry
+		switch hdr.Typeflag {
+		case stdtar.TypeDir:
+			if e, err = fs.add(p, true); err != nil {
+				return err
+			}
+		case stdtar.TypeReg, stdtar.TypeRegA, stdtar.TypeGNUSparse:
+			if e, err = fs.add(p, false); err != nil {
+				return err
+			}
+			e.offset, e.size, e.symlink = offset(), hdr.Size, ""
+			e.sparse = hdr.Typeflag == stdtar.TypeGNUSparse || hdr.PAXRecords["GNU.sparse.map"] != "" || hdr.PAXRecords["GNU.sparse.major"] != ""
+		case stdtar.TypeLink:
+			target, ok := fs.entries[path.Clean("/"+hdr.Linkname)]
+			if !ok || target.isDir {
+				return fmt.Errorf("tar entry %s links to missing file %s", hdr.Name, hdr.Linkname)
+			}
+			if e, err = fs.add(p, false); err != nil {
+				return err
+			}
+			e.offset, e.size, e.sparse, e.symlink = target.offset, target.size, target.sparse, target.symlink
+		case stdtar.TypeSymlink:
+			if e, err = fs.add(p, false); err != nil {
+				return err
+			}
+			target := hdr.Linkname
+			if !path.IsAbs(target) {
+				target = path.Join(path.Dir(p), target)
+			}
+			e.symlink = path.Clean(target)
+			e.size = int64(len(hdr.Linkname))
+		default:
+			// Devices, fifos and the like have no place in a StreamStore.
+			continue
+		}
+		if e.isDir != (hdr.Typeflag == stdtar.TypeDir) {
+			return fmt.Errorf("tar entry %s is both a file and a directory", hdr.Name)
+		}
+		e.modTime = hdr.ModTime
+		e.mode = hdr.FileInfo().Mode()
+	}
+}
+
+// add returns the entry for p, creating it and any missing parent
+// directories.
+func (fs *tarStreamStore) add(p string, isDir bool) (*tarEntry, error) {
+	if e, ok := fs.entries[p]; ok {
+		return e, nil
+	}
+	parent, err := fs.add(path.Dir(p), true)
+	if err != nil {
+		return nil, err
+	}
+	if !parent.isDir {
+		return nil, fmt.Errorf("tar entry %s is both a file and a directory", path.Dir(p))
+	}
+	e := &tarEntry{name: path.Base(p), isDir: isDir}
+	if isDir {
+		e.children = map[string]*tarEntry{}
+	}
+	parent.children[e.name] = e
+	fs.entries[p] = e
+	return e, nil
+}
+
+// maxSymlinks is how many symlinks are followed before giving up, as with
+// ELOOP.
+const maxSymlinks = 40
+
+// lookup returns the entry for name, following symlinks if follow is set.
+func (fs *tarStreamStore) lookup(op, name string, follow bool) (*tarEntry, error) {
+	p := path.Clean("/" + name)
+	for i := 0; ; i++ {
+		e, ok := fs.entries[p]
+		if !ok {
+			return nil, &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+		}
+		if e.symlink == "" || !follow {
+			return e, nil
+		}
+		if i == maxSymlinks {
+			return nil, &os.PathError{Op: op, Path: name, Err: errors.New("too many levels of symbolic links")}
+		}
+		p = e.symlink
+	}
+}
+
+func (fs *tarStreamStore) Close() error {
+	var err error
+	for _, c := range fs.closers {
+		if e := c.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+func (fs *tarStreamStore) Lstat(name string) (os.FileInfo, error) {
+	e, err := fs.lookup("lstat", name, false)
+	if err != nil {
+		return nil, err
+	}
+	return e.info(path.Base(path.Clean("/" + name))), nil
+}
+
+func (fs *tarStreamStore) Stat(name string) (os.FileInfo, error) {
+	e, err := fs.lookup("stat", name, true)
+	if err != nil {
+		return nil, err
+	}
+	return e.info(path.Base(path.Clean("/" + name))), nil
+}
+
+func (e *tarEntry) info(name string) os.FileInfo {
+	sr := &tarStatResult{name: name, isDir: e.isDir, modTime: e.modTime, size: e.size, mode: e.mode}
+	if e.isDir {
+		sr.size = 4096
+		if sr.mode == 0 {
+			sr.mode = os.ModeDir | 0555
+		}
+	}
+	return sr
+}
+
+type tarStatResult struct {
+	name    string
+	isDir   bool
+	modTime time.Time
+	size    int64
+	mode    os.FileMode
+}
+
+func (sr *tarStatResult) Name() string {
+	return sr.name
+}
+
+func (sr *tarStatResult) IsDir() bool {
+	return sr.isDir
+}
+
+func (sr *tarStatResult) Size() int64 {
+	return sr.size
+}
+
+func (sr *tarStatResult) ModTime() time.Time {
+	return sr.modTime
+}
+
+func (sr *tarStatResult) Mode() os.FileMode {
+	return sr.mode
+}
+
+func (sr *tarStatResult) Sys() interface{} {
+	return nil
+}
+
+func (fs *tarStreamStore) Readdir(name string) ([]os.FileInfo, error) {
+	e, err := fs.lookup("readdir", name, true)
+	if err != nil {
+		return nil, err
+	}
+	if !e.isDir {
+		return nil, fmt.Errorf("%s not a directory", name)
+	}
+
+	results := make([]os.FileInfo, 0, len(e.children))
+	for n, c := range e.children {
+		results = append(results, c.info(n))
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].Name() < results[j].Name() })
+	return results, nil
+}
+
+// OpenReadCloser reads uncompressed archives in place, so entries seek and
+// ReadAt by delegating to the underlying reader.  Entries in compressed
+// archives are read by decompressing from the start of the archive, and
+// seeking backwards starts the decompression again.
+func (fs *tarStreamStore) OpenReadCloser(name string) (straw.StrawReader, error) {
+	e, err := fs.lookup("open", name, true)
+	if err != nil {
+		return nil, err
+	}
+	if e.isDir {
+		return nil, fmt.Errorf("%s is a directory", name)
+	}
+	if e.sparse {
+		return nil, fmt.Errorf("%s is a sparse file, which is not supported", name)
+	}
+
+	fi := e.info(path.Base(path.Clean("/" + name)))
+	if fs.compression == CompressionNone {
+		return &sectionReader{io.NewSectionReader(fs.r, e.offset, e.size), fi}, nil
+	}
+
+	r := &streamReader{fs: fs, e: e, fi: fi}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+type sectionReader struct {
+	*io.SectionReader
+	fi os.FileInfo
+}
+
+// Stat returns the FileInfo from the archive's index.
+func (r *sectionReader) Stat() (os.FileInfo, error) {
+	return r.fi, nil
+}
+
+func (r *sectionReader) Close() error {
+	return nil
+}
+
+type streamReader struct {
+	fs *tarStreamStore
+	e  *tarEntry
+
+	// rc is positioned at pos within the entry, while seek is where the
+	// next Read should start from.
+	rc     io.ReadCloser
+	data   io.Reader
+	pos    int64
+	seek   int64
+	closed bool
+
+	// idle is a stream left behind by ReadAt, which the next ReadAt at or
+	// after its position carries on from rather than decompressing from
+	// the start again.
+	lk   sync.Mutex
+	idle *dataStream
+
+	fi os.FileInfo
+}
+
+// dataStream is a stream of an entry's data, at pos within it.
+type dataStream struct {
+	rc   io.ReadCloser
+	data io.Reader
+	pos  int64
+}
+
+// entryStream returns a fresh stream positioned at the start of e's data.
+func (fs *tarStreamStore) entryStream(e *tarEntry) (io.ReadCloser, io.Reader, error) {
+	rc, err := fs.stream()
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err := io.CopyN(ioutil.Discard, rc, e.offset); err != nil {
+		rc.Close()
+		return nil, nil, err
+	}
+	return rc, io.LimitReader(rc, e.size), nil
+}
+
+func (r *streamReader) open() error {
+	rc, data, err := r.fs.entryStream(r.e)
+	if err != nil {
+		return err
+	}
+	if r.rc != nil {
+		_ = r.rc.Close()
+	}
+	r.rc, r.data, r.pos = rc, data, 0
+	return nil
+}
+
+// Stat returns the FileInfo from the archive's index.
+func (r *streamReader) Stat() (os.FileInfo, error) {
+	return r.fi, nil
+}
+
+func (r *streamReader) Seek(offset int64, whence int) (int64, error) {
+	var abs int64
+	switch whence {
+	case io.SeekStart:
+		abs = offset
+	case io.SeekCurrent:
+		abs = r.seek + offset
+	case io.SeekEnd:
+		abs = r.e.size + offset
+	default:
+		return 0, fmt.Errorf("invalid whence %d", whence)
+	}
+	if abs < 0 {
+		return 0, errors.New("invalid seek position")
+	}
+	r.seek = abs
+	return abs, nil
+}
+
+func (r *streamReader) Read(buf []byte) (int, error) {
+	if r.closed {
+		return 0, os.ErrClosed
+	}
+	if r.seek != r.pos {
+		if r.seek < r.pos {
+			if err := r.open(); err != nil {
+				return 0, err
+			}
+		}
+		n, err := io.CopyN(ioutil.Discard, r.data, r.seek-r.pos)
+		r.pos += n
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := r.data.Read(buf)
+	r.pos += int64(n)
+	r.seek = r.pos
+	return n, err
+}
+
+// ReadAt decompresses into buf from a stream of its own, so it does not
+// disturb Read and is safe to call concurrently.  Reading forwards through
+// an entry with ReadAt decompresses it only once.
+func (r *streamReader) ReadAt(buf []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("invalid offset")
+	}
+	if off >= r.e.size {
+		return 0, io.EOF
+	}
+
+	r.lk.Lock()
+	ds := r.idle
+	if ds != nil && ds.pos <= off {
+		r.idle = nil
+	} else {
+		ds = nil
+	}
+	r.lk.Unlock()
+	if ds == nil {
+		rc, data, err := r.fs.entryStream(r.e)
+		if err != nil {
+			return 0, err
+		}
+		ds = &dataStream{rc: rc, data: data}
+	}
+
+	skipped, err := io.CopyN(ioutil.Discard, ds.data, off-ds.pos)
+	ds.pos += skipped
+	if err != nil {
+		ds.rc.Close()
+		return 0, err
+	}
+	n, err := io.ReadFull(ds.data, buf)
+	ds.pos += int64(n)
+	if err != nil {
+		ds.rc.Close()
+		if err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
+		return n, err
+	}
+	r.keep(ds)
+	return n, nil
+}
+
+// keep makes ds the idle stream, closing the one it replaces.
+func (r *streamReader) keep(ds *dataStream) {
+	r.lk.Lock()
+	old := r.idle
+	if r.closed {
+		old = ds
+	} else {
+		r.idle = ds
+	}
+	r.lk.Unlock()
+	if old != nil {
+		old.rc.Close()
+	}
+}
+
+func (r *streamReader) Close() error {
+	r.lk.Lock()
+	if r.closed {
+		r.lk.Unlock()
+		return nil
+	}
+	r.closed = true
+	idle := r.idle
+	r.idle = nil
+	r.lk.Unlock()
+
+	if idle != nil {
+		idle.rc.Close()
+	}
+	return r.rc.Close()
+}
+
+func (fs *tarStreamStore) Mkdir(name string, mode os.FileMode) error {
+	return &os.PathError{Op: "mkdir", Path: name, Err: os.ErrPermission}
+}
+
+func (fs *tarStreamStore) Remove(name string) error {
+	return &os.PathError{Op: "remove", Path: name, Err: os.ErrPermission}
+}
+
+func (fs *tarStreamStore) CreateWriteCloser(name string) (straw.StrawWriter, error) {
+	return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrPermission}
+}
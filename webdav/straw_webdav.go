@@ -0,0 +1,452 @@
+package webdav
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/uw-labs/straw"
+	"github.com/uw-labs/straw/internal/httpio"
+)
+
+var _ straw.StreamStore = &webdavStreamStore{}
+
+func init() {
+	open := func(u *url.URL) (straw.StreamStore, error) {
+		opts, err := optionsFromURL(u)
+		if err != nil {
+			return nil, err
+		}
+		base := *u
+		base.RawQuery = ""
+		base.User = nil
+		if u.Scheme == "webdavs" {
+			base.Scheme = "https"
+		} else {
+			base.Scheme = "http"
+		}
+		return newWebdavStreamStore(base.String(), opts)
+	}
+	straw.Register("webdav", open)
+	straw.Register("webdavs", open)
+}
+
+// Options configures a WebDAV backed StreamStore.
+type Options struct {
+	// Client is used for all requests.  Defaults to http.DefaultClient.
+	Client *http.Client
+	// Username and Password are sent as basic auth with every request.
+	Username string
+	Password string
+	// BearerToken is sent in an `Authorization: Bearer` header with every
+	// request.  It takes precedence over Username and Password.
+	BearerToken string
+}
+
+// NewStreamStore returns a StreamStore rooted at baseURL, which must be an
+// http or https URL.
+func NewStreamStore(baseURL string, opts Options) (straw.StreamStore, error) {
+	return newWebdavStreamStore(baseURL, opts)
+}
+
+// optionsFromURL takes basic auth credentials from the URL's user info.
+// Bearer tokens are never taken from the URL itself, instead `token_file`
+// or `token_env` name a file or environment variable holding the token.
+func optionsFromURL(u *url.URL) (Options, error) {
+	var opts Options
+	if u.User != nil {
+		opts.Username = u.User.Username()
+		opts.Password, _ = u.User.Password()
+	}
+
+	q := u.Query()
+	tokenFile, tokenEnv := q.Get("token_file"), q.Get("token_env")
+	switch {
+	case tokenFile != "" && tokenEnv != "":
+		return Options{}, errors.New("only one of `token_file` and `token_env` may be set")
+	case tokenFile != "":
+		data, err := ioutil.ReadFile(tokenFile)
+		if err != nil {
+			return Options{}, fmt.Errorf("failed to read bearer token: %w", err)
+		}
+		opts.BearerToken = strings.TrimSpace(string(data))
+	case tokenEnv != "":
+		token, ok := os.LookupEnv(tokenEnv)
+		if !ok {
+			return Options{}, fmt.Errorf("bearer token environment variable %s is not set", tokenEnv)
+		}
+		opts.BearerToken = strings.TrimSpace(token)
+	}
+	return opts, nil
+}
+
+func newWebdavStreamStore(baseURL string, opts Options) (*webdavStreamStore, error) {
+	base, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, err
+	}
+	if base.Scheme != "http" && base.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported url scheme %q", base.Scheme)
+	}
+	base.Path = strings.TrimSuffix(base.Path, "/")
+	base.RawPath = ""
+
+	if opts.Client == nil {
+		opts.Client = http.DefaultClient
+	}
+
+	return &webdavStreamStore{
+		base:        base,
+		client:      opts.Client,
+		username:    opts.Username,
+		password:    opts.Password,
+		bearerToken: opts.BearerToken,
+	}, nil
+}
+
+type webdavStreamStore struct {
+	base        *url.URL
+	client      *http.Client
+	username    string
+	password    string
+	bearerToken string
+}
+
+func (fs *webdavStreamStore) Close() error {
+	return nil
+}
+
+// cleanPath returns name as a clean absolute path, with "" for the root.
+func (fs *webdavStreamStore) cleanPath(name string) string {
+	p := path.Clean("/" + name)
+	if p == "/" {
+		return ""
+	}
+	return p
+}
+
+// urlFor returns the URL for name, relative to the base URL.  Collections
+// are addressed with a trailing slash, which some servers insist on.
+func (fs *webdavStreamStore) urlFor(name string, dir bool) *url.URL {
+	u := *fs.base
+	u.Path = fs.base.Path + fs.cleanPath(name)
+	if dir {
+		u.Path += "/"
+	}
+	return &u
+}
+
+func (fs *webdavStreamStore) do(method string, u *url.URL, header http.Header, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	switch {
+	case fs.bearerToken != "":
+		req.Header.Set("Authorization", "Bearer "+fs.bearerToken)
+	case fs.username != "" || fs.password != "":
+		req.SetBasicAuth(fs.username, fs.password)
+	}
+	return fs.client.Do(req)
+}
+
+// doNoBody is do for requests without a body.
+func (fs *webdavStreamStore) doNoBody(method string, u *url.URL, header http.Header) (*http.Response, error) {
+	return fs.do(method, u, header, nil)
+}
+
+const propfindBody = `<?xml version="1.0" encoding="utf-8"?>
+<D:propfind xmlns:D="DAV:"><D:prop><D:resourcetype/><D:getcontentlength/><D:getlastmodified/></D:prop></D:propfind>`
+
+type multistatus struct {
+	Responses []davResponse `xml:"DAV: response"`
+}
+
+type davResponse struct {
+	Href      string        `xml:"DAV: href"`
+	Propstats []davPropstat `xml:"DAV: propstat"`
+}
+
+type davPropstat struct {
+	Status string  `xml:"DAV: status"`
+	Prop   davProp `xml:"DAV: prop"`
+}
+
+type davProp struct {
+	ResourceType struct {
+		Collection *struct{} `xml:"DAV: collection"`
+	} `xml:"DAV: resourcetype"`
+	ContentLength string `xml:"DAV: getcontentlength"`
+	LastModified  string `xml:"DAV: getlastmodified"`
+}
+
+// propfind returns the parsed responses for name at the given depth, keyed
+// by their clean, unescaped path relative to the base URL.
+func (fs *webdavStreamStore) propfind(op, name string, depth int) (map[string]*webdavStatResult, error) {
+	header := http.Header{
+		"Depth":        {strconv.Itoa(depth)},
+		"Content-Type": {"application/xml; charset=utf-8"},
+	}
+	resp, err := fs.do("PROPFIND", fs.urlFor(name, depth > 0), header, strings.NewReader(propfindBody))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusMultiStatus {
+		return nil, httpio.StatusError(op, name, resp)
+	}
+
+	var ms multistatus
+	if err := xml.NewDecoder(resp.Body).Decode(&ms); err != nil {
+		return nil, fmt.Errorf("failed to parse PROPFIND response for %s: %w", name, err)
+	}
+
+	results := make(map[string]*webdavStatResult, len(ms.Responses))
+	for _, r := range ms.Responses {
+		href, err := url.Parse(strings.TrimSpace(r.Href))
+		if err != nil {
+			return nil, fmt.Errorf("invalid href %q in PROPFIND response: %w", r.Href, err)
+		}
+		p := path.Clean("/" + href.Path)
+		if p != fs.base.Path && !strings.HasPrefix(p, fs.base.Path+"/") {
+			continue
+		}
+		p = strings.TrimPrefix(p, fs.base.Path)
+
+		sr := &webdavStatResult{name: path.Base(p)}
+		if p == "" || p == "/" {
+			p = ""
+			sr.name = "/"
+		}
+		for _, ps := range r.Propstats {
+			if !strings.Contains(ps.Status, " 200 ") {
+				continue
+			}
+			if ps.Prop.ResourceType.Collection != nil {
+				sr.isDir = true
+				sr.size = 4096
+			}
+			if ps.Prop.ContentLength != "" && !sr.isDir {
+				sr.size, _ = strconv.ParseInt(ps.Prop.ContentLength, 10, 64)
+			}
+			if ps.Prop.LastModified != "" {
+				sr.modTime, _ = http.ParseTime(ps.Prop.LastModified)
+			}
+		}
+		results[p] = sr
+	}
+	return results, nil
+}
+
+func (fs *webdavStreamStore) Lstat(name string) (os.FileInfo, error) {
+	// WebDAV does not expose symlinks
+	return fs.Stat(name)
+}
+
+func (fs *webdavStreamStore) Stat(name string) (os.FileInfo, error) {
+	results, err := fs.propfind("stat", name, 0)
+	if err != nil {
+		return nil, err
+	}
+	sr, ok := results[fs.cleanPath(name)]
+	if !ok {
+		return nil, fmt.Errorf("no PROPFIND response for %s", name)
+	}
+	return sr, nil
+}
+
+type webdavStatResult struct {
+	name    string
+	isDir   bool
+	modTime time.Time
+	size    int64
+}
+
+func (sr *webdavStatResult) Name() string {
+	return sr.name
+}
+
+func (sr *webdavStatResult) IsDir() bool {
+	return sr.isDir
+}
+
+func (sr *webdavStatResult) Size() int64 {
+	return sr.size
+}
+
+func (sr *webdavStatResult) ModTime() time.Time {
+	return sr.modTime
+}
+
+func (sr *webdavStatResult) Mode() os.FileMode {
+	if sr.IsDir() {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}
+
+func (sr *webdavStatResult) Sys() interface{} {
+	return nil
+}
+
+func (fs *webdavStreamStore) Readdir(name string) ([]os.FileInfo, error) {
+	results, err := fs.propfind("readdir", name, 1)
+	if err != nil {
+		return nil, err
+	}
+	self := fs.cleanPath(name)
+	if sr, ok := results[self]; ok && !sr.isDir {
+		return nil, fmt.Errorf("%s not a directory", name)
+	}
+
+	var fis []os.FileInfo
+	for p, sr := range results {
+		if p == self || path.Dir(p) != path.Clean("/"+self) {
+			continue
+		}
+		fis = append(fis, sr)
+	}
+	sort.Slice(fis, func(i, j int) bool { return fis[i].Name() < fis[j].Name() })
+	return fis, nil
+}
+
+// OpenReadCloser issues a GET for name.  Servers refuse GET on a
+// collection in different ways, so any failure other than a missing file
+// is followed by a Stat to see whether name is a directory.
+func (fs *webdavStreamStore) OpenReadCloser(name string) (straw.StrawReader, error) {
+	p := fs.cleanPath(name)
+	if p == "" {
+		return nil, fmt.Errorf("%s is a directory", name)
+	}
+
+	u := fs.urlFor(name, false)
+	resp, err := fs.do(http.MethodGet, u, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		if fi, serr := fs.Stat(name); serr == nil && fi.IsDir() {
+			return nil, fmt.Errorf("%s is a directory", name)
+		}
+		return nil, httpio.StatusError("open", name, resp)
+	}
+
+	fi := &webdavStatResult{name: path.Base(p)}
+	if resp.ContentLength > 0 {
+		fi.size = resp.ContentLength
+	}
+	if lm := resp.Header.Get("Last-Modified"); lm != "" {
+		fi.modTime, _ = http.ParseTime(lm)
+	}
+	return httpio.NewReader(fs.doNoBody, "webdav", name, u, resp.Body, fi), nil
+}
+
+func (fs *webdavStreamStore) checkParentDir(child string) error {
+	d := path.Dir(path.Clean("/" + child))
+	if d != "/" {
+		fi, err := fs.Stat(d)
+		if err != nil {
+			return err
+		}
+		if !fi.IsDir() {
+			return fmt.Errorf("%s not a directory", d)
+		}
+	}
+	return nil
+}
+
+// Mkdir checks the parent and target itself before issuing MKCOL, since
+// servers report those cases with differing status codes.
+func (fs *webdavStreamStore) Mkdir(name string, mode os.FileMode) error {
+	if err := fs.checkParentDir(name); err != nil {
+		return err
+	}
+
+	if _, err := fs.Stat(name); err == nil {
+		return fmt.Errorf("%s : file exists", name)
+	}
+
+	resp, err := fs.do("MKCOL", fs.urlFor(name, true), nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusCreated, http.StatusOK, http.StatusNoContent:
+		return nil
+	case http.StatusMethodNotAllowed:
+		return fmt.Errorf("%s : file exists", name)
+	case http.StatusConflict:
+		return &os.PathError{Op: "mkdir", Path: name, Err: os.ErrNotExist}
+	default:
+		return httpio.StatusError("mkdir", name, resp)
+	}
+}
+
+func (fs *webdavStreamStore) Remove(name string) error {
+	fi, err := fs.Stat(name)
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		files, err := fs.Readdir(name)
+		if err != nil {
+			return err
+		}
+		if len(files) != 0 {
+			return fmt.Errorf("%s : directory not empty", name)
+		}
+	}
+
+	resp, err := fs.do(http.MethodDelete, fs.urlFor(name, fi.IsDir()), nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNoContent, http.StatusAccepted:
+		return nil
+	default:
+		return httpio.StatusError("remove", name, resp)
+	}
+}
+
+// CreateWriteCloser streams the data to a single PUT request, which
+// completes when the writer is closed.
+func (fs *webdavStreamStore) CreateWriteCloser(name string) (straw.StrawWriter, error) {
+	if err := fs.checkParentDir(name); err != nil {
+		return nil, err
+	}
+
+	if fi, err := fs.Stat(name); err == nil && fi.IsDir() {
+		return nil, fmt.Errorf("%s is a directory", name)
+	}
+
+	return httpio.NewUploader(func(body io.Reader) error {
+		resp, err := fs.do(http.MethodPut, fs.urlFor(name, false), nil, body)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		switch resp.StatusCode {
+		case http.StatusOK, http.StatusCreated, http.StatusNoContent:
+			return nil
+		default:
+			return httpio.StatusError("write", name, resp)
+		}
+	}), nil
+}
@@ -0,0 +1,359 @@
+package zip
+
+import (
+	stdzip "archive/zip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/uw-labs/straw"
+)
+
+var _ straw.StreamStore = &zipStreamStore{}
+
+func init() {
+	straw.Register("zip", func(u *url.URL) (straw.StreamStore, error) {
+		f, err := os.Open(u.Path)
+		if err != nil {
+			return nil, err
+		}
+		fi, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		ss, err := newZipStreamStore(f, fi.Size())
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		ss.closer = f
+		return ss, nil
+	})
+}
+
+// NewStreamStore returns a read only StreamStore presenting the contents of
+// the zip archive in r, which is size bytes long.  Any straw.StrawReader
+// will do for r, so archives held in any other StreamStore can be read
+// without first being copied.  Closing the returned StreamStore does not
+// close r.
+func NewStreamStore(r io.ReaderAt, size int64) (straw.StreamStore, error) {
+	return newZipStreamStore(r, size)
+}
+
+func newZipStreamStore(r io.ReaderAt, size int64) (*zipStreamStore, error) {
+	zr, err := stdzip.NewReader(r, size)
+	if err != nil {
+		return nil, err
+	}
+
+	fs := &zipStreamStore{
+		r:       r,
+		entries: map[string]*zipEntry{"/": {name: "/", isDir: true, children: map[string]*zipEntry{}}},
+	}
+	for _, f := range zr.File {
+		p := path.Clean("/" + f.Name)
+		if p == "/" {
+			continue
+		}
+		isDir := strings.HasSuffix(f.Name, "/")
+		e, err := fs.add(p, isDir)
+		if err == nil && e.isDir != isDir {
+			err = fmt.Errorf("zip entry %s is both a file and a directory", f.Name)
+		}
+		if err != nil {
+			return nil, err
+		}
+		e.modTime = f.Modified
+		if !isDir {
+			e.file = f
+		}
+	}
+	return fs, nil
+}
+
+type zipStreamStore struct {
+	r       io.ReaderAt
+	entries map[string]*zipEntry
+	// closer is the archive file opened for a `zip://` URL.
+	closer io.Closer
+}
+
+// zipEntry is a file or directory in the archive.  Directories are also
+// created for any parents that have no entry of their own.
+type zipEntry struct {
+	name     string
+	isDir    bool
+	modTime  time.Time
+	file     *stdzip.File
+	children map[string]*zipEntry
+}
+
+// add returns the entry for p, creating it and any missing parent
+// directories.
+func (fs *zipStreamStore) add(p string, isDir bool) (*zipEntry, error) {
+	if e, ok := fs.entries[p]; ok {
+		return e, nil
+	}
+	parent, err := fs.add(path.Dir(p), true)
+	if err != nil {
+		return nil, err
+	}
+	if !parent.isDir {
+		return nil, fmt.Errorf("zip entry %s is both a file and a directory", path.Dir(p))
+	}
+	e := &zipEntry{name: path.Base(p), isDir: isDir}
+	if isDir {
+		e.children = map[string]*zipEntry{}
+	}
+	parent.children[e.name] = e
+	fs.entries[p] = e
+	return e, nil
+}
+
+func (fs *zipStreamStore) lookup(op, name string) (*zipEntry, error) {
+	e, ok := fs.entries[path.Clean("/"+name)]
+	if !ok {
+		return nil, &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+	}
+	return e, nil
+}
+
+func (fs *zipStreamStore) Close() error {
+	if fs.closer != nil {
+		return fs.closer.Close()
+	}
+	return nil
+}
+
+func (fs *zipStreamStore) Lstat(name string) (os.FileInfo, error) {
+	return fs.Stat(name)
+}
+
+func (fs *zipStreamStore) Stat(name string) (os.FileInfo, error) {
+	e, err := fs.lookup("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return e.info(), nil
+}
+
+func (e *zipEntry) info() os.FileInfo {
+	sr := &zipStatResult{name: e.name, isDir: e.isDir, modTime: e.modTime, size: 4096}
+	if e.file != nil {
+		sr.size = int64(e.file.UncompressedSize64)
+	}
+	return sr
+}
+
+type zipStatResult struct {
+	name    string
+	isDir   bool
+	modTime time.Time
+	size    int64
+}
+
+func (sr *zipStatResult) Name() string {
+	return sr.name
+}
+
+func (sr *zipStatResult) IsDir() bool {
+	return sr.isDir
+}
+
+func (sr *zipStatResult) Size() int64 {
+	return sr.size
+}
+
+func (sr *zipStatResult) ModTime() time.Time {
+	return sr.modTime
+}
+
+func (sr *zipStatResult) Mode() os.FileMode {
+	if sr.IsDir() {
+		return os.ModeDir | 0555
+	}
+	return 0444
+}
+
+func (sr *zipStatResult) Sys() interface{} {
+	return nil
+}
+
+func (fs *zipStreamStore) Readdir(name string) ([]os.FileInfo, error) {
+	e, err := fs.lookup("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	if !e.isDir {
+		return nil, fmt.Errorf("%s not a directory", name)
+	}
+
+	results := make([]os.FileInfo, 0, len(e.children))
+	for _, c := range e.children {
+		results = append(results, c.info())
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].Name() < results[j].Name() })
+	return results, nil
+}
+
+// OpenReadCloser reads stored entries straight from the archive, so they
+// seek and ReadAt without any extra work.  Compressed entries are
+// decompressed from the start, and seeking backwards in them starts the
+// decompression again.
+func (fs *zipStreamStore) OpenReadCloser(name string) (straw.StrawReader, error) {
+	e, err := fs.lookup("open", name)
+	if err != nil {
+		return nil, err
+	}
+	if e.isDir {
+		return nil, fmt.Errorf("%s is a directory", name)
+	}
+
+	if e.file.Method == stdzip.Store {
+		off, err := e.file.DataOffset()
+		if err != nil {
+			return nil, err
+		}
+		return &storedReader{
+			io.NewSectionReader(fs.r, off, int64(e.file.CompressedSize64)),
+			e.info(),
+		}, nil
+	}
+
+	rc, err := e.file.Open()
+	if err != nil {
+		return nil, err
+	}
+	return &deflateReader{file: e.file, rc: rc, size: int64(e.file.UncompressedSize64), fi: e.info()}, nil
+}
+
+type storedReader struct {
+	*io.SectionReader
+	fi os.FileInfo
+}
+
+// Stat returns the FileInfo from the archive's directory.
+func (r *storedReader) Stat() (os.FileInfo, error) {
+	return r.fi, nil
+}
+
+func (r *storedReader) Close() error {
+	return nil
+}
+
+type deflateReader struct {
+	file *stdzip.File
+	size int64
+
+	// rc is positioned at pos, while seek is where the next Read should
+	// start from.
+	rc   io.ReadCloser
+	pos  int64
+	seek int64
+
+	fi os.FileInfo
+}
+
+// Stat returns the FileInfo from the archive's directory.
+func (r *deflateReader) Stat() (os.FileInfo, error) {
+	return r.fi, nil
+}
+
+func (r *deflateReader) Seek(offset int64, whence int) (int64, error) {
+	var abs int64
+	switch whence {
+	case io.SeekStart:
+		abs = offset
+	case io.SeekCurrent:
+		abs = r.seek + offset
+	case io.SeekEnd:
+		abs = r.size + offset
+	default:
+		return 0, fmt.Errorf("invalid whence %d", whence)
+	}
+	if abs < 0 {
+		return 0, errors.New("invalid seek position")
+	}
+	r.seek = abs
+	return abs, nil
+}
+
+func (r *deflateReader) Read(buf []byte) (int, error) {
+	if r.rc == nil {
+		return 0, os.ErrClosed
+	}
+	if r.seek != r.pos {
+		if r.seek < r.pos {
+			rc, err := r.file.Open()
+			if err != nil {
+				return 0, err
+			}
+			_ = r.rc.Close()
+			r.rc, r.pos = rc, 0
+		}
+		n, err := io.CopyN(ioutil.Discard, r.rc, r.seek-r.pos)
+		r.pos += n
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := r.rc.Read(buf)
+	r.pos += int64(n)
+	r.seek = r.pos
+	return n, err
+}
+
+// ReadAt decompresses into buf from a fresh reader of its own, so it does
+// not disturb Read and is safe to call concurrently.
+func (r *deflateReader) ReadAt(buf []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("invalid offset")
+	}
+	if off >= r.size {
+		return 0, io.EOF
+	}
+	rc, err := r.file.Open()
+	if err != nil {
+		return 0, err
+	}
+	defer rc.Close()
+
+	if _, err := io.CopyN(ioutil.Discard, rc, off); err != nil {
+		return 0, err
+	}
+	n, err := io.ReadFull(rc, buf)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (r *deflateReader) Close() error {
+	if r.rc == nil {
+		return nil
+	}
+	err := r.rc.Close()
+	r.rc = nil
+	return err
+}
+
+func (fs *zipStreamStore) Mkdir(name string, mode os.FileMode) error {
+	return &os.PathError{Op: "mkdir", Path: name, Err: os.ErrPermission}
+}
+
+func (fs *zipStreamStore) Remove(name string) error {
+	return &os.PathError{Op: "remove", Path: name, Err: os.ErrPermission}
+}
+
+func (fs *zipStreamStore) CreateWriteCloser(name string) (straw.StrawWriter, error) {
+	return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrPermission}
+}